@@ -0,0 +1,306 @@
+package config
+
+import (
+	"airclipboard/server/cache"
+	"airclipboard/slog"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EnvPrefix 环境变量名的前缀，配置项 redis.addr 对应的环境变量为 AIRCLIPBOARD_REDIS_ADDR
+const EnvPrefix = "AIRCLIPBOARD_"
+
+// Config 服务端的全部配置，加载优先级从低到高为：默认值、配置文件、环境变量、命令行参数
+type Config struct {
+	Addr            string        // 服务监听地址
+	ShutdownTimeout time.Duration // 退出时等待进行中请求完成的最长时间
+	ReconnectDelay  time.Duration // 退出时建议客户端等待多久再重连
+	TokenSecret     string        // 签发剪贴板访问令牌的密钥，为空时启动后随机生成
+	Cache           cache.Config  // 缓存配置
+	Board           BoardConfig   // 剪贴板与记录的限制
+	Relay           RelayConfig   // 设备间中转传输的限制
+	Ice             IceConfig     // 下发给客户端的 STUN/TURN 服务器
+	Log             slog.Config   // 日志文件配置
+}
+
+// BoardConfig 剪贴板与记录的限制，字段与 server.Limits 一一对应，由 main 转换后设置
+type BoardConfig struct {
+	DefaultMaxMessages int           // 默认保留的记录条数
+	MaxMessages        int           // 可设置的记录条数上限
+	DefaultMaxBytes    int64         // 默认的总字节数上限
+	MaxBytes           int64         // 可设置的总字节数上限
+	DefaultTTL         time.Duration // 默认的过期时间
+	MaxTTL             time.Duration // 可设置的过期时间上限
+	EmptyBoardTTL      time.Duration // 没有内容的剪贴板的过期时间
+	MaxPinned          int           // 每个剪贴板最多置顶的记录条数
+	PinnedTTL          time.Duration // 有置顶记录的剪贴板的过期时间
+	MaxFileSize        int64         // 单个上传文件的大小上限
+}
+
+// RelayConfig 设备间中转传输的限制，字段与 server.RelayLimits 一一对应
+type RelayConfig struct {
+	MaxTransferBytes int64         // 单次中转每个方向最多转发的字节数
+	Bandwidth        int64         // 单次中转每秒转发的字节数上限，0 表示不限制
+	TotalBandwidth   int64         // 所有中转每秒转发的字节数之和的上限，0 表示不限制
+	AcceptTimeout    time.Duration // 等待接收方接入的时间
+}
+
+// IceConfig 下发给客户端的 STUN/TURN 服务器，字段与 server.IceConfig 一一对应
+type IceConfig struct {
+	StunURLs   []string      // STUN 服务器
+	TurnURLs   []string      // TURN 服务器，为空时不使用 TURN
+	TurnSecret string        // 与 TURN 服务器共享的密钥
+	TurnTTL    time.Duration // TURN 凭据的有效期
+}
+
+// Default 默认配置
+func Default() *Config {
+	return &Config{
+		Addr:            "0.0.0.0:18128",
+		ShutdownTimeout: 30 * time.Second,
+		ReconnectDelay:  3 * time.Second,
+		Cache: cache.Config{
+			CacheType:        cache.CacheTypeMemory,
+			RedisAddr:        "localhost:6379",
+			RedisPassword:    "******",
+			FrontCacheSize:   1000,
+			FrontCacheTTL:    30 * time.Second,
+			DBPath:           "airclipboard.db",
+			CleanInterval:    10 * time.Minute,
+			SnapshotInterval: 5 * time.Minute,
+			Budget:           cache.Budget{MaxBytes: 1 << 30},
+		},
+		Board: BoardConfig{
+			DefaultMaxMessages: 5,
+			MaxMessages:        20,
+			DefaultMaxBytes:    100 << 20,
+			MaxBytes:           200 << 20,
+			DefaultTTL:         6 * time.Hour,
+			MaxTTL:             24 * time.Hour,
+			EmptyBoardTTL:      10 * time.Minute,
+			MaxPinned:          3,
+			PinnedTTL:          7 * 24 * time.Hour,
+			MaxFileSize:        20 << 20,
+		},
+		Relay: RelayConfig{
+			MaxTransferBytes: 1 << 30,
+			Bandwidth:        4 << 20,
+			TotalBandwidth:   32 << 20,
+			AcceptTimeout:    30 * time.Second,
+		},
+		Ice: IceConfig{
+			StunURLs: []string{"stun:stun.l.google.com:19302"},
+			TurnTTL:  time.Hour,
+		},
+		Log: slog.DefaultConfig(),
+	}
+}
+
+// Load 解析命令行参数并按优先级合并配置文件和环境变量，返回配置以及命令行中剩余的参数（子命令）。
+// 配置文件通过 --config 或 AIRCLIPBOARD_CONFIG 指定，根据扩展名识别 YAML 或 TOML 格式
+func Load(name string, args []string) (*Config, []string, error) {
+	c := Default()
+	settings := c.settings()
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	path := fs.String("config", os.Getenv(EnvPrefix+"CONFIG"), "Configuration file (.yaml, .yml or .toml)")
+	pending := make(map[string]*pendingValue, len(settings))
+	for _, s := range settings {
+		pending[s.flag] = &pendingValue{value: s.value}
+		fs.Var(pending[s.flag], s.flag, s.usage)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] [command]\n\n", name)
+		fmt.Fprintf(fs.Output(), "Every flag can also be set in the configuration file or with an %s* environment variable,\n", EnvPrefix)
+		fmt.Fprintf(fs.Output(), "flags take precedence over environment variables, which take precedence over the file.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *path != "" {
+		values, err := readFile(*path)
+		if err != nil {
+			return nil, nil, err
+		}
+		byKey := make(map[string]*setting, len(settings))
+		for _, s := range settings {
+			byKey[s.key] = s
+		}
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s, found := byKey[k]
+			if !found {
+				return nil, nil, fmt.Errorf("%s: unknown setting %q", *path, k)
+			}
+			if err = s.value.Set(values[k]); err != nil {
+				return nil, nil, fmt.Errorf("%s: invalid value for %s: %w", *path, k, err)
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if val, found := os.LookupEnv(s.env()); found {
+			if err := s.value.Set(val); err != nil {
+				return nil, nil, fmt.Errorf("invalid value for %s: %w", s.env(), err)
+			}
+		}
+	}
+
+	for _, s := range settings {
+		for _, val := range pending[s.flag].values {
+			if err := s.value.Set(val); err != nil {
+				return nil, nil, fmt.Errorf("invalid value for --%s: %w", s.flag, err)
+			}
+		}
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, nil, err
+	}
+	return c, fs.Args(), nil
+}
+
+func (c *Config) validate() error {
+	if c.Addr == "" {
+		return errors.New("server.addr is required")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("server.shutdown_timeout must be positive")
+	}
+	if c.ReconnectDelay < 0 {
+		return errors.New("server.reconnect_delay must not be negative")
+	}
+	if c.Cache.CleanInterval <= 0 {
+		return errors.New("cache.clean_interval must be positive")
+	}
+	// 剪贴板设置中的 0 表示使用服务端默认值，默认值和上限本身必须为正数
+	if c.Board.DefaultMaxMessages <= 0 || c.Board.MaxMessages <= 0 {
+		return errors.New("board.default_max_messages and board.max_messages must be positive")
+	}
+	if c.Board.DefaultMaxMessages > c.Board.MaxMessages {
+		return errors.New("board.default_max_messages must not exceed board.max_messages")
+	}
+	if c.Board.DefaultMaxBytes <= 0 || c.Board.MaxBytes <= 0 {
+		return errors.New("board.default_max_bytes and board.max_bytes must be positive")
+	}
+	if c.Board.DefaultMaxBytes > c.Board.MaxBytes {
+		return errors.New("board.default_max_bytes must not exceed board.max_bytes")
+	}
+	if c.Board.DefaultTTL <= 0 || c.Board.MaxTTL <= 0 {
+		return errors.New("board.default_ttl and board.max_ttl must be positive")
+	}
+	if c.Board.DefaultTTL > c.Board.MaxTTL {
+		return errors.New("board.default_ttl must not exceed board.max_ttl")
+	}
+	if c.Board.EmptyBoardTTL <= 0 {
+		return errors.New("board.empty_ttl must be positive")
+	}
+	if c.Board.MaxPinned < 0 {
+		return errors.New("board.max_pinned must not be negative")
+	}
+	if c.Board.PinnedTTL <= 0 {
+		return errors.New("board.pinned_ttl must be positive")
+	}
+	if c.Board.MaxFileSize <= 0 {
+		return errors.New("board.max_file_size must be positive")
+	}
+	if c.Relay.MaxTransferBytes <= 0 {
+		return errors.New("relay.max_transfer_bytes must be positive")
+	}
+	if c.Relay.Bandwidth < 0 || c.Relay.TotalBandwidth < 0 {
+		return errors.New("relay bandwidth must not be negative")
+	}
+	if c.Relay.AcceptTimeout <= 0 {
+		return errors.New("relay.accept_timeout must be positive")
+	}
+	for _, u := range c.Ice.StunURLs {
+		if !strings.HasPrefix(u, "stun:") && !strings.HasPrefix(u, "stuns:") {
+			return fmt.Errorf("invalid STUN url %q in ice.stun_urls", u)
+		}
+	}
+	for _, u := range c.Ice.TurnURLs {
+		if !strings.HasPrefix(u, "turn:") && !strings.HasPrefix(u, "turns:") {
+			return fmt.Errorf("invalid TURN url %q in ice.turn_urls", u)
+		}
+	}
+	if len(c.Ice.TurnURLs) > 0 && c.Ice.TurnSecret == "" {
+		return errors.New("ice.turn_secret is required with ice.turn_urls")
+	}
+	if c.Ice.TurnTTL < time.Minute {
+		return errors.New("ice.turn_ttl must be at least 1m")
+	}
+	if c.Log.ReserveDay < 0 || c.Log.CompressReserveDay < 0 {
+		return errors.New("log retention days must not be negative")
+	}
+	return nil
+}
+
+// String 输出生效的配置，每行一项，密码等敏感内容会被隐藏
+func (c *Config) String() string {
+	var b strings.Builder
+	for _, s := range c.settings() {
+		fmt.Fprintf(&b, "%s = %s\n", s.key, s.display())
+	}
+	return b.String()
+}
+
+// readFile 读取配置文件并展开为 section.key 形式的键值，数组以逗号连接
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tree := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.Unmarshal(data, &tree)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &tree)
+	default:
+		return nil, fmt.Errorf("%s: unsupported configuration format, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	flatten("", tree, values)
+	return values, nil
+}
+
+func flatten(prefix string, tree map[string]interface{}, values map[string]string) {
+	for k, v := range tree {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			flatten(key, v, values)
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[key] = strings.Join(items, ",")
+		case nil:
+			values[key] = ""
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+}
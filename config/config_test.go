@@ -0,0 +1,220 @@
+package config
+
+import (
+	"airclipboard/server"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile 在临时目录中写入配置文件，返回 --config 参数
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return "--config=" + path
+}
+
+// TestDefaultMatchesServer config 中重复的默认值与 server 包中的默认值一致
+func TestDefaultMatchesServer(t *testing.T) {
+	c := Default()
+	if got := server.Limits(c.Board); got != server.BoardLimits {
+		t.Errorf("board defaults = %+v, want %+v", got, server.BoardLimits)
+	}
+	if got := server.RelayLimits(c.Relay); got != server.PeerRelayLimits {
+		t.Errorf("relay defaults = %+v, want %+v", got, server.PeerRelayLimits)
+	}
+	if got := server.IceConfig(c.Ice); !reflect.DeepEqual(got, server.PeerIceConfig) {
+		t.Errorf("ice defaults = %+v, want %+v", got, server.PeerIceConfig)
+	}
+}
+
+// TestLoadPrecedence 命令行参数优先于环境变量，环境变量优先于配置文件，配置文件优先于默认值
+func TestLoadPrecedence(t *testing.T) {
+	yaml := "server:\n  addr: file:1\n  shutdown_timeout: 5s\nboard:\n  max_messages: 30\nice:\n  stun_urls: [stun:a.example, stun:b.example]\n"
+	toml := "[server]\naddr = \"file:1\"\nshutdown_timeout = \"5s\"\n[board]\nmax_messages = 30\n[ice]\nstun_urls = [\"stun:a.example\", \"stun:b.example\"]\n"
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		env      map[string]string
+		args     []string
+		addr     string
+		shutdown time.Duration
+		maxMsgs  int
+		stun     []string
+	}{
+		{
+			name:     "defaults",
+			addr:     "0.0.0.0:18128",
+			shutdown: 30 * time.Second,
+			maxMsgs:  20,
+			stun:     []string{"stun:stun.l.google.com:19302"},
+		},
+		{
+			name:     "yaml file",
+			file:     "config.yaml",
+			content:  yaml,
+			addr:     "file:1",
+			shutdown: 5 * time.Second,
+			maxMsgs:  30,
+			stun:     []string{"stun:a.example", "stun:b.example"},
+		},
+		{
+			name:     "toml file",
+			file:     "config.toml",
+			content:  toml,
+			addr:     "file:1",
+			shutdown: 5 * time.Second,
+			maxMsgs:  30,
+			stun:     []string{"stun:a.example", "stun:b.example"},
+		},
+		{
+			name:     "env over file",
+			file:     "config.yaml",
+			content:  yaml,
+			env:      map[string]string{"AIRCLIPBOARD_SERVER_ADDR": "env:2", "AIRCLIPBOARD_ICE_STUN_URLS": "stun:env.example"},
+			addr:     "env:2",
+			shutdown: 5 * time.Second,
+			maxMsgs:  30,
+			stun:     []string{"stun:env.example"},
+		},
+		{
+			name:     "flags over env",
+			file:     "config.toml",
+			content:  toml,
+			env:      map[string]string{"AIRCLIPBOARD_SERVER_ADDR": "env:2", "AIRCLIPBOARD_BOARD_MAX_MESSAGES": "40"},
+			args:     []string{"--addr=flag:3", "--shutdown-timeout=7s"},
+			addr:     "flag:3",
+			shutdown: 7 * time.Second,
+			maxMsgs:  40,
+			stun:     []string{"stun:a.example", "stun:b.example"},
+		},
+		{
+			name:     "flags without file",
+			env:      map[string]string{"AIRCLIPBOARD_SERVER_ADDR": "env:2"},
+			args:     []string{"--addr=flag:3", "--board-max-messages=50", "--ice-stun-urls=stun:flag.example"},
+			addr:     "flag:3",
+			shutdown: 30 * time.Second,
+			maxMsgs:  50,
+			stun:     []string{"stun:flag.example"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(EnvPrefix+"CONFIG", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{writeFile(t, tt.file, tt.content)}, args...)
+			}
+			c, rest, err := Load("airclipboard", append(args, "migrate-redis"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Addr != tt.addr || c.ShutdownTimeout != tt.shutdown || c.Board.MaxMessages != tt.maxMsgs || !reflect.DeepEqual(c.Ice.StunURLs, tt.stun) {
+				t.Fatalf("got addr=%s shutdown=%v max_messages=%d stun=%v, want %s %v %d %v",
+					c.Addr, c.ShutdownTimeout, c.Board.MaxMessages, c.Ice.StunURLs, tt.addr, tt.shutdown, tt.maxMsgs, tt.stun)
+			}
+			if !reflect.DeepEqual(rest, []string{"migrate-redis"}) {
+				t.Fatalf("remaining args = %v, want [migrate-redis]", rest)
+			}
+		})
+	}
+}
+
+// TestLoadErrors 配置文件中未知的配置项、无法解析的值和不支持的格式都返回错误
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		env     map[string]string
+		want    string
+	}{
+		{name: "unknown setting", file: "config.yaml", content: "server:\n  port: 1\n", want: `unknown setting "server.port"`},
+		{name: "invalid file value", file: "config.toml", content: "[board]\nmax_messages = \"many\"\n", want: "invalid value for board.max_messages"},
+		{name: "unsupported format", file: "config.json", content: "{}", want: "unsupported configuration format"},
+		{name: "invalid env value", env: map[string]string{"AIRCLIPBOARD_BOARD_DEFAULT_TTL": "soon"}, want: "invalid value for AIRCLIPBOARD_BOARD_DEFAULT_TTL"},
+		{name: "validated after merging", env: map[string]string{"AIRCLIPBOARD_BOARD_MAX_MESSAGES": "3"}, want: "board.default_max_messages must not exceed board.max_messages"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(EnvPrefix+"CONFIG", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			var args []string
+			if tt.file != "" {
+				args = append(args, writeFile(t, tt.file, tt.content))
+			}
+			if _, _, err := Load("airclipboard", args); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Load() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestValidate 每项检查各自返回对应配置项的错误
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   string
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"empty addr", func(c *Config) { c.Addr = "" }, "server.addr is required"},
+		{"shutdown timeout", func(c *Config) { c.ShutdownTimeout = 0 }, "server.shutdown_timeout must be positive"},
+		{"reconnect delay", func(c *Config) { c.ReconnectDelay = -time.Second }, "server.reconnect_delay must not be negative"},
+		{"clean interval", func(c *Config) { c.Cache.CleanInterval = 0 }, "cache.clean_interval must be positive"},
+		{"max messages", func(c *Config) { c.Board.MaxMessages = 0 }, "board.default_max_messages and board.max_messages must be positive"},
+		{"default max messages", func(c *Config) { c.Board.DefaultMaxMessages = 21 }, "board.default_max_messages must not exceed board.max_messages"},
+		{"max bytes", func(c *Config) { c.Board.DefaultMaxBytes = 0 }, "board.default_max_bytes and board.max_bytes must be positive"},
+		{"default max bytes", func(c *Config) { c.Board.DefaultMaxBytes = 300 << 20 }, "board.default_max_bytes must not exceed board.max_bytes"},
+		{"ttl", func(c *Config) { c.Board.MaxTTL = 0 }, "board.default_ttl and board.max_ttl must be positive"},
+		{"default ttl", func(c *Config) { c.Board.DefaultTTL = 48 * time.Hour }, "board.default_ttl must not exceed board.max_ttl"},
+		{"empty ttl", func(c *Config) { c.Board.EmptyBoardTTL = 0 }, "board.empty_ttl must be positive"},
+		{"max pinned", func(c *Config) { c.Board.MaxPinned = -1 }, "board.max_pinned must not be negative"},
+		{"no pinned", func(c *Config) { c.Board.MaxPinned = 0 }, ""},
+		{"pinned ttl", func(c *Config) { c.Board.PinnedTTL = 0 }, "board.pinned_ttl must be positive"},
+		{"max file size", func(c *Config) { c.Board.MaxFileSize = 0 }, "board.max_file_size must be positive"},
+		{"max transfer bytes", func(c *Config) { c.Relay.MaxTransferBytes = 0 }, "relay.max_transfer_bytes must be positive"},
+		{"bandwidth", func(c *Config) { c.Relay.Bandwidth = -1 }, "relay bandwidth must not be negative"},
+		{"total bandwidth", func(c *Config) { c.Relay.TotalBandwidth = -1 }, "relay bandwidth must not be negative"},
+		{"unlimited bandwidth", func(c *Config) { c.Relay.Bandwidth, c.Relay.TotalBandwidth = 0, 0 }, ""},
+		{"accept timeout", func(c *Config) { c.Relay.AcceptTimeout = 0 }, "relay.accept_timeout must be positive"},
+		{"stun url", func(c *Config) { c.Ice.StunURLs = []string{"turn:a.example"} }, `invalid STUN url "turn:a.example" in ice.stun_urls`},
+		{"turn url", func(c *Config) { c.Ice.TurnURLs = []string{"a.example:3478"} }, `invalid TURN url "a.example:3478" in ice.turn_urls`},
+		{"turn secret", func(c *Config) { c.Ice.TurnURLs = []string{"turn:a.example:3478"} }, "ice.turn_secret is required with ice.turn_urls"},
+		{"turn ttl", func(c *Config) {
+			c.Ice.TurnURLs, c.Ice.TurnSecret, c.Ice.TurnTTL = []string{"turns:a.example:5349"}, "secret", 30*time.Second
+		}, "ice.turn_ttl must be at least 1m"},
+		{"turn", func(c *Config) {
+			c.Ice.TurnURLs, c.Ice.TurnSecret = []string{"turn:a.example:3478?transport=tcp"}, "secret"
+		}, ""},
+		{"log retention", func(c *Config) { c.Log.ReserveDay = -1 }, "log retention days must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			tt.modify(c)
+			err := c.validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("validate() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"flag"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// setting 一个配置项，配置文件、环境变量和命令行参数都通过 value 写入 Config 中对应的字段
+type setting struct {
+	key    string // 配置文件中的路径，如 redis.addr
+	flag   string // 命令行参数名，沿用已有的参数名
+	usage  string
+	value  flag.Value
+	secret bool // 输出生效配置时隐藏
+}
+
+// env 配置项对应的环境变量名
+func (s *setting) env() string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(s.key))
+}
+
+// display 输出生效配置时显示的值，URL 只隐藏其中的密码
+func (s *setting) display() string {
+	val := s.value.String()
+	if !s.secret || val == "" {
+		return val
+	}
+	if u, err := url.Parse(val); err == nil && u.Scheme != "" && u.Host != "" {
+		return u.Redacted()
+	}
+	return "******"
+}
+
+// settingList 借助 flag.FlagSet 生成绑定到字段的 flag.Value
+type settingList struct {
+	binder   *flag.FlagSet
+	settings []*setting
+}
+
+func (l *settingList) add(key, name, usage string) *setting {
+	s := &setting{key: key, flag: name, usage: usage, value: l.binder.Lookup(name).Value}
+	l.settings = append(l.settings, s)
+	return s
+}
+
+func (l *settingList) string(p *string, key, name, usage string) *setting {
+	l.binder.StringVar(p, name, *p, usage)
+	return l.add(key, name, usage)
+}
+
+func (l *settingList) int(p *int, key, name, usage string) *setting {
+	l.binder.IntVar(p, name, *p, usage)
+	return l.add(key, name, usage)
+}
+
+func (l *settingList) int64(p *int64, key, name, usage string) *setting {
+	l.binder.Int64Var(p, name, *p, usage)
+	return l.add(key, name, usage)
+}
+
+func (l *settingList) bool(p *bool, key, name, usage string) *setting {
+	l.binder.BoolVar(p, name, *p, usage)
+	return l.add(key, name, usage)
+}
+
+func (l *settingList) duration(p *time.Duration, key, name, usage string) *setting {
+	l.binder.DurationVar(p, name, *p, usage)
+	return l.add(key, name, usage)
+}
+
+func (l *settingList) list(p *[]string, key, name, usage string) *setting {
+	l.binder.Var((*listValue)(p), name, usage)
+	return l.add(key, name, usage)
+}
+
+// settings 所有配置项，顺序即输出生效配置时的顺序
+func (c *Config) settings() []*setting {
+	l := &settingList{binder: flag.NewFlagSet("", flag.ContinueOnError)}
+
+	l.string(&c.Addr, "server.addr", "addr", "Address the server listens on")
+	l.duration(&c.ShutdownTimeout, "server.shutdown_timeout", "shutdown-timeout", "Time to wait for in-flight requests on shutdown")
+	l.duration(&c.ReconnectDelay, "server.reconnect_delay", "reconnect-delay", "Delay clients are told to wait before reconnecting when the server restarts")
+	l.string(&c.TokenSecret, "server.token_secret", "token-secret", "Secret used to sign board access tokens, must be the same on every instance (random if empty)").secret = true
+
+	l.string(&c.Cache.CacheType, "cache.type", "cache-type", "Cache type (memory, redis or sqlite)")
+	l.duration(&c.Cache.CleanInterval, "cache.clean_interval", "cache-clean-interval", "Interval of cleaning expired boards")
+	l.int(&c.Cache.Budget.MaxBoards, "cache.max_boards", "max-boards", "Maximum number of boards, least recently used boards are evicted beyond it (0 means no limit)")
+	l.int64(&c.Cache.Budget.MaxBytes, "cache.max_bytes", "cache-max-bytes", "Maximum total bytes of all boards, least recently used boards are evicted beyond it (0 means no limit)")
+	l.string(&c.Cache.DBPath, "cache.db_path", "db-path", "Path of the SQLite database file")
+	l.string(&c.Cache.BlobDir, "cache.blob_dir", "blob-dir", "Directory to store file contents in (stored in the cache when empty)")
+	l.string(&c.Cache.SnapshotPath, "cache.snapshot_path", "snapshot-path", "Snapshot file of the memory cache (no snapshot when empty)")
+	l.duration(&c.Cache.SnapshotInterval, "cache.snapshot_interval", "snapshot-interval", "Interval of saving the memory cache snapshot (only on shutdown when 0)")
+
+	l.string(&c.Cache.RedisAddr, "redis.addr", "redis-addr", "Address of the Redis server")
+	l.string(&c.Cache.RedisPassword, "redis.password", "redis-password", "Password for the Redis server").secret = true
+	l.int(&c.Cache.RedisDB, "redis.db", "redis-db", "Redis database number")
+	l.string(&c.Cache.RedisURL, "redis.url", "redis-url", "Redis URL (redis:// or rediss://), overrides the address, password and database number").secret = true
+	l.string(&c.Cache.RedisUsername, "redis.username", "redis-username", "ACL username for the Redis server")
+	l.string(&c.Cache.RedisSentinelMaster, "redis.sentinel_master", "redis-sentinel-master", "Name of the master monitored by Redis Sentinel")
+	l.list(&c.Cache.RedisSentinelAddrs, "redis.sentinel_addrs", "redis-sentinel-addrs", "Comma separated addresses of the Redis Sentinel nodes")
+	l.string(&c.Cache.RedisSentinelUsername, "redis.sentinel_username", "redis-sentinel-username", "ACL username for the Redis Sentinel nodes")
+	l.string(&c.Cache.RedisSentinelPassword, "redis.sentinel_password", "redis-sentinel-password", "Password for the Redis Sentinel nodes").secret = true
+	l.list(&c.Cache.RedisClusterAddrs, "redis.cluster_addrs", "redis-cluster-addrs", "Comma separated seed addresses of the Redis Cluster")
+	l.bool(&c.Cache.RedisTLS, "redis.tls", "redis-tls", "Connect to Redis over TLS")
+	l.string(&c.Cache.RedisTLSCA, "redis.tls_ca", "redis-tls-ca", "CA certificate file to verify the Redis server (system roots when empty)")
+	l.string(&c.Cache.RedisTLSCert, "redis.tls_cert", "redis-tls-cert", "Client certificate file for Redis TLS")
+	l.string(&c.Cache.RedisTLSKey, "redis.tls_key", "redis-tls-key", "Client private key file for Redis TLS")
+	l.string(&c.Cache.RedisKeyPrefix, "redis.key_prefix", "redis-key-prefix", "Prefix of all Redis keys")
+	l.int(&c.Cache.FrontCacheSize, "redis.front_cache_size", "redis-front-cache-size", "Number of boards cached in process in front of Redis (0 disables the front cache)")
+	l.duration(&c.Cache.FrontCacheTTL, "redis.front_cache_ttl", "redis-front-cache-ttl", "TTL of the boards cached in process in front of Redis")
+
+	l.int(&c.Board.DefaultMaxMessages, "board.default_max_messages", "board-default-max-messages", "Default number of messages a board keeps")
+	l.int(&c.Board.MaxMessages, "board.max_messages", "board-max-messages", "Upper bound of the messages a board can keep")
+	l.int64(&c.Board.DefaultMaxBytes, "board.default_max_bytes", "board-default-max-bytes", "Default total bytes a board keeps")
+	l.int64(&c.Board.MaxBytes, "board.max_bytes", "board-max-bytes", "Upper bound of the total bytes a board can keep")
+	l.duration(&c.Board.DefaultTTL, "board.default_ttl", "board-default-ttl", "Default TTL of a board with messages")
+	l.duration(&c.Board.MaxTTL, "board.max_ttl", "board-max-ttl", "Upper bound of the board TTL")
+	l.duration(&c.Board.EmptyBoardTTL, "board.empty_ttl", "board-empty-ttl", "TTL of a board without messages")
+	l.int(&c.Board.MaxPinned, "board.max_pinned", "board-max-pinned", "Maximum number of pinned messages per board")
+	l.duration(&c.Board.PinnedTTL, "board.pinned_ttl", "pinned-ttl", "TTL of boards with pinned messages")
+	l.int64(&c.Board.MaxFileSize, "board.max_file_size", "max-file-size", "Maximum size of an uploaded file in bytes")
+
+	l.int64(&c.Relay.MaxTransferBytes, "relay.max_transfer_bytes", "relay-max-transfer-bytes", "Maximum bytes relayed in each direction of a transfer between peers without WebRTC")
+	l.int64(&c.Relay.Bandwidth, "relay.bandwidth", "relay-bandwidth", "Maximum bytes per second of a relayed transfer (0 means no limit)")
+	l.int64(&c.Relay.TotalBandwidth, "relay.total_bandwidth", "relay-total-bandwidth", "Maximum bytes per second of all relayed transfers (0 means no limit)")
+	l.duration(&c.Relay.AcceptTimeout, "relay.accept_timeout", "relay-accept-timeout", "Time to wait for the recipient to accept a relayed transfer")
+
+	l.list(&c.Ice.StunURLs, "ice.stun_urls", "ice-stun-urls", "Comma separated STUN server urls sent to clients for WebRTC")
+	l.list(&c.Ice.TurnURLs, "ice.turn_urls", "ice-turn-urls", "Comma separated TURN server urls sent to clients for WebRTC (no TURN when empty)")
+	l.string(&c.Ice.TurnSecret, "ice.turn_secret", "ice-turn-secret", "Secret shared with the TURN server to create time-limited credentials (TURN REST API)").secret = true
+	l.duration(&c.Ice.TurnTTL, "ice.turn_ttl", "ice-turn-ttl", "Lifetime of the TURN credentials sent to clients")
+
+	l.string(&c.Log.Dir, "log.dir", "log-dir", "Directory of the log files")
+	l.string(&c.Log.Prefix, "log.prefix", "log-prefix", "File name prefix of the log files")
+	l.bool(&c.Log.Compress, "log.compress", "log-compress", "Compress log files older than the reserve days")
+	l.int(&c.Log.ReserveDay, "log.reserve_days", "log-reserve-days", "Days to keep uncompressed log files")
+	l.int(&c.Log.CompressReserveDay, "log.compress_reserve_days", "log-compress-reserve-days", "Days to keep compressed log files after the reserve days")
+
+	return l.settings
+}
+
+// listValue 以逗号分隔的列表，忽略空白项
+type listValue []string
+
+func (v *listValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return strings.Join(*v, ",")
+}
+
+func (v *listValue) Set(s string) error {
+	items := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	*v = items
+	return nil
+}
+
+// pendingValue 先记录命令行参数的值，在配置文件和环境变量之后再写入，保证命令行参数优先
+type pendingValue struct {
+	value  flag.Value
+	values []string
+}
+
+func (v *pendingValue) String() string {
+	if v == nil || v.value == nil {
+		return ""
+	}
+	return v.value.String()
+}
+
+func (v *pendingValue) Set(s string) error {
+	v.values = append(v.values, s)
+	return nil
+}
+
+// IsBoolFlag 布尔参数可以省略值，如 --redis-tls
+func (v *pendingValue) IsBoolFlag() bool {
+	b, ok := v.value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"airclipboard/common"
+	"airclipboard/config"
 	"airclipboard/server"
 	"airclipboard/server/cache"
 	"airclipboard/slog"
+	"context"
 	"embed"
 	"errors"
 	"flag"
@@ -15,6 +17,9 @@ import (
 	"io/fs"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 	"unicode"
 )
@@ -23,40 +28,71 @@ import (
 var content embed.FS
 
 func main() {
-	cacheType := flag.String("cache-type", "memory", "Cache type (memory or redis)")
-	redisAddr := flag.String("redis-addr", "localhost:6379", "Address of the Redis server")
-	redisPassword := flag.String("redis-password", "******", "Password for the Redis server")
-	redisDB := flag.Int("redis-db", 0, "Redis database number")
-
-	flag.Parse()
+	cfg, args, err := config.Load(os.Args[0], os.Args[1:])
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	// config 不依赖 server，字段相同的结构体直接转换
+	server.BoardLimits = server.Limits(cfg.Board)
+	server.PeerRelayLimits = server.RelayLimits(cfg.Relay)
+	server.PeerIceConfig = server.IceConfig(cfg.Ice)
+	server.BoardTokenSecret = cfg.TokenSecret
+
+	logWriter := slog.Init(cfg.Log) // 日志初始化
+	log.Printf("Effective config:\n%s", cfg)
+
+	// 子命令执行完成后直接退出，不启动服务
+	if len(args) > 0 {
+		runCommand(cfg.Cache, args)
+		return
+	}
 
-	slog.Init() // 日志初始化
+	cache.OnExpire(server.OnBoardExpired)
+	cache.OnBroadcast(server.OnBoardEventBroadcast)
+	cache.InitCache(cfg.Cache)
 
-	config := cache.Config{
-		CacheType:     *cacheType,
-		RedisAddr:     *redisAddr,
-		RedisPassword: *redisPassword,
-		RedisDB:       *redisDB,
+	r := gin.New()
+	peerServer := server.NewPeerServer()
+	initRoute(r, peerServer)
+	log.Printf("Start server @ %s", cfg.Addr)
+	srv := &http.Server{Addr: cfg.Addr, Handler: r}
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start: %s", err.Error())
+		}
+	}()
+
+	// 收到退出信号后先通知 WebSocket 和 SSE 客户端稍后重连，再停止接收请求并等待进行中的请求（如上传）完成，
+	// 最后关闭缓存（内存缓存此时保存快照，Redis 关闭连接）和日志文件
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	log.Println("Shutting down server...")
+	peerServer.Shutdown(cfg.ReconnectDelay)
+	server.CloseEventStreams(cfg.ReconnectDelay)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("ERROR: shutdown server failed: %v", err)
 	}
-	cache.InitCache(config)
+	cache.CloseCache()
+	log.Println("Server exited")
 
-	r := gin.New()
-	initRoute(r)
-	base := fmt.Sprintf("%s:%d", "0.0.0.0", 18128)
-	log.Printf("Start server @ %s", base)
-	srv := &http.Server{Addr: base, Handler: r}
-	err := srv.ListenAndServe()
-	if err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Fatalf("Failed to start: %s", err.Error())
+	log.SetOutput(os.Stdout) // 日志文件关闭后再写入会重新打开
+	if err := logWriter.Close(); err != nil {
+		log.Printf("ERROR: close log file failed: %v", err)
 	}
 }
 
-func initRoute(e *gin.Engine) {
+func initRoute(e *gin.Engine, peerServer *server.PeerServer) {
 	Cors(e)
-	peerServer := server.NewPeerServer()
 	e.GET("/server/webrtc", func(c *gin.Context) {
 		peerServer.HandleConnection(c)
 	})
+	e.GET("/server/relay", func(c *gin.Context) {
+		peerServer.HandleRelay(c)
+	})
 
 	// 静态文件路由
 	e.GET("/service-worker.js", func(c *gin.Context) {
@@ -84,14 +120,19 @@ func initRoute(e *gin.Engine) {
 
 	e.GET("/", func(c *gin.Context) {
 		realIp := server.LogApiRequestIP(c, "Index", -1)
+		ctx := c.Request.Context()
 
 		var board string
 
 		if cookie, err := c.Request.Cookie("board"); err == nil && cookie.Value != "" {
 			board = cookie.Value
 		} else {
-			// 默认同网络内的同名板块
-			if boardExist, ok := cache.GetBoardNameFromCache(realIp); ok {
+			// 默认同网络内的同名板块，缓存不可用时不影响打开页面
+			boardExist, ok, err := cache.GetBoardNameFromCache(ctx, realIp)
+			if err != nil {
+				log.Printf("读取IP对应的剪贴板失败，err=%v", err)
+			}
+			if ok {
 				board = boardExist
 			} else {
 				// 生成6位随机字符串，只包含数字和小写字母
@@ -99,7 +140,9 @@ func initRoute(e *gin.Engine) {
 			}
 			c.Header("Set-Cookie", "board="+board+";SameSite=Strict;Secure")
 		}
-		cache.SetBoardNameToCache(realIp, board, time.Hour*48)
+		if err := cache.SetBoardNameToCache(ctx, realIp, board, time.Hour*48); err != nil {
+			log.Printf("保存IP对应的剪贴板失败，err=%v", err)
+		}
 		c.HTML(200, "index.html", gin.H{"Board": board})
 	})
 
@@ -115,10 +158,17 @@ func initRoute(e *gin.Engine) {
 	})
 
 	mfApi := e.Group("/boardapi")
-	mfApi.GET("/:board", server.FetchBoard)
-	mfApi.POST("/:board", server.AddMessage)
-	mfApi.DELETE("/:board/:id", server.DeleteMessage)
-	mfApi.GET("/:board/:id", server.GetMessage)
+	mfApi.GET("/:board", server.BoardAuth, server.FetchBoard)
+	mfApi.POST("/:board", server.BoardAuth, server.AddMessage)
+	mfApi.POST("/:board/upload", server.BoardAuth, server.UploadMessage)
+	mfApi.GET("/:board/events", server.BoardAuth, server.BoardEventStream)
+	mfApi.PUT("/:board/password", server.SetBoardPassword)
+	mfApi.PUT("/:board/settings", server.BoardAuth, server.SetBoardSettings)
+	mfApi.POST("/:board/auth", server.AuthBoard)
+	mfApi.DELETE("/:board/:id", server.BoardAuth, server.DeleteMessage)
+	mfApi.GET("/:board/:id", server.BoardAuth, server.GetMessage)
+	mfApi.PUT("/:board/:id/pin", server.BoardAuth, server.PinMessage)
+	mfApi.DELETE("/:board/:id/pin", server.BoardAuth, server.UnpinMessage)
 }
 
 func Cors(r *gin.Engine) {
@@ -150,6 +200,25 @@ func truncateBoard(board string) string {
 	return string(runes)
 }
 
+// runCommand 执行子命令，用法：airclipboard [flags] <command> [command flags]
+func runCommand(config cache.Config, args []string) {
+	switch args[0] {
+	case "migrate-redis-keys":
+		// 将旧前缀下的 key 迁移到 --redis-key-prefix 指定的前缀下
+		cmd := flag.NewFlagSet(args[0], flag.ExitOnError)
+		from := cmd.String("from", "", "Prefix the keys are currently stored under")
+		_ = cmd.Parse(args[1:])
+
+		migrated, err := cache.MigrateRedisKeys(config, *from)
+		if err != nil {
+			log.Fatalf("Failed to migrate Redis keys: %v", err)
+		}
+		log.Printf("Migrated %d boards from prefix %q to %q", migrated, *from, config.RedisKeyPrefix)
+	default:
+		log.Fatalf("Unknown command: %s", args[0])
+	}
+}
+
 func isChinese(r rune) bool {
 	return unicode.Is(unicode.Han, r)
 }
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"airclipboard/common"
+	"airclipboard/server/cache"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BoardTokenTTL     = time.Hour * 48
+	MaxPasswordLength = 72 // bcrypt 最多只使用前 72 字节
+
+	boardTokenHeader = "X-Board-Token"
+	boardTokenCookie = "board_token"
+
+	boardCreatorHeader = "X-Board-Creator-Token"
+	boardCreatorCookie = "board_creator"
+
+	// authAttemptWindow 内同一连接地址最多输错 authAddrAttemptLimit 次密码，同一剪贴板最多被输错 authBoardAttemptLimit 次，
+	// 超出后在窗口结束前拒绝验证，防止穷举
+	authAttemptWindow     = 10 * time.Minute
+	authAddrAttemptLimit  = 10
+	authBoardAttemptLimit = 30
+)
+
+// BoardTokenSecret 签发访问令牌的服务端密钥，多实例部署时各实例必须相同，为空时进程启动后随机生成
+var BoardTokenSecret string
+
+var (
+	errPasswordSet = errors.New("password already set")
+	errNotCreator  = errors.New("not the creator of the board")
+
+	tokenSecret     []byte
+	tokenSecretOnce sync.Once
+
+	authAddrFailures  = newAttemptLimiter(authAddrAttemptLimit, authAttemptWindow)
+	authBoardFailures = newAttemptLimiter(authBoardAttemptLimit, authAttemptWindow)
+)
+
+type PasswordReq struct {
+	Password string `json:"password"`
+}
+
+type BoardToken struct {
+	Board    string `json:"board"`
+	Token    string `json:"token"`
+	ExpireAt string `json:"expireAt"`
+}
+
+// SetBoardPassword 创建剪贴板时设置访问密码，只允许对不存在、或者尚无内容且未设置密码的剪贴板设置。
+// 剪贴板已存在时需要提供创建时颁发的创建者令牌，避免他人抢先为刚打开的剪贴板设置密码
+func SetBoardPassword(c *gin.Context) {
+	board := c.Param("board")
+	if board == "" {
+		common.ErrorStrResp(c, "board not found ！", http.StatusNotFound)
+		return
+	}
+
+	LogApiRequestIP(c, "SetBoardPassword: "+board, -1)
+
+	if board == "public" {
+		common.ErrorStrResp(c, "public board can not be protected ！", http.StatusForbidden)
+		return
+	}
+
+	var req PasswordReq
+	if err := c.ShouldBindJSON(&req); err != nil || req.Password == "" {
+		common.ErrorStrResp(c, "password is required ！", http.StatusBadRequest)
+		return
+	}
+	if len(req.Password) > MaxPasswordLength {
+		common.ErrorStrResp(c, fmt.Sprintf("password must be at most %d bytes ！", MaxPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	ctx := c.Request.Context()
+	msgs, created, err := ensureBoard(c, board)
+	if err != nil {
+		writeCacheError(c, err)
+		return
+	}
+	if len(msgs) > 0 {
+		common.ErrorStrResp(c, "password can only be set on a new board ！", http.StatusConflict)
+		return
+	}
+	token := ""
+	if !created {
+		token = requestCreatorToken(c)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("生成密码哈希失败，err=%v", err)
+		common.ErrorStrResp(c, "请求失败！", http.StatusInternalServerError)
+		return
+	}
+	// 在缓存的原子操作中检查并写入，避免并发请求互相覆盖密码或其他元数据
+	err = cache.UpdateBoardMeta(ctx, board, func(meta *cache.BoardMeta) error {
+		if !created && !verifyCreator(meta, token) {
+			return errNotCreator
+		}
+		if meta.PasswordHash != "" {
+			return errPasswordSet
+		}
+		meta.PasswordHash = string(hash)
+		return nil
+	})
+	if errors.Is(err, errNotCreator) {
+		common.ErrorStrResp(c, "only the creator of the board can set its password ！", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, errPasswordSet) {
+		common.ErrorStrResp(c, "password can only be set on a new board ！", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeCacheError(c, err)
+		return
+	}
+
+	issueBoardToken(c, board, string(hash))
+}
+
+// AuthBoard 验证剪贴板密码，验证通过后颁发访问令牌
+func AuthBoard(c *gin.Context) {
+	board := c.Param("board")
+	if board == "" {
+		common.ErrorStrResp(c, "board not found ！", http.StatusNotFound)
+		return
+	}
+
+	LogApiRequestIP(c, "AuthBoard: "+board, -1)
+	// 请求头中的 IP 可以伪造，按连接地址计数
+	addr := remoteHost(c.Request)
+	if !authAddrFailures.allow(addr) || !authBoardFailures.allow(board) {
+		common.ErrorStrResp(c, "too many wrong passwords, please try again later ！", http.StatusTooManyRequests)
+		return
+	}
+
+	var req PasswordReq
+	if err := c.ShouldBindJSON(&req); err != nil || req.Password == "" {
+		common.ErrorStrResp(c, "password is required ！", http.StatusBadRequest)
+		return
+	}
+
+	meta, ok, err := cache.GetBoardMetaFromCache(c.Request.Context(), board)
+	if err != nil {
+		writeCacheError(c, err)
+		return
+	}
+	if !ok || meta.PasswordHash == "" {
+		common.ErrorStrResp(c, "board is not protected ！", http.StatusBadRequest)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(meta.PasswordHash), []byte(req.Password)); err != nil {
+		authAddrFailures.fail(addr)
+		authBoardFailures.fail(board)
+		common.ErrorStrResp(c, "wrong password ！", http.StatusUnauthorized)
+		return
+	}
+
+	issueBoardToken(c, board, meta.PasswordHash)
+}
+
+// BoardAuth 校验受密码保护剪贴板的访问令牌，令牌可通过 X-Board-Token 请求头或 Cookie 传递，
+// 无法读取元数据时拒绝访问，避免缓存故障期间跳过密码校验
+func BoardAuth(c *gin.Context) {
+	board := c.Param("board")
+
+	meta, ok, err := cache.GetBoardMetaFromCache(c.Request.Context(), board)
+	if err != nil {
+		writeCacheError(c, err)
+		return
+	}
+	if !ok || meta.PasswordHash == "" {
+		c.Next()
+		return
+	}
+
+	token := c.GetHeader(boardTokenHeader)
+	if token == "" {
+		token, _ = c.Cookie(boardTokenCookie)
+	}
+	if !verifyBoardToken(board, meta.PasswordHash, token) {
+		common.ErrorStrResp(c, "board is password protected ！", http.StatusUnauthorized)
+		return
+	}
+	c.Next()
+}
+
+func issueBoardToken(c *gin.Context, board, passwordHash string) {
+	expireAt := time.Now().Add(BoardTokenTTL)
+	token := signBoardToken(board, passwordHash, expireAt)
+
+	// Cookie 仅对当前剪贴板的接口生效，便于图片和文件直接通过链接访问
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(boardTokenCookie, token, int(BoardTokenTTL.Seconds()), "/boardapi/"+url.PathEscape(board), "", false, true)
+
+	common.SuccessResp(c, BoardToken{
+		Board:    board,
+		Token:    token,
+		ExpireAt: expireAt.Format("2006-01-02 15:04:05"),
+	})
+}
+
+// issueCreatorToken 向创建剪贴板的请求颁发创建者令牌，浏览器以 HttpOnly Cookie 保存，其他客户端从响应头读取
+func issueCreatorToken(c *gin.Context, board, token string) {
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(boardCreatorCookie, token, int(BoardLimits.EmptyBoardTTL.Seconds()), "/boardapi/"+url.PathEscape(board), "", false, true)
+	c.Header(boardCreatorHeader, token)
+}
+
+// requestCreatorToken 从 X-Board-Creator-Token 请求头或 Cookie 中读取创建者令牌
+func requestCreatorToken(c *gin.Context) string {
+	token := c.GetHeader(boardCreatorHeader)
+	if token == "" {
+		token, _ = c.Cookie(boardCreatorCookie)
+	}
+	return token
+}
+
+// creatorHash 缓存中只保存创建者令牌的哈希
+func creatorHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyCreator 校验创建者令牌，未记录创建者的剪贴板不允许任何人通过令牌校验
+func verifyCreator(meta *cache.BoardMeta, token string) bool {
+	if meta.CreatorHash == "" || token == "" {
+		return false
+	}
+	return hmac.Equal([]byte(creatorHash(token)), []byte(meta.CreatorHash))
+}
+
+// signBoardToken 令牌格式为 过期时间戳.签名，签名以服务端密钥为密钥并包含密码哈希，修改密码后旧令牌自动失效。
+// 只能读取缓存、拿不到服务端密钥时无法伪造令牌
+func signBoardToken(board, passwordHash string, expireAt time.Time) string {
+	expire := strconv.FormatInt(expireAt.Unix(), 10)
+	mac := hmac.New(sha256.New, boardTokenSecret())
+	mac.Write([]byte(passwordHash + "|" + board + "|" + expire))
+	return expire + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// boardTokenSecret 未配置 BoardTokenSecret 时生成随机密钥，重启后之前签发的令牌失效
+func boardTokenSecret() []byte {
+	tokenSecretOnce.Do(func() {
+		if BoardTokenSecret != "" {
+			tokenSecret = []byte(BoardTokenSecret)
+			return
+		}
+		tokenSecret = make([]byte, 32)
+		if _, err := rand.Read(tokenSecret); err != nil {
+			log.Fatalf("生成令牌密钥失败，err=%v", err)
+		}
+		log.Printf("未配置令牌密钥，使用随机生成的密钥，重启后需重新输入剪贴板密码")
+	})
+	return tokenSecret
+}
+
+// remoteHost 连接的对端地址，不受 CF-Connecting-IP、X-Forwarded-For 等请求头影响
+func remoteHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// attemptLimiter 按 key 记录窗口内的失败次数，达到上限后在窗口结束前拒绝
+type attemptLimiter struct {
+	limit    int
+	window   time.Duration
+	failures map[string]*attempts
+	mu       sync.Mutex
+}
+
+type attempts struct {
+	count   int
+	resetAt time.Time
+}
+
+func newAttemptLimiter(limit int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{limit: limit, window: window, failures: make(map[string]*attempts)}
+}
+
+// allow key 的失败次数未达到上限时返回 true
+func (l *attemptLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep()
+	f := l.failures[key]
+	return f == nil || f.count < l.limit
+}
+
+// fail 记录 key 的一次失败，窗口从第一次失败开始计算
+func (l *attemptLimiter) fail(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f := l.failures[key]
+	if f == nil {
+		f = &attempts{resetAt: time.Now().Add(l.window)}
+		l.failures[key] = f
+	}
+	f.count++
+}
+
+// sweep 清理窗口已结束的记录，调用方需持有 l.mu
+func (l *attemptLimiter) sweep() {
+	now := time.Now()
+	for key, f := range l.failures {
+		if now.After(f.resetAt) {
+			delete(l.failures, key)
+		}
+	}
+}
+
+func verifyBoardToken(board, passwordHash, token string) bool {
+	expire, _, found := strings.Cut(token, ".")
+	if !found {
+		return false
+	}
+	expireUnix, err := strconv.ParseInt(expire, 10, 64)
+	if err != nil {
+		return false
+	}
+	expireAt := time.Unix(expireUnix, 0)
+	if expireAt.Before(time.Now()) {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(signBoardToken(board, passwordHash, expireAt)))
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBoardTokenRequiresServerSecret(t *testing.T) {
+	hash := "$2a$10$abcdefghijklmnopqrstuv"
+	expireAt := time.Now().Add(time.Hour)
+	token := signBoardToken("board", hash, expireAt)
+	if !verifyBoardToken("board", hash, token) {
+		t.Fatal("token signed by the server is rejected")
+	}
+	if verifyBoardToken("other", hash, token) {
+		t.Fatal("token accepted for another board")
+	}
+	if verifyBoardToken("board", hash+"x", token) {
+		t.Fatal("token accepted after the password changed")
+	}
+
+	// 旧的签名方式：只知道密码哈希即可算出
+	expire := strconv.FormatInt(expireAt.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(hash))
+	mac.Write([]byte("board|" + expire))
+	forged := expire + "." + hex.EncodeToString(mac.Sum(nil))
+	if verifyBoardToken("board", hash, forged) {
+		t.Fatal("token forged from the password hash is accepted")
+	}
+}
+
+func TestAttemptLimiter(t *testing.T) {
+	l := newAttemptLimiter(3, 50*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if !l.allow("a") {
+			t.Fatalf("attempt %d rejected before the limit", i+1)
+		}
+		l.fail("a")
+	}
+	if l.allow("a") {
+		t.Fatal("attempt allowed after the limit")
+	}
+	if !l.allow("b") {
+		t.Fatal("failures of one key limit another key")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !l.allow("a") {
+		t.Fatal("attempt rejected after the window ended")
+	}
+}
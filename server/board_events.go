@@ -0,0 +1,202 @@
+package server
+
+import (
+	"airclipboard/common"
+	"airclipboard/server/cache"
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	BoardEventMessageAdded   = "message-added"
+	BoardEventMessageDeleted = "message-deleted"
+	BoardEventMessageUpdated = "message-updated"
+	BoardEventBoardExpiring  = "board-expiring"
+	BoardEventBoardExpired   = "board-expired"
+
+	// boardEventHistorySize 每个剪贴板保留的历史事件条数，用于断线重连后补发
+	boardEventHistorySize = 100
+)
+
+// BoardEvent 剪贴板变更事件，由写入接口直接发布，不依赖浏览器转发
+type BoardEvent struct {
+	Seq       int64          `json:"seq"` // 同一剪贴板内单调递增的事件序号
+	Type      string         `json:"type"`
+	Board     string         `json:"board"`
+	Id        string         `json:"id,omitempty"`
+	ExpireAt  string         `json:"expireAt"`
+	Message   *cache.Message `json:"message,omitempty"` // 记录元数据，不含文件内容
+	Protected bool           `json:"-"`                 // 剪贴板受密码保护，未经认证的订阅者不应收到记录元数据
+}
+
+// BoardEventHub 剪贴板事件的发布订阅中心。事件通过 cache.Broadcast 发布，使用 Redis 缓存时各实例都会收到，
+// 但序号由各实例分别分配，事件 ID 带有实例标识，断线后重连到其他实例时只能重新拉取剪贴板
+type BoardEventHub struct {
+	instance    string
+	subscribers map[int]func(BoardEvent)
+	nextId      int
+	seq         map[string]int64
+	history     map[string][]BoardEvent
+	mu          sync.Mutex
+}
+
+var boardEvents = NewBoardEventHub()
+
+func NewBoardEventHub() *BoardEventHub {
+	return &BoardEventHub{
+		instance:    common.RandString(6),
+		subscribers: make(map[int]func(BoardEvent)),
+		seq:         make(map[string]int64),
+		history:     make(map[string][]BoardEvent),
+	}
+}
+
+// Subscribe 订阅剪贴板事件，返回取消订阅的函数
+func (h *BoardEventHub) Subscribe(fn func(BoardEvent)) func() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	id := h.nextId
+	h.nextId++
+	h.subscribers[id] = fn
+
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subscribers, id)
+	}
+}
+
+// Publish 为事件分配序号并发布给所有订阅者，订阅者不应阻塞
+func (h *BoardEventHub) Publish(evt BoardEvent) {
+	h.mu.Lock()
+	h.seq[evt.Board]++
+	evt.Seq = h.seq[evt.Board]
+	history := append(h.history[evt.Board], evt)
+	if len(history) > boardEventHistorySize {
+		history = history[len(history)-boardEventHistorySize:]
+	}
+	h.history[evt.Board] = history
+	if evt.Type == BoardEventBoardExpired {
+		// 剪贴板已过期，之前的事件不再需要补发
+		h.history[evt.Board] = []BoardEvent{evt}
+	}
+
+	subscribers := make([]func(BoardEvent), 0, len(h.subscribers))
+	for _, fn := range h.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	h.mu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(evt)
+	}
+}
+
+// EventId 事件在 SSE 中的 ID，格式为 {实例标识}-{序号}
+func (h *BoardEventHub) EventId(evt BoardEvent) string {
+	return h.instance + "-" + strconv.FormatInt(evt.Seq, 10)
+}
+
+// ParseEventId 解析 EventId 生成的 ID，不是本实例生成的 ID 返回 false
+func (h *BoardEventHub) ParseEventId(id string) (int64, bool) {
+	instance, seq, found := strings.Cut(id, "-")
+	if !found || instance != h.instance {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(seq, 10, 64)
+	return n, err == nil && n >= 0
+}
+
+// Since 获取序号 seq 之后的历史事件，历史事件不完整时返回 false，调用方需要重新拉取整个剪贴板
+func (h *BoardEventHub) Since(board string, seq int64) ([]BoardEvent, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if seq >= h.seq[board] {
+		return nil, seq == h.seq[board]
+	}
+	history := h.history[board]
+	if len(history) == 0 || history[0].Seq > seq+1 {
+		return nil, false
+	}
+	events := make([]BoardEvent, 0, len(history))
+	for _, evt := range history {
+		if evt.Seq > seq {
+			events = append(events, evt)
+		}
+	}
+	return events, true
+}
+
+// publishBoardEvent 发布单条记录的变更事件，变更已写入缓存，读取过期时间或元数据失败时仍然发布，
+// 无法确认剪贴板是否受密码保护时按受保护处理
+func publishBoardEvent(ctx context.Context, eventType, board string, msg *cache.Message) {
+	expireAt, err := cache.GetExpireAt(ctx, board)
+	if err != nil {
+		log.Printf("读取剪贴板过期时间失败，err=%v", err)
+	}
+	evt := BoardEvent{
+		Type:     eventType,
+		Board:    board,
+		Id:       msg.Id,
+		ExpireAt: expireAt,
+		Message:  messageInfo(msg),
+	}
+	meta, ok, err := cache.GetBoardMetaFromCache(ctx, board)
+	if err != nil {
+		log.Printf("读取剪贴板元数据失败，err=%v", err)
+		evt.Protected = true
+	} else if ok && meta.PasswordHash != "" {
+		evt.Protected = true
+	}
+	broadcastBoardEvent(ctx, evt)
+}
+
+// broadcastEvent 在实例之间传递的剪贴板事件，Protected 不参与 BoardEvent 的序列化，需要单独传递
+type broadcastEvent struct {
+	Event     BoardEvent `json:"event"`
+	Protected bool       `json:"protected"`
+}
+
+// broadcastBoardEvent 通过缓存发布事件，所有实例（包括本实例）在 OnBoardEventBroadcast 中收到后再分配序号
+func broadcastBoardEvent(ctx context.Context, evt BoardEvent) {
+	payload, err := json.Marshal(broadcastEvent{Event: evt, Protected: evt.Protected})
+	if err != nil {
+		log.Printf("序列化剪贴板事件失败，err=%v", err)
+		return
+	}
+	cache.Broadcast(ctx, payload)
+}
+
+// OnBoardEventBroadcast 收到 cache.Broadcast 发布的剪贴板事件时调用
+func OnBoardEventBroadcast(payload []byte) {
+	var b broadcastEvent
+	if err := json.Unmarshal(payload, &b); err != nil {
+		log.Printf("解析剪贴板事件失败，err=%v", err)
+		return
+	}
+	evt := b.Event
+	evt.Protected = b.Protected
+	boardEvents.Publish(evt)
+}
+
+// publishEvicted 发布被保留策略淘汰的记录的删除事件
+func publishEvicted(ctx context.Context, board string, evicted []*cache.Message) {
+	for _, msg := range evicted {
+		publishBoardEvent(ctx, BoardEventMessageDeleted, board, msg)
+	}
+}
+
+// OnBoardExpired 缓存层清理过期剪贴板时调用，通知订阅者剪贴板已过期。
+// 使用 Redis 缓存时各实例都会收到过期通知，因此只在本实例内发布
+func OnBoardExpired(board string) {
+	boardEvents.Publish(BoardEvent{
+		Type:  BoardEventBoardExpired,
+		Board: board,
+	})
+}
@@ -3,31 +3,42 @@ package server
 import (
 	"airclipboard/common"
 	"airclipboard/server/cache"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"path/filepath"
 	"regexp"
-	"sort"
+	"strings"
 	"time"
 )
 
-const (
-	MaxMessageSize = 5
-	MaxBoardSize   = 30
-)
-
 type MessageReq struct {
 	Content string `json:"content"`
 }
 
 type BoardInfo struct {
-	Board    string           `json:"board"`
-	ExpireAt string           `json:"expireAt"`
-	Messages []*cache.Message `json:"messages"`
+	Board    string              `json:"board"`
+	ExpireAt string              `json:"expireAt"`
+	Settings cache.BoardSettings `json:"settings"`
+	// MaxFileSize 单个上传文件的大小上限，客户端据此在上传前提示
+	MaxFileSize int64            `json:"maxFileSize"`
+	Messages    []*cache.Message `json:"messages"`
+	// 以下字段用于增量同步，Cursor 为剪贴板的纪元和当前的变更序号，下次请求时通过 ?since= 传回
+	Cursor     string            `json:"cursor"`
+	Reset      bool              `json:"reset,omitempty"` // 游标已失效，Messages 为完整内容，客户端需丢弃本地状态
+	Tombstones []cache.Tombstone `json:"tombstones,omitempty"`
 }
 
 func LogApiRequestIP(c *gin.Context, apiName string, userId int64) string {
@@ -75,57 +86,315 @@ func AddMessage(c *gin.Context) {
 		return
 	}
 
-	if msgs, ok := cache.GetFromCache(board); !ok {
-		common.ErrorStrResp(c, "抱歉，由于服务器资源有限，当前剪切板数量已达上限，将为您自动跳转到public剪切板空间！", http.StatusBadRequest)
+	isFile, fileName, fileType, base64Str := checkContentIsFile(req.Content)
+
+	ctx := c.Request.Context()
+	settings, err := boardSettings(ctx, board)
+	if err != nil {
+		writeCacheError(c, err)
+		return
+	}
+
+	msg := &cache.Message{
+		Content:  base64Str,
+		Time:     time.Now().Format("2006-01-02 15:04:05"),
+		Ip:       realIp,
+		IsFile:   isFile,
+		FileName: fileName,
+		FileType: fileType,
+		Size:     int64(len(base64Str)),
+	}
+	if isFile {
+		msg.Size = int64(base64.StdEncoding.DecodedLen(len(base64Str)))
+	}
+	// 先校验大小再写入 BlobStore，校验失败时不会留下无人引用的文件
+	if msg.Size > settings.MaxBytes {
+		common.ErrorStrResp(c, boardLimitError(settings).Error(), http.StatusBadRequest)
 		return
+	}
+	if isFile {
+		if cache.BlobsEnabled() {
+			// 文件内容解码后写入 BlobStore，记录中只保存引用
+			ref, size, err := cache.PutBlob(base64.NewDecoder(base64.StdEncoding, strings.NewReader(base64Str)))
+			if err != nil {
+				log.Printf("保存文件内容失败，err=%v", err)
+				common.ErrorStrResp(c, "请求失败！", http.StatusBadRequest)
+				return
+			}
+			msg.Content = ""
+			msg.BlobRef = ref
+			msg.Size = size
+		}
+	}
+
+	saveMessage(c, board, settings, msg)
+}
+
+// UploadMessage 以二进制方式上传文件，支持 multipart/form-data 和 application/octet-stream 两种请求，
+// 文件内容直接流式编码后写入缓存，避免 JSON + base64 + 正则解析的额外开销
+func UploadMessage(c *gin.Context) {
+	board := c.Param("board")
+	if board == "" {
+		common.ErrorStrResp(c, "board not found ！", http.StatusNotFound)
+		return
+	}
+
+	realIp := LogApiRequestIP(c, "UploadMessage: "+board, -1)
+
+	var (
+		reader   io.Reader
+		fileName string
+		fileType string
+	)
+
+	mediaType, _, _ := mime.ParseMediaType(c.ContentType())
+	if mediaType == "multipart/form-data" {
+		mr, err := c.Request.MultipartReader()
+		if err != nil {
+			log.Printf("解析multipart请求失败，err=%v", err)
+			common.ErrorStrResp(c, "请求失败！", http.StatusBadRequest)
+			return
+		}
+		// 取第一个文件字段
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Printf("读取multipart内容失败，err=%v", err)
+				common.ErrorStrResp(c, "请求失败！", http.StatusBadRequest)
+				return
+			}
+			if part.FileName() == "" {
+				continue
+			}
+			reader = part
+			fileName = part.FileName()
+			fileType = part.Header.Get("Content-Type")
+			break
+		}
+		if reader == nil {
+			common.ErrorStrResp(c, "file not found ！", http.StatusBadRequest)
+			return
+		}
 	} else {
-		isFile, fileName, fileType, base64Str := checkContentIsFile(req.Content)
-
-		newMsg := &cache.Message{
-			Content:  base64Str,
-			Time:     time.Now().Format("2006-01-02 15:04:05"),
-			Ip:       realIp,
-			Id:       fmt.Sprintf("%v", time.Now().UnixNano()), // 时间戳
-			IsFile:   isFile,
-			FileName: fileName,
-			FileType: fileType,
+		// application/octet-stream，文件名通过 X-File-Name 请求头传递（URL 编码）
+		fileName, _ = url.QueryUnescape(c.GetHeader("X-File-Name"))
+		if fileName == "" {
+			common.ErrorStrResp(c, "X-File-Name header is required ！", http.StatusBadRequest)
+			return
+		}
+		reader = c.Request.Body
+		if mediaType != "application/octet-stream" {
+			fileType = c.ContentType()
 		}
+	}
 
-		msgs = append(msgs, newMsg)
+	ctx := c.Request.Context()
+	settings, err := boardSettings(ctx, board)
+	if err != nil {
+		writeCacheError(c, err)
+		return
+	}
+	// 读取时即按剪贴板的总字节数上限截断，超出时写入 BlobStore 的临时文件会被丢弃
+	limit := &fileSizeLimiter{n: maxUploadSize(settings), err: fmt.Errorf("file size exceeds the %dMB limit", BoardLimits.MaxFileSize>>20)}
+	if limit.n < BoardLimits.MaxFileSize {
+		limit.err = boardLimitError(settings)
+	}
+
+	content, ref, size, head, err := readFileContent(reader, limit)
+	if errors.Is(err, limit.err) {
+		common.ErrorStrResp(c, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		// 可能是 BlobStore 的错误，包含服务端的路径，不返回给客户端
+		log.Printf("读取上传文件失败，err=%v", err)
+		common.ErrorStrResp(c, "请求失败！", http.StatusInternalServerError)
+		return
+	}
+	if size == 0 {
+		common.ErrorStrResp(c, "请求内容为空！", http.StatusBadRequest)
+		return
+	}
 
-		// msgs根据Time时间倒序排序
-		sort.Slice(msgs, func(i, j int) bool {
-			return msgs[i].Id > msgs[j].Id
-		})
+	// 未指定类型时，优先根据扩展名推断，其次根据文件头识别
+	if fileType == "" || fileType == "application/octet-stream" {
+		fileType = mime.TypeByExtension(filepath.Ext(fileName))
+		if fileType == "" || fileType == "application/octet-stream" {
+			fileType = http.DetectContentType(head)
+		}
+	}
 
-		// 只保留最新的10条数据
-		if len(msgs) > MaxMessageSize {
-			msgs = msgs[:MaxMessageSize]
+	saveMessage(c, board, settings, &cache.Message{
+		Content:  content,
+		BlobRef:  ref,
+		Time:     time.Now().Format("2006-01-02 15:04:05"),
+		Ip:       realIp,
+		IsFile:   true,
+		FileName: filepath.Base(fileName),
+		FileType: fileType,
+		Size:     size,
+	})
+}
+
+// readFileContent 读取上传内容，配置了 BlobStore 时流式写入 BlobStore 并返回引用，否则编码为 base64，
+// 同时返回原始字节数以及用于类型识别的文件头，读取超过 limit 时返回 limit 的错误
+func readFileContent(r io.Reader, limit *fileSizeLimiter) (content, ref string, size int64, head []byte, err error) {
+	br := bufio.NewReader(r)
+	peek, _ := br.Peek(512)
+	head = append([]byte(nil), peek...)
+	limit.r = br
+
+	if cache.BlobsEnabled() {
+		ref, size, err = cache.PutBlob(limit)
+		if err != nil {
+			return "", "", 0, nil, err
 		}
+		return "", ref, size, head, nil
+	}
+
+	var sb strings.Builder
+	encoder := base64.NewEncoder(base64.StdEncoding, &sb)
+	size, err = io.Copy(encoder, limit)
+	if err != nil {
+		return "", "", 0, nil, err
+	}
+	if err = encoder.Close(); err != nil {
+		return "", "", 0, nil, err
+	}
+	return sb.String(), "", size, head, nil
+}
+
+// fileSizeLimiter 读取超过 n 字节时返回 err，写入 BlobStore 的临时文件会被丢弃
+type fileSizeLimiter struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (l *fileSizeLimiter) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, l.err
+	}
+	return n, err
+}
+
+// saveMessage 将已按剪贴板设置校验过大小的新消息写入剪贴板，并按剪贴板的保留策略淘汰最旧的记录
+func saveMessage(c *gin.Context, board string, settings cache.BoardSettings, newMsg *cache.Message) {
+	ctx := c.Request.Context()
+	// 记录 ID 由缓存层分配，多实例部署时也能保证唯一且单调递增
+	evicted, err := cache.AppendMessage(ctx, board, newMsg, boardRetention(settings))
+	if err != nil {
+		writeCacheError(c, err)
+		return
+	}
+
+	publishBoardEvent(ctx, BoardEventMessageAdded, board, newMsg)
+	publishEvicted(ctx, board, evicted)
 
-		cache.SetToCache(board, msgs, time.Hour*6)
+	writeBoardInfo(c, board, []*cache.Message{newMsg})
+}
 
-		returnMsg := &cache.Message{
-			Content:  "",
-			Time:     newMsg.Time,
-			Ip:       realIp,
-			Id:       newMsg.Id, // 时间戳
-			IsFile:   isFile,
-			FileName: fileName,
-			FileType: fileType,
+// maxUploadSize 单个上传文件的大小上限，取服务端的文件大小上限与剪贴板总字节数上限中较小的一个
+func maxUploadSize(settings cache.BoardSettings) int64 {
+	if settings.MaxBytes < BoardLimits.MaxFileSize {
+		return settings.MaxBytes
+	}
+	return BoardLimits.MaxFileSize
+}
+
+func boardLimitError(settings cache.BoardSettings) error {
+	return fmt.Errorf("content size exceeds the board limit of %d bytes ！", settings.MaxBytes)
+}
+
+// ensureBoard 获取剪贴板的记录列表，剪贴板不存在时新建并向本次请求颁发创建者令牌，缓存超出容量上限时由缓存淘汰最久未访问的剪贴板。
+// 缓存不可用时返回错误，不能当作剪贴板不存在而覆盖已有内容；并发的请求只有一个会创建剪贴板，其余读取其内容
+func ensureBoard(c *gin.Context, board string) ([]*cache.Message, bool, error) {
+	ctx := c.Request.Context()
+	msgs, ok, err := cache.ListFromCache(ctx, board)
+	if err != nil || ok {
+		return msgs, false, err
+	}
+	token, err := randomToken()
+	if err != nil {
+		return nil, false, err
+	}
+	created, err := cache.CreateBoard(ctx, board, &cache.BoardMeta{CreatorHash: creatorHash(token)}, BoardLimits.EmptyBoardTTL)
+	if err != nil {
+		return nil, false, err
+	}
+	if !created {
+		if msgs, ok, err = cache.ListFromCache(ctx, board); err != nil || ok {
+			return msgs, false, err
 		}
-		if !isFile {
-			returnMsg.Content = newMsg.Content
+		return make([]*cache.Message, 0), false, nil
+	}
+	issueCreatorToken(c, board, token)
+	return make([]*cache.Message, 0), true, nil
+}
+
+// boardInfo 组装剪贴板信息，文件内容需要单独下载，列表中不返回
+func boardInfo(ctx context.Context, board string, msgs []*cache.Message) (BoardInfo, error) {
+	expireAt, err := cache.GetExpireAt(ctx, board)
+	if err != nil {
+		return BoardInfo{}, err
+	}
+	meta, _, err := cache.GetBoardMetaFromCache(ctx, board)
+	if err != nil {
+		return BoardInfo{}, err
+	}
+
+	returnMsgs := make([]*cache.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg == nil {
+			continue
 		}
+		returnMsgs = append(returnMsgs, messageInfo(msg))
+	}
+	settings := effectiveSettings(meta)
+	return BoardInfo{
+		Board:       board,
+		ExpireAt:    expireAt,
+		Settings:    settings,
+		MaxFileSize: maxUploadSize(settings),
+		Messages:    returnMsgs,
+		Cursor:      boardCursor(msgs, meta),
+	}, nil
+}
 
-		common.SuccessResp(c, BoardInfo{
-			Board:    board,
-			ExpireAt: cache.GetExpireAt(board),
-			Messages: []*cache.Message{returnMsg},
-		})
+// writeBoardInfo 响应剪贴板信息
+func writeBoardInfo(c *gin.Context, board string, msgs []*cache.Message) {
+	info, err := boardInfo(c.Request.Context(), board, msgs)
+	if err != nil {
+		writeCacheError(c, err)
 		return
 	}
+	common.SuccessResp(c, info)
+}
+
+// messageInfo 复制记录的元数据，文件记录不包含内容
+func messageInfo(msg *cache.Message) *cache.Message {
+	returnMsg := &cache.Message{
+		Content:  "",
+		Time:     msg.Time,
+		Ip:       msg.Ip,
+		Id:       msg.Id, // 时间戳
+		IsFile:   msg.IsFile,
+		FileName: msg.FileName,
+		FileType: msg.FileType,
+		Size:     cache.MessageSize(msg),
+		Pinned:   msg.Pinned,
+		Seq:      msg.Seq,
+	}
+	if !msg.IsFile {
+		returnMsg.Content = msg.Content
+	}
+	return returnMsg
 }
+
 func GetMessage(c *gin.Context) {
 	board := c.Param("board")
 	if board == "" {
@@ -141,32 +410,101 @@ func GetMessage(c *gin.Context) {
 
 	LogApiRequestIP(c, "GetMessage: "+board, -1)
 
-	if msgs, ok := cache.GetFromCache(board); !ok {
-		common.ErrorStrResp(c, "board not found ！", http.StatusNotFound)
+	// 只读取这一条记录的内容，不加载整个剪贴板
+	msg, ok, err := cache.GetMessageFromCache(c.Request.Context(), board, id)
+	if err != nil {
+		writeCacheError(c, err)
 		return
+	}
+	if !ok {
+		common.ErrorStrResp(c, "message not found!", http.StatusNotFound)
+		return
+	}
+	serveMessageContent(c, msg)
+}
+
+// serveMessageContent 输出消息内容，支持 Range 断点续传、ETag 协商缓存，
+// 通过 ?download 或 ?inline 参数指定以附件下载还是在浏览器中直接打开
+func serveMessageContent(c *gin.Context, msg *cache.Message) {
+	// 内容来自用户上传，即使被直接打开也不能访问本站的 Cookie 和存储
+	c.Header("Content-Security-Policy", "sandbox")
+
+	var (
+		content     io.ReadSeeker
+		etag        string
+		fileName    = msg.FileName
+		contentType = msg.FileType
+	)
+
+	if msg.BlobRef != "" {
+		// 直接从 BlobStore 流式读取，引用即内容的 sha256
+		f, err := cache.OpenBlob(msg.BlobRef)
+		if err != nil {
+			log.Printf("读取文件内容失败，err=%v", err)
+			common.ErrorStrResp(c, "file content not found!", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		content = f
+		etag = msg.BlobRef[:32]
 	} else {
-		for _, msg := range msgs {
-			if id == fmt.Sprintf("%v", msg.Id) {
-				if msg.IsFile {
-					// 解码 Base64 内容
-					data, err := base64.StdEncoding.DecodeString(msg.Content)
-					if err != nil {
-						common.ErrorStrResp(c, "Failed to decode Base64 content!", http.StatusNotFound)
-						return
-					}
-					c.Header("Content-Type", msg.FileType)
-					c.Data(http.StatusOK, msg.FileType, data)
-					return
-				} else {
-					c.Header("Content-Type", "text/plain; charset=utf-8")
-					c.String(http.StatusOK, msg.FileType, msg.Content)
-					return
-				}
+		var data []byte
+		if msg.IsFile {
+			// 解码 Base64 内容
+			decoded, err := base64.StdEncoding.DecodeString(msg.Content)
+			if err != nil {
+				common.ErrorStrResp(c, "Failed to decode Base64 content!", http.StatusNotFound)
+				return
 			}
+			data = decoded
+		} else {
+			data = []byte(msg.Content)
 		}
-		common.ErrorStrResp(c, "message not found!", http.StatusNotFound)
-		return
+		sum := sha256.Sum256(data)
+		content = bytes.NewReader(data)
+		etag = hex.EncodeToString(sum[:16])
+	}
+	if !msg.IsFile {
+		contentType = "text/plain; charset=utf-8"
+	}
+	if fileName == "" {
+		fileName = msg.Id + ".txt"
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// 只有不会执行脚本的类型才在浏览器中打开，?inline 也不例外，否则上传的 HTML、SVG 会在本站的源下运行
+	disposition := "attachment"
+	if _, ok := c.GetQuery("download"); !ok && isInlineType(contentType) {
+		disposition = "inline"
 	}
+
+	c.Header("ETag", `"`+etag+`"`)
+	c.Header("Cache-Control", "private, no-cache")
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": fileName}))
+	c.Header("X-Content-Type-Options", "nosniff")
+
+	// ServeContent 负责处理 If-None-Match、If-Range、Range 以及 Content-Length
+	http.ServeContent(c.Writer, c.Request, fileName, time.Time{}, content)
+}
+
+// isInlineType 判断该类型的文件是否默认在浏览器中直接展示
+func isInlineType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "image/svg+xml":
+		// SVG 可以包含脚本
+		return false
+	case strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "audio/"),
+		mediaType == "text/plain",
+		mediaType == "application/pdf":
+		return true
+	}
+	return false
 }
 
 func DeleteMessage(c *gin.Context) {
@@ -184,51 +522,42 @@ func DeleteMessage(c *gin.Context) {
 
 	LogApiRequestIP(c, "DeleteMessage: "+board, -1)
 
-	if msgs, ok := cache.GetFromCache(board); !ok {
-		common.ErrorStrResp(c, "board not found ！", http.StatusNotFound)
+	ctx := c.Request.Context()
+	removed, err := cache.RemoveMessage(ctx, board, id)
+	if err != nil && !errors.Is(err, cache.ErrMessageNotFound) {
+		writeCacheError(c, err)
 		return
-	} else {
-		removeIdx := -1
-		for i, msg := range msgs {
-			if id == fmt.Sprintf("%v", msg.Id) {
-				removeIdx = i
-			}
-		}
-		if removeIdx > -1 {
-			msgs = append(msgs[:removeIdx], msgs[removeIdx+1:]...)
-			if len(msgs) == 0 {
-				cache.SetToCache(board, msgs, time.Minute*10)
-			} else {
-				cache.SetToCache(board, msgs, time.Hour*6)
-			}
-		}
-		returnMsgs := make([]*cache.Message, 0)
-		for _, msg := range msgs {
-			if msg == nil {
-				continue
-			}
-			returnMsg := &cache.Message{
-				Content:  "",
-				Time:     msg.Time,
-				Ip:       msg.Ip,
-				Id:       msg.Id, // 时间戳
-				IsFile:   msg.IsFile,
-				FileName: msg.FileName,
-				FileType: msg.FileType,
-			}
-			if !msg.IsFile {
-				returnMsg.Content = msg.Content
-			}
-			returnMsgs = append(returnMsgs, returnMsg)
-		}
-		common.SuccessResp(c, BoardInfo{
-			Board:    board,
-			ExpireAt: cache.GetExpireAt(board),
-			Messages: returnMsgs,
-		})
+	}
+	if removed != nil {
+		publishBoardEvent(ctx, BoardEventMessageDeleted, board, removed)
+	}
+	msgs, _, err := cache.ListFromCache(ctx, board)
+	if err != nil {
+		writeCacheError(c, err)
 		return
 	}
+	writeBoardInfo(c, board, msgs)
+}
 
+// writeCacheError 将缓存层的错误转换为接口响应，业务错误返回 4xx，缓存后端的错误返回 5xx
+func writeCacheError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, cache.ErrBoardNotFound):
+		common.ErrorStrResp(c, "board not found ！", http.StatusNotFound)
+	case errors.Is(err, cache.ErrMessageNotFound):
+		common.ErrorStrResp(c, "message not found!", http.StatusNotFound)
+	case errors.Is(err, cache.ErrTooManyPinned):
+		common.ErrorStrResp(c, fmt.Sprintf("at most %d messages can be pinned ！", BoardLimits.MaxPinned), http.StatusBadRequest)
+	case errors.Is(err, context.Canceled):
+		// 客户端已断开连接，无需响应
+		c.Abort()
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Printf("访问缓存超时，err=%v", err)
+		common.ErrorStrResp(c, "cache timeout, please try again later ！", http.StatusGatewayTimeout)
+	default:
+		log.Printf("访问缓存失败，err=%v", err)
+		common.ErrorStrResp(c, "cache unavailable, please try again later ！", http.StatusServiceUnavailable)
+	}
 }
 
 func checkContentIsFile(content string) (isFile bool, fileName, fileType, base64str string) {
@@ -253,46 +582,32 @@ func FetchBoard(c *gin.Context) {
 	}
 
 	realIp := LogApiRequestIP(c, "FetchBoard: "+board, -1)
-	cache.SetBoardNameToCache(realIp, board, time.Hour*48)
+	ctx := c.Request.Context()
+	if err := cache.SetBoardNameToCache(ctx, realIp, board, time.Hour*48); err != nil {
+		writeCacheError(c, err)
+		return
+	}
+
+	msgs, _, err := ensureBoard(c, board)
+	if err != nil {
+		writeCacheError(c, err)
+		return
+	}
 
-	if msgs, ok := cache.GetFromCache(board); !ok {
-		if board != "public" && cache.CacheSize() >= MaxBoardSize {
-			common.ErrorStrResp(c, "抱歉，由于服务器资源有限，当前剪切板数量已达上限，将为您自动跳转到public剪切板空间！", http.StatusBadRequest)
+	// ?since=<cursor> 只返回游标之后新增、修改的记录以及删除记录的墓碑
+	if since := c.Query("since"); since != "" {
+		epoch, cursor, err := parseCursor(since)
+		if err != nil || cursor < 0 {
+			common.ErrorStrResp(c, "invalid cursor ！", http.StatusBadRequest)
 			return
 		}
-		msgs = make([]*cache.Message, 0)
-		cache.SetToCache(board, msgs, time.Minute*10)
-		common.SuccessResp(c, BoardInfo{
-			Board:    board,
-			ExpireAt: cache.GetExpireAt(board),
-			Messages: msgs,
-		})
-		return
-	} else {
-		returnMsgs := make([]*cache.Message, 0)
-		for _, msg := range msgs {
-			if msg == nil {
-				continue
-			}
-			returnMsg := &cache.Message{
-				Content:  "",
-				Time:     msg.Time,
-				Ip:       msg.Ip,
-				Id:       msg.Id, // 时间戳
-				IsFile:   msg.IsFile,
-				FileName: msg.FileName,
-				FileType: msg.FileType,
-			}
-			if !msg.IsFile {
-				returnMsg.Content = msg.Content
-			}
-			returnMsgs = append(returnMsgs, returnMsg)
+		info, err := boardDelta(ctx, board, msgs, epoch, cursor)
+		if err != nil {
+			writeCacheError(c, err)
+			return
 		}
-		common.SuccessResp(c, BoardInfo{
-			Board:    board,
-			ExpireAt: cache.GetExpireAt(board),
-			Messages: returnMsgs,
-		})
+		common.SuccessResp(c, info)
 		return
 	}
+	writeBoardInfo(c, board, msgs)
 }
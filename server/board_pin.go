@@ -0,0 +1,57 @@
+package server
+
+import (
+	"airclipboard/common"
+	"airclipboard/server/cache"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// PinMessage 置顶记录，置顶的记录不会被淘汰，并会延长剪贴板的过期时间
+func PinMessage(c *gin.Context) {
+	setPinned(c, true)
+}
+
+// UnpinMessage 取消置顶
+func UnpinMessage(c *gin.Context) {
+	setPinned(c, false)
+}
+
+func setPinned(c *gin.Context, pinned bool) {
+	board := c.Param("board")
+	if board == "" {
+		common.ErrorStrResp(c, "board not found ！", http.StatusNotFound)
+		return
+	}
+
+	id := c.Param("id")
+	if id == "" {
+		common.ErrorStrResp(c, "id not found ！", http.StatusNotFound)
+		return
+	}
+
+	LogApiRequestIP(c, fmt.Sprintf("SetPinned(%v): %s", pinned, board), -1)
+
+	ctx := c.Request.Context()
+	settings, err := boardSettings(ctx, board)
+	if err != nil {
+		writeCacheError(c, err)
+		return
+	}
+	target, evicted, err := cache.SetPinned(ctx, board, id, pinned, boardRetention(settings))
+	if err != nil {
+		writeCacheError(c, err)
+		return
+	}
+
+	publishBoardEvent(ctx, BoardEventMessageUpdated, board, target)
+	publishEvicted(ctx, board, evicted)
+
+	msgs, _, err := cache.ListFromCache(ctx, board)
+	if err != nil {
+		writeCacheError(c, err)
+		return
+	}
+	writeBoardInfo(c, board, msgs)
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"airclipboard/common"
+	"airclipboard/server/cache"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+const minBoardTTL = time.Minute
+
+// Limits 服务端对剪贴板的限制，剪贴板创建者只能在该范围内调整设置
+type Limits struct {
+	DefaultMaxMessages int           // 默认保留的记录条数
+	MaxMessages        int           // 可设置的记录条数上限
+	DefaultMaxBytes    int64         // 默认的总字节数上限
+	MaxBytes           int64         // 可设置的总字节数上限
+	DefaultTTL         time.Duration // 默认的过期时间
+	MaxTTL             time.Duration // 可设置的过期时间上限
+	EmptyBoardTTL      time.Duration // 没有内容的剪贴板的过期时间
+	MaxPinned          int           // 每个剪贴板最多置顶的记录条数
+	PinnedTTL          time.Duration // 有置顶记录的剪贴板的过期时间
+	MaxFileSize        int64         // 单个上传文件的大小上限
+}
+
+var BoardLimits = Limits{
+	DefaultMaxMessages: 5,
+	MaxMessages:        20,
+	DefaultMaxBytes:    100 << 20,
+	MaxBytes:           200 << 20,
+	DefaultTTL:         time.Hour * 6,
+	MaxTTL:             time.Hour * 24,
+	EmptyBoardTTL:      time.Minute * 10,
+	MaxPinned:          3,
+	PinnedTTL:          time.Hour * 24 * 7,
+	MaxFileSize:        20 << 20, // 20MB
+}
+
+// SetBoardSettings 设置剪贴板的保留策略，只允许剪贴板的创建者在剪贴板尚无内容时设置
+func SetBoardSettings(c *gin.Context) {
+	board := c.Param("board")
+	if board == "" {
+		common.ErrorStrResp(c, "board not found ！", http.StatusNotFound)
+		return
+	}
+
+	LogApiRequestIP(c, "SetBoardSettings: "+board, -1)
+
+	if board == "public" {
+		common.ErrorStrResp(c, "public board settings can not be changed ！", http.StatusForbidden)
+		return
+	}
+
+	var req cache.BoardSettings
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.ErrorStrResp(c, "请求失败！", http.StatusBadRequest)
+		return
+	}
+	if err := validateSettings(req); err != nil {
+		common.ErrorResp(c, err, http.StatusBadRequest)
+		return
+	}
+
+	ctx := c.Request.Context()
+	msgs, created, err := ensureBoard(c, board)
+	if err != nil {
+		writeCacheError(c, err)
+		return
+	}
+	if len(msgs) > 0 {
+		common.ErrorStrResp(c, "settings can only be changed on a new board ！", http.StatusConflict)
+		return
+	}
+
+	token := ""
+	if !created {
+		token = requestCreatorToken(c)
+	}
+	err = cache.UpdateBoardMeta(ctx, board, func(meta *cache.BoardMeta) error {
+		if !created && !verifyCreator(meta, token) {
+			return errNotCreator
+		}
+		meta.Settings = req
+		return nil
+	})
+	if errors.Is(err, errNotCreator) {
+		common.ErrorStrResp(c, "only the creator of the board can change its settings ！", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		writeCacheError(c, err)
+		return
+	}
+
+	writeBoardInfo(c, board, msgs)
+}
+
+// validateSettings 校验剪贴板设置，各项为 0 时使用服务端默认值
+func validateSettings(s cache.BoardSettings) error {
+	limits := BoardLimits
+	if s.MaxMessages < 0 || s.MaxMessages > limits.MaxMessages {
+		return fmt.Errorf("maxMessages must be between 0 (server default) and %d", limits.MaxMessages)
+	}
+	if s.MaxBytes < 0 || s.MaxBytes > limits.MaxBytes {
+		return fmt.Errorf("maxBytes must be between 0 (server default) and %d", limits.MaxBytes)
+	}
+	if s.TTL != 0 && (time.Duration(s.TTL)*time.Second < minBoardTTL || time.Duration(s.TTL)*time.Second > limits.MaxTTL) {
+		return fmt.Errorf("ttl must be 0 (server default) or between %d and %d seconds", int64(minBoardTTL.Seconds()), int64(limits.MaxTTL.Seconds()))
+	}
+	return nil
+}
+
+// boardSettings 获取剪贴板生效的保留策略
+func boardSettings(ctx context.Context, board string) (cache.BoardSettings, error) {
+	meta, _, err := cache.GetBoardMetaFromCache(ctx, board)
+	if err != nil {
+		return cache.BoardSettings{}, err
+	}
+	return effectiveSettings(meta), nil
+}
+
+// effectiveSettings 未设置的项使用服务端默认值，meta 可以为 nil
+func effectiveSettings(meta *cache.BoardMeta) cache.BoardSettings {
+	var s cache.BoardSettings
+	if meta != nil {
+		s = meta.Settings
+	}
+	if s.MaxMessages == 0 {
+		s.MaxMessages = BoardLimits.DefaultMaxMessages
+	}
+	if s.MaxBytes == 0 {
+		s.MaxBytes = BoardLimits.DefaultMaxBytes
+	}
+	if s.TTL == 0 {
+		s.TTL = int64(BoardLimits.DefaultTTL.Seconds())
+	}
+	return s
+}
+
+// boardRetention 将剪贴板生效的设置转换为缓存层的保留策略
+func boardRetention(s cache.BoardSettings) cache.Retention {
+	return cache.Retention{
+		MaxMessages: s.MaxMessages,
+		MaxBytes:    s.MaxBytes,
+		MaxPinned:   BoardLimits.MaxPinned,
+		TTL:         time.Duration(s.TTL) * time.Second,
+		PinnedTTL:   BoardLimits.PinnedTTL,
+	}
+}
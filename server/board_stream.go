@@ -0,0 +1,161 @@
+package server
+
+import (
+	"airclipboard/common"
+	"airclipboard/server/cache"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	sseHeartbeatInterval = 15 * time.Second
+	// BoardExpiringNotice 剪贴板剩余时间少于该值时发送 board-expiring 事件
+	BoardExpiringNotice = 2 * time.Minute
+	// ServerRestarting 服务即将重启时推送给 WebSocket 和 SSE 客户端的消息类型
+	ServerRestarting = "server-restarting"
+)
+
+var (
+	// streamsClosed 服务退出时关闭，所有 SSE 连接据此通知客户端重连并结束请求
+	streamsClosed    = make(chan struct{})
+	closeStreamsOnce sync.Once
+	reconnectDelay   time.Duration
+)
+
+// CloseEventStreams 通知所有 SSE 连接服务即将重启，客户端在 delay 之后重连。
+// SSE 请求不会自行结束，需在 http.Server.Shutdown 之前调用，否则 Shutdown 会一直等到超时
+func CloseEventStreams(delay time.Duration) {
+	closeStreamsOnce.Do(func() {
+		reconnectDelay = delay
+		close(streamsClosed)
+	})
+}
+
+// BoardEventStream 以 Server-Sent Events 推送剪贴板变更，支持通过 Last-Event-ID 断线续传
+func BoardEventStream(c *gin.Context) {
+	board := c.Param("board")
+	if board == "" {
+		common.ErrorStrResp(c, "board not found ！", http.StatusNotFound)
+		return
+	}
+
+	LogApiRequestIP(c, "BoardEventStream: "+board, -1)
+
+	// 先订阅再补发历史事件，避免两者之间的事件丢失，重复的事件按序号跳过
+	events := make(chan BoardEvent, 64)
+	overflow := make(chan struct{}, 1)
+	unsubscribe := boardEvents.Subscribe(func(evt BoardEvent) {
+		if evt.Board != board {
+			return
+		}
+		select {
+		case events <- evt:
+		default:
+			select {
+			case overflow <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	lastEventId := c.GetHeader("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = c.Query("lastEventId")
+	}
+	var lastSeq int64
+	if lastEventId != "" {
+		// 其他实例生成的事件 ID 无法在本实例补发
+		seq, ok := boardEvents.ParseEventId(lastEventId)
+		history, complete := boardEvents.Since(board, seq)
+		if ok && complete {
+			lastSeq = seq
+			for _, evt := range history {
+				writeBoardEvent(c, evt)
+				lastSeq = evt.Seq
+			}
+		} else {
+			writeSSE(c, "", "reset", gin.H{"board": board})
+		}
+	}
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(sseHeartbeatInterval)
+	defer ticker.Stop()
+	expiringSent := false
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-streamsClosed:
+			// retry 字段指定浏览器 EventSource 的重连间隔
+			fmt.Fprintf(c.Writer, "retry: %d\n", reconnectDelay.Milliseconds())
+			writeSSE(c, "", ServerRestarting, gin.H{"reconnectAfter": reconnectDelay.Milliseconds()})
+			c.Writer.Flush()
+			return
+		case evt := <-events:
+			if evt.Seq <= lastSeq {
+				continue
+			}
+			writeBoardEvent(c, evt)
+			lastSeq = evt.Seq
+		case <-overflow:
+			// 客户端消费过慢，事件已丢失，通知客户端重新拉取
+			writeSSE(c, "", "reset", gin.H{"board": board})
+		case <-ticker.C:
+			expireAt, err := cache.GetExpireAt(c.Request.Context(), board)
+			if err != nil {
+				log.Printf("读取剪贴板过期时间失败，err=%v", err)
+			} else if expiring(expireAt) {
+				if !expiringSent {
+					writeSSE(c, "", BoardEventBoardExpiring, gin.H{"board": board, "expireAt": expireAt})
+					expiringSent = true
+				}
+			} else {
+				// 剪贴板有新内容写入后过期时间会延长
+				expiringSent = false
+			}
+			fmt.Fprint(c.Writer, ": keepalive\n\n")
+		}
+		c.Writer.Flush()
+	}
+}
+
+func writeBoardEvent(c *gin.Context, evt BoardEvent) {
+	writeSSE(c, boardEvents.EventId(evt), evt.Type, evt)
+}
+
+func writeSSE(c *gin.Context, id, event string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	if id != "" {
+		fmt.Fprintf(c.Writer, "id: %s\n", id)
+	}
+	fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, payload)
+}
+
+// expiring 判断剪贴板是否即将过期
+func expiring(expireAt string) bool {
+	if expireAt == "" {
+		return false
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", expireAt, time.Local)
+	if err != nil {
+		return false
+	}
+	return time.Until(t) <= BoardExpiringNotice
+}
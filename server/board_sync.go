@@ -0,0 +1,81 @@
+package server
+
+import (
+	"airclipboard/server/cache"
+	"context"
+	"strconv"
+	"strings"
+)
+
+// boardCursor 获取剪贴板当前的游标，格式与记录 ID 相同，为 纪元-变更序号，meta 可以为 nil
+func boardCursor(msgs []*cache.Message, meta *cache.BoardMeta) string {
+	var epoch string
+	if meta != nil {
+		epoch = meta.Epoch
+	}
+	return cache.MessageId(epoch, boardSeq(msgs, meta))
+}
+
+// boardSeq 获取已知记录和墓碑中最大的变更序号，meta 可以为 nil
+func boardSeq(msgs []*cache.Message, meta *cache.BoardMeta) int64 {
+	var seq int64
+	for _, msg := range msgs {
+		if msg != nil && msg.Seq > seq {
+			seq = msg.Seq
+		}
+	}
+	if meta != nil {
+		for _, t := range meta.Tombstones {
+			if t.Seq > seq {
+				seq = t.Seq
+			}
+		}
+	}
+	return seq
+}
+
+// parseCursor 解析游标中的纪元和变更序号，没有纪元的游标来自旧版本创建的剪贴板
+func parseCursor(cursor string) (string, int64, error) {
+	epoch, seq, found := strings.Cut(cursor, "-")
+	if !found {
+		epoch, seq = "", cursor
+	}
+	n, err := strconv.ParseInt(seq, 10, 64)
+	return epoch, n, err
+}
+
+// boardDelta 组装游标 since 之后的增量变更，游标失效时返回完整内容并设置 Reset
+func boardDelta(ctx context.Context, board string, msgs []*cache.Message, epoch string, since int64) (BoardInfo, error) {
+	info, err := boardInfo(ctx, board, msgs)
+	if err != nil {
+		return BoardInfo{}, err
+	}
+
+	meta, ok, err := cache.GetBoardMetaFromCache(ctx, board)
+	if err != nil {
+		return BoardInfo{}, err
+	}
+	if !ok {
+		meta = &cache.BoardMeta{}
+	}
+	// 纪元不同说明剪贴板已过期重建，游标大于当前序号说明游标无效，小于已丢弃的墓碑序号说明删除记录不完整
+	if epoch != meta.Epoch || since > boardSeq(msgs, meta) || since < meta.Pruned {
+		info.Reset = true
+		return info, nil
+	}
+
+	changed := make([]*cache.Message, 0)
+	for _, msg := range info.Messages {
+		if msg.Seq > since {
+			changed = append(changed, msg)
+		}
+	}
+	info.Messages = changed
+
+	for _, t := range meta.Tombstones {
+		if t.Seq > since {
+			info.Tombstones = append(info.Tombstones, t)
+		}
+	}
+	return info, nil
+}
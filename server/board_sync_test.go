@@ -0,0 +1,220 @@
+package server
+
+import (
+	"airclipboard/server/cache"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseCursor(t *testing.T) {
+	tests := []struct {
+		cursor  string
+		epoch   string
+		seq     int64
+		wantErr bool
+	}{
+		{cursor: "a1b2c3d4-42", epoch: "a1b2c3d4", seq: 42},
+		{cursor: "a1b2c3d4-0", epoch: "a1b2c3d4", seq: 0},
+		{cursor: "17", epoch: "", seq: 17}, // 旧版本创建的剪贴板没有纪元
+		{cursor: "", wantErr: true},
+		{cursor: "a1b2c3d4-", wantErr: true},
+		{cursor: "a1b2c3d4-x", wantErr: true},
+		{cursor: "a-b-3", wantErr: true},
+	}
+	for _, tt := range tests {
+		epoch, seq, err := parseCursor(tt.cursor)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseCursor(%q) = %q, %d, want an error", tt.cursor, epoch, seq)
+			}
+			continue
+		}
+		if err != nil || epoch != tt.epoch || seq != tt.seq {
+			t.Errorf("parseCursor(%q) = %q, %d, %v, want %q, %d", tt.cursor, epoch, seq, err, tt.epoch, tt.seq)
+		}
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []struct {
+		msgs  []*cache.Message
+		meta  *cache.BoardMeta
+		epoch string
+		seq   int64
+	}{
+		{msgs: nil, meta: nil, epoch: "", seq: 0},
+		{msgs: []*cache.Message{{Seq: 3}, nil, {Seq: 5}}, meta: nil, epoch: "", seq: 5},
+		{msgs: []*cache.Message{{Seq: 3}}, meta: &cache.BoardMeta{Epoch: "beef"}, epoch: "beef", seq: 3},
+		{
+			msgs:  []*cache.Message{{Seq: 3}},
+			meta:  &cache.BoardMeta{Epoch: "beef", Tombstones: []cache.Tombstone{{Id: "beef-2", Seq: 9}}},
+			epoch: "beef",
+			seq:   9,
+		},
+	}
+	for i, tt := range tests {
+		if seq := boardSeq(tt.msgs, tt.meta); seq != tt.seq {
+			t.Errorf("case %d: boardSeq = %d, want %d", i, seq, tt.seq)
+		}
+		cursor := boardCursor(tt.msgs, tt.meta)
+		epoch, seq, err := parseCursor(cursor)
+		if err != nil || epoch != tt.epoch || seq != tt.seq {
+			t.Errorf("case %d: parseCursor(%q) = %q, %d, %v, want %q, %d", i, cursor, epoch, seq, err, tt.epoch, tt.seq)
+		}
+	}
+}
+
+// syncBoard 创建测试用的剪贴板，返回追加的记录，第一条为最新的记录
+func syncBoard(t *testing.T, ctx context.Context, board string, n int) []*cache.Message {
+	t.Helper()
+	if _, err := cache.CreateBoard(ctx, board, &cache.BoardMeta{}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = cache.DeleteFromCache(context.Background(), board) })
+	// 不淘汰记录，墓碑只来自删除
+	retention := boardRetention(effectiveSettings(nil))
+	if retention.MaxMessages < n {
+		retention.MaxMessages = n
+	}
+	for i := 0; i < n; i++ {
+		if _, err := cache.AppendMessage(ctx, board, &cache.Message{Content: "msg", Size: 3}, retention); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs, _, err := cache.ListFromCache(ctx, board)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+// delta 以游标请求增量变更
+func delta(t *testing.T, ctx context.Context, board, cursor string) BoardInfo {
+	t.Helper()
+	epoch, since, err := parseCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, _, err := cache.ListFromCache(ctx, board)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := boardDelta(ctx, board, msgs, epoch, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestBoardDelta(t *testing.T) {
+	ctx := context.Background()
+	const board = "sync-delta"
+	msgs := syncBoard(t, ctx, board, 3)
+	meta, _, err := cache.GetBoardMetaFromCache(ctx, board)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epoch := meta.Epoch
+	if _, err := cache.RemoveMessage(ctx, board, msgs[1].Id); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		cursor     string
+		reset      bool
+		messages   int
+		tombstones int
+	}{
+		{name: "up to date", cursor: cache.MessageId(epoch, 4), messages: 0, tombstones: 0},
+		{name: "before removal", cursor: cache.MessageId(epoch, 3), messages: 0, tombstones: 1},
+		{name: "before last append", cursor: cache.MessageId(epoch, 2), messages: 1, tombstones: 1},
+		{name: "from start", cursor: cache.MessageId(epoch, 0), messages: 2, tombstones: 1},
+		{name: "other epoch", cursor: cache.MessageId("0000", 4), reset: true, messages: 2},
+		{name: "no epoch", cursor: "4", reset: true, messages: 2},
+		{name: "ahead of board", cursor: cache.MessageId(epoch, 5), reset: true, messages: 2},
+	}
+	for _, tt := range tests {
+		info := delta(t, ctx, board, tt.cursor)
+		if info.Reset != tt.reset || len(info.Messages) != tt.messages || len(info.Tombstones) != tt.tombstones {
+			t.Errorf("%s: reset=%v messages=%d tombstones=%d, want reset=%v messages=%d tombstones=%d",
+				tt.name, info.Reset, len(info.Messages), len(info.Tombstones), tt.reset, tt.messages, tt.tombstones)
+		}
+		if info.Cursor != cache.MessageId(epoch, 4) {
+			t.Errorf("%s: cursor = %q, want %q", tt.name, info.Cursor, cache.MessageId(epoch, 4))
+		}
+	}
+}
+
+// TestBoardDeltaEpochReset 剪贴板过期后以同名重建，旧游标的序号可能仍然有效，需要通过纪元识别
+func TestBoardDeltaEpochReset(t *testing.T) {
+	ctx := context.Background()
+	const board = "sync-epoch"
+	syncBoard(t, ctx, board, 2)
+	meta, _, err := cache.GetBoardMetaFromCache(ctx, board)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := cache.MessageId(meta.Epoch, 1)
+
+	if err := cache.DeleteFromCache(ctx, board); err != nil {
+		t.Fatal(err)
+	}
+	syncBoard(t, ctx, board, 2)
+	info := delta(t, ctx, board, old)
+	if !info.Reset || len(info.Messages) != 2 {
+		t.Fatalf("old cursor after re-creation: reset=%v messages=%d, want a reset with 2 messages", info.Reset, len(info.Messages))
+	}
+	if info.Cursor == cache.MessageId(meta.Epoch, 2) {
+		t.Fatalf("cursor %q did not change with the epoch", info.Cursor)
+	}
+}
+
+// TestBoardDeltaPruned 墓碑超过 MaxTombstones 后最旧的被丢弃，早于丢弃墓碑的游标无法得知全部删除，需要返回完整内容
+func TestBoardDeltaPruned(t *testing.T) {
+	ctx := context.Background()
+	const board = "sync-pruned"
+	const extra = 5
+	msgs := syncBoard(t, ctx, board, cache.MaxTombstones+extra+1)
+	meta, _, err := cache.GetBoardMetaFromCache(ctx, board)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epoch := meta.Epoch
+	appended := int64(len(msgs))
+	// 从最旧的记录开始删除，第 i 次（从 1 开始）删除的序号为 appended+i
+	for i := 0; i < cache.MaxTombstones+extra; i++ {
+		if _, err := cache.RemoveMessage(ctx, board, msgs[len(msgs)-1-i].Id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	meta, _, err = cache.GetBoardMetaFromCache(ctx, board)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Tombstones) != cache.MaxTombstones || meta.Pruned != appended+extra {
+		t.Fatalf("tombstones=%d pruned=%d, want %d and %d", len(meta.Tombstones), meta.Pruned, cache.MaxTombstones, appended+extra)
+	}
+
+	tests := []struct {
+		name       string
+		since      int64
+		reset      bool
+		tombstones int
+	}{
+		{name: "before pruned", since: appended, reset: true},
+		{name: "just before pruned", since: meta.Pruned - 1, reset: true},
+		{name: "at pruned", since: meta.Pruned, tombstones: cache.MaxTombstones},
+		{name: "after pruned", since: meta.Pruned + 10, tombstones: cache.MaxTombstones - 10},
+	}
+	for _, tt := range tests {
+		info := delta(t, ctx, board, cache.MessageId(epoch, tt.since))
+		if info.Reset != tt.reset || len(info.Tombstones) != tt.tombstones {
+			t.Errorf("%s: reset=%v tombstones=%d, want reset=%v tombstones=%d", tt.name, info.Reset, len(info.Tombstones), tt.reset, tt.tombstones)
+		}
+		if info.Reset && len(info.Messages) != 1 {
+			t.Errorf("%s: reset returned %d messages, want the remaining 1", tt.name, len(info.Messages))
+		}
+	}
+}
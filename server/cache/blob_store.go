@@ -0,0 +1,180 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// blobGracePeriod 新写入的内容在该时间内不会被回收，避免内容已写入但记录尚未保存时被误删
+const blobGracePeriod = time.Hour
+
+const blobTempPrefix = ".upload-"
+
+var ErrInvalidBlobRef = errors.New("invalid blob ref")
+
+// BlobStore 文件内容存储，内容按哈希寻址，相同的内容只保存一份
+type BlobStore interface {
+	// Put 写入内容，返回内容的引用和字节数
+	Put(r io.Reader) (ref string, size int64, err error)
+	// Open 打开内容用于读取，支持 Seek 以便响应 Range 请求
+	Open(ref string) (io.ReadSeekCloser, error)
+	// Collect 删除未被引用且早于 before 写入的内容，返回删除的数量
+	Collect(inUse map[string]bool, before time.Time) (int, error)
+}
+
+// DirBlobStore 将内容保存在本地目录中，路径为 <dir>/<哈希前两位>/<sha256>
+type DirBlobStore struct {
+	dir string
+}
+
+func NewDirBlobStore(dir string) (*DirBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DirBlobStore{dir: dir}, nil
+}
+
+func (s *DirBlobStore) Put(r io.Reader) (string, int64, error) {
+	// 先写入临时文件，计算出哈希后再重命名，读取失败时不会留下不完整的内容
+	tmp, err := os.CreateTemp(s.dir, blobTempPrefix+"*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	ref := hex.EncodeToString(h.Sum(nil))
+	path := s.path(ref)
+	if _, err = os.Stat(path); err == nil {
+		// 内容已存在，刷新修改时间，避免刚被引用就被回收
+		now := time.Now()
+		return ref, size, os.Chtimes(path, now, now)
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", 0, err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return "", 0, err
+	}
+	return ref, size, nil
+}
+
+func (s *DirBlobStore) Open(ref string) (io.ReadSeekCloser, error) {
+	if !validBlobRef(ref) {
+		return nil, ErrInvalidBlobRef
+	}
+	return os.Open(s.path(ref))
+}
+
+func (s *DirBlobStore) Collect(inUse map[string]bool, before time.Time) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name := d.Name()
+		if inUse[name] {
+			return nil
+		}
+		if !validBlobRef(name) && !strings.HasPrefix(name, blobTempPrefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(before) {
+			return nil
+		}
+		if err = os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+func (s *DirBlobStore) path(ref string) string {
+	return filepath.Join(s.dir, ref[:2], ref)
+}
+
+// validBlobRef 引用必须是 sha256 的十六进制字符串，避免拼接出目录之外的路径
+func validBlobRef(ref string) bool {
+	if len(ref) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(ref)
+	return err == nil
+}
+
+// BlobsEnabled 是否将文件内容保存在 BlobStore 中
+func BlobsEnabled() bool {
+	return blobs != nil
+}
+
+func PutBlob(r io.Reader) (string, int64, error) {
+	return blobs.Put(r)
+}
+
+func OpenBlob(ref string) (io.ReadSeekCloser, error) {
+	return blobs.Open(ref)
+}
+
+// blobRefs 返回记录中引用的 BlobStore 文件
+func blobRefs(msgs []*Message) []string {
+	var refs []string
+	for _, msg := range msgs {
+		if msg.BlobRef != "" {
+			refs = append(refs, msg.BlobRef)
+		}
+	}
+	return refs
+}
+
+// collectBlobs 回收已过期或已删除记录的文件内容，读取任一剪贴板失败时跳过本次回收，避免误删仍在使用的内容
+func collectBlobs(ctx context.Context) {
+	if blobs == nil {
+		return
+	}
+	keys, err := cache.GetAllKeys(ctx)
+	if err != nil {
+		log.Printf("ERROR: collect blobs skipped, list boards failed: %v", err)
+		return
+	}
+	inUse := make(map[string]bool)
+	for _, key := range keys {
+		// 不能通过 List 读取，否则每次回收都会刷新所有剪贴板的访问时间，使按最久未访问淘汰失效
+		refs, err := cache.ListBlobRefs(ctx, key)
+		if err != nil {
+			log.Printf("ERROR: collect blobs skipped, list board %s failed: %v", key, err)
+			return
+		}
+		for _, ref := range refs {
+			inUse[ref] = true
+		}
+	}
+	removed, err := blobs.Collect(inUse, time.Now().Add(-blobGracePeriod))
+	if err != nil {
+		log.Printf("ERROR: collect blobs failed: %v", err)
+		return
+	}
+	log.Printf("回收文件内容完成，删除文件数：%v", removed)
+}
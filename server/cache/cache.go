@@ -1,6 +1,8 @@
 package cache
 
 import (
+	"context"
+	"fmt"
 	"github.com/go-redis/redis/v8"
 	"github.com/robfig/cron/v3"
 	"log"
@@ -8,13 +10,17 @@ import (
 )
 
 var (
-	cache       Cache
-	redisClient *redis.Client
+	cache           Cache
+	redisClient     redis.UniversalClient
+	blobs           BlobStore // 未配置时文件内容以 base64 保存在记录中
+	expireListeners []func(key string)
+	eventListeners  []func(payload []byte)
 )
 
 const (
 	CacheTypeMemory = "memory"
 	CacheTypeRedis  = "redis"
+	CacheTypeSQLite = "sqlite"
 )
 
 type Config struct {
@@ -22,50 +28,145 @@ type Config struct {
 	RedisAddr     string
 	RedisPassword string
 	RedisDB       int
+
+	RedisURL              string   // redis:// 或 rediss:// 地址，设置后忽略单节点的地址、密码和数据库编号
+	RedisUsername         string   // ACL 用户名
+	RedisSentinelMaster   string   // Sentinel 监控的主节点名称，设置后通过 Sentinel 连接
+	RedisSentinelAddrs    []string // Sentinel 节点地址
+	RedisSentinelUsername string
+	RedisSentinelPassword string
+	RedisClusterAddrs     []string // Cluster 种子节点地址，设置后以集群模式连接
+	RedisTLS              bool     // 使用 TLS 连接
+	RedisTLSCA            string   // 校验服务端证书的 CA 证书文件，为空时使用系统根证书
+	RedisTLSCert          string   // 客户端证书文件
+	RedisTLSKey           string   // 客户端私钥文件
+	RedisKeyPrefix        string   // 所有 key 的前缀
+
+	DBPath  string // SQLite 数据库文件路径
+	BlobDir string // 文件内容的保存目录，为空时保存在缓存中。多个实例共用 Redis 时必须是共享存储，服务端不做检查
+
+	CleanInterval time.Duration // 清理过期缓存的间隔
+
+	SnapshotPath     string        // 内存缓存的快照文件路径，为空时不保存快照
+	SnapshotInterval time.Duration // 定时保存快照的间隔，为 0 时只在退出时保存
+
+	Budget Budget // 缓存的容量上限，超出时淘汰最久未访问的剪贴板
+
+	FrontCacheSize int           // Redis 缓存之上进程内缓存的剪贴板数量，为 0 时不使用进程内缓存
+	FrontCacheTTL  time.Duration // 进程内缓存的有效期
 }
 
 func InitCache(config Config) {
+	budget = config.Budget
 	switch config.CacheType {
 	case CacheTypeRedis:
-		redisClient = redis.NewClient(&redis.Options{
-			Addr:     config.RedisAddr,
-			Password: config.RedisPassword,
-			DB:       config.RedisDB,
-		})
-		cache = NewRedisCache(redisClient)
+		client, err := newRedisClient(config)
+		if err != nil {
+			log.Fatalf("ERROR: init Redis client failed: %v", err)
+		}
+		redisClient = client
+		redisCache := NewRedisCache(redisClient, config.RedisKeyPrefix)
+		if config.FrontCacheSize > 0 {
+			cache = NewTieredCache(redisCache, config.FrontCacheSize, config.FrontCacheTTL)
+		} else {
+			cache = redisCache
+		}
+	case CacheTypeSQLite:
+		cache = NewSQLiteCache(config.DBPath)
 	default:
-		cache = NewInMemoryCache()
+		cache = NewInMemoryCache(config.SnapshotPath)
+	}
+
+	if config.BlobDir != "" {
+		store, err := NewDirBlobStore(config.BlobDir)
+		if err != nil {
+			log.Fatalf("ERROR: init blob store failed: %v", err)
+		}
+		blobs = store
 	}
 
 	go func() {
 		c := cron.New()
-		// 清理过期缓存，10分钟执行一次
-		_, err := c.AddFunc("@every 10m", func() {
+		// 清理过期缓存
+		_, err := c.AddFunc(fmt.Sprintf("@every %s", config.CleanInterval), func() {
 			go func() {
-				cache.Clean()
-				log.Printf("清理过期缓存完成，当前缓存大小：%v", cache.Size())
+				ctx := context.Background()
+				if err := cache.Clean(ctx); err != nil {
+					log.Printf("ERROR: clean cache failed: %v", err)
+					return
+				}
+				usage, err := cache.Size(ctx)
+				if err != nil {
+					log.Printf("ERROR: read cache usage failed: %v", err)
+					return
+				}
+				log.Printf("清理过期缓存完成，当前剪贴板数：%v，占用字节数：%v", usage.Boards, usage.Bytes)
+				collectBlobs(ctx)
 			}()
 		})
 		if err != nil {
 			log.Printf("ERROR-清理过期缓存任务启动失败: %v", err)
 			panic(err)
 		}
-		log.Println("开启定时任务，10分钟执行一次，清理过期缓存")
+		log.Printf("开启定时任务，%v执行一次，清理过期缓存", config.CleanInterval)
+		if mem, ok := cache.(*InMemoryCache); ok && config.SnapshotPath != "" && config.SnapshotInterval > 0 {
+			// 定时保存快照，减少进程异常退出时丢失的内容
+			_, err = c.AddFunc(fmt.Sprintf("@every %s", config.SnapshotInterval), func() {
+				if err := mem.SaveSnapshot(); err != nil {
+					log.Printf("ERROR: save snapshot failed: %v", err)
+				}
+			})
+			if err != nil {
+				log.Printf("ERROR-保存快照任务启动失败: %v", err)
+				panic(err)
+			}
+			log.Printf("开启定时任务，%v执行一次，保存内存缓存快照", config.SnapshotInterval)
+		}
 		c.Start()
 	}()
 }
 
+// Cache 剪贴板缓存，ctx 取消或超时时中止对后端的访问。读取方法在剪贴板不存在时返回 false 和 nil 错误，
+// 后端不可用等错误与剪贴板不存在区分开，由调用方转换为服务端错误
 type Cache interface {
-	Get(key string) ([]*Message, bool)
-	Set(key string, data []*Message, duration time.Duration)
-	Delete(key string)
-	GetAllKeys() []string
-	Size() int
-	Clean()
-	GetExpireAt(key string) string
+	Get(ctx context.Context, key string) ([]*Message, bool, error)
+	// List 获取剪贴板的记录列表，文件记录不保证包含内容，用于列表展示
+	List(ctx context.Context, key string) ([]*Message, bool, error)
+	// ListBlobRefs 获取剪贴板中记录引用的 BlobStore 文件，供回收文件内容使用，不刷新剪贴板的访问时间，剪贴板不存在时返回空列表
+	ListBlobRefs(ctx context.Context, key string) ([]string, error)
+	// GetMessage 获取包含完整内容的单条记录
+	GetMessage(ctx context.Context, key, id string) (*Message, bool, error)
+	Set(ctx context.Context, key string, data []*Message, duration time.Duration) error
+	// CreateBoard 剪贴板不存在或已过期时以 meta 原子地创建空剪贴板并生成新的纪元，meta 可以为 nil，剪贴板已存在时返回 false
+	CreateBoard(ctx context.Context, key string, meta *BoardMeta, duration time.Duration) (bool, error)
+	Delete(ctx context.Context, key string) error
+	GetAllKeys(ctx context.Context) ([]string, error)
+	// Size 返回剪贴板数量和占用的字节数
+	Size(ctx context.Context) (Usage, error)
+	Clean(ctx context.Context) error
+	// GetExpireAt 获取剪贴板的过期时间，剪贴板不存在或没有过期时间时返回空字符串
+	GetExpireAt(ctx context.Context, key string) (string, error)
+
+	SetIp2BoardName(ctx context.Context, ip, boardName string, duration time.Duration) error
+	GetIp2BoardName(ctx context.Context, ip string) (string, bool, error)
+
+	// SetPeerRoom 记录设备配对后所在的房间，device 为服务端颁发的设备凭据的摘要，过期前重复设置可延长有效期
+	SetPeerRoom(ctx context.Context, device, room string, duration time.Duration) error
+	GetPeerRoom(ctx context.Context, device string) (string, bool, error)
+	DeletePeerRoom(ctx context.Context, device string) error
 
-	SetIp2BoardName(ip, boardName string, duration time.Duration)
-	GetIp2BoardName(ip string) (string, bool)
+	// GetMeta 获取剪贴板的元数据，元数据与剪贴板内容一起过期
+	GetMeta(ctx context.Context, key string) (*BoardMeta, bool, error)
+	// UpdateMeta 原子地读取并修改剪贴板的元数据，fn 修改的是副本，返回错误时不写回，剪贴板不存在时返回 ErrBoardNotFound
+	UpdateMeta(ctx context.Context, key string, fn func(meta *BoardMeta) error) error
+	// AppendMessage 原子地追加记录并按保留策略淘汰最旧的记录，记录 ID 由缓存分配，返回被淘汰的记录
+	AppendMessage(ctx context.Context, key string, msg *Message, max Retention) ([]*Message, error)
+	// RemoveMessage 原子地删除记录，不改变剪贴板的过期时间
+	RemoveMessage(ctx context.Context, key, id string) (*Message, error)
+	// SetPinned 原子地修改记录的置顶状态，返回修改后的记录和被淘汰的记录
+	SetPinned(ctx context.Context, key, id string, pinned bool, max Retention) (*Message, []*Message, error)
+	// Close 退出前调用，内存缓存保存快照，其他缓存关闭连接
+	Close() error
 }
 
 type Message struct {
@@ -76,45 +177,171 @@ type Message struct {
 	IsFile   bool   `json:"isFile"`
 	FileType string `json:"fileType"`
 	FileName string `json:"fileName"`
+	Size     int64  `json:"size"`              // 原始内容字节数
+	Pinned   bool   `json:"pinned"`            // 置顶的记录不会被淘汰，并会延长剪贴板的过期时间
+	Seq      int64  `json:"seq"`               // 最近一次变更的序号
+	BlobRef  string `json:"blobRef,omitempty"` // 文件内容在 BlobStore 中的引用，此时 Content 为空
+}
+
+// BoardMeta 剪贴板元数据
+type BoardMeta struct {
+	PasswordHash string        `json:"passwordHash,omitempty"` // bcrypt 哈希，为空表示未设置密码
+	CreatorHash  string        `json:"creatorHash,omitempty"`  // 创建者令牌的 sha256，只有创建者可以设置密码和保留策略
+	Settings     BoardSettings `json:"settings"`
+	Tombstones   []Tombstone   `json:"tombstones,omitempty"` // 最近删除的记录，用于增量同步
+	Pruned       int64         `json:"pruned,omitempty"`     // 已丢弃的墓碑中最大的变更序号
+	Epoch        string        `json:"epoch,omitempty"`      // 剪贴板创建时生成，过期后以同名重建时不同，用于区分记录 ID 和游标属于哪一次创建
+}
+
+// Tombstone 已删除记录的墓碑
+type Tombstone struct {
+	Id  string `json:"id"`
+	Seq int64  `json:"seq"` // 删除时的变更序号
+}
+
+// BoardSettings 剪贴板的保留策略，零值表示使用服务端默认值
+type BoardSettings struct {
+	MaxMessages int   `json:"maxMessages"` // 最多保留的记录条数
+	MaxBytes    int64 `json:"maxBytes"`    // 所有记录的总字节数上限
+	TTL         int64 `json:"ttl"`         // 有内容时的过期时间，单位秒
 }
 
 type cachedItem struct {
 	Data       []*Message
+	Meta       *BoardMeta
+	Seq        int64
 	Expiration int64
+	Bytes      int64 // 记录占用的字节数
+	AccessedAt int64 // 最近一次访问的时间，用于淘汰最久未访问的剪贴板
 }
 type cachedBoardName struct {
 	BoardName  string
 	Expiration int64
 }
+type cachedPeerRoom struct {
+	Room       string
+	Expiration int64
+}
+
+// OnExpire 注册剪贴板过期回调，需在 InitCache 之前调用
+func OnExpire(fn func(key string)) {
+	expireListeners = append(expireListeners, fn)
+}
+
+func notifyExpired(key string) {
+	for _, fn := range expireListeners {
+		fn(key)
+	}
+}
+
+// OnBroadcast 注册接收 Broadcast 事件的回调，需在 InitCache 之前调用
+func OnBroadcast(fn func(payload []byte)) {
+	eventListeners = append(eventListeners, fn)
+}
+
+func notifyBroadcast(payload []byte) {
+	for _, fn := range eventListeners {
+		fn(payload)
+	}
+}
 
-func GetFromCache(key string) ([]*Message, bool) {
-	return cache.Get(key)
+// broadcaster 能在共用同一缓存的多个实例之间发布事件的缓存
+type broadcaster interface {
+	broadcast(ctx context.Context, payload []byte) error
 }
 
-func SetToCache(key string, data []*Message, duration time.Duration) {
-	cache.Set(key, data, duration)
+// Broadcast 将事件发布给所有实例（包括本实例）的 OnBroadcast 回调。Redis 缓存通过 pub/sub 发布，
+// 其余缓存只能在单个进程内使用，直接调用本进程的回调；pub/sub 发布失败时只通知本实例
+func Broadcast(ctx context.Context, payload []byte) {
+	if b, ok := cache.(broadcaster); ok {
+		err := b.broadcast(ctx, payload)
+		if err == nil {
+			return
+		}
+		log.Printf("ERROR: broadcast event failed: %v", err)
+	}
+	notifyBroadcast(payload)
 }
 
-func DeleteFromCache(key string) {
-	cache.Delete(key)
+func GetFromCache(ctx context.Context, key string) ([]*Message, bool, error) {
+	return cache.Get(ctx, key)
 }
 
-func GetExpireAt(key string) string {
-	return cache.GetExpireAt(key)
+func ListFromCache(ctx context.Context, key string) ([]*Message, bool, error) {
+	return cache.List(ctx, key)
 }
 
-func GetAllKeys() []string {
-	return cache.GetAllKeys()
+func GetMessageFromCache(ctx context.Context, key, id string) (*Message, bool, error) {
+	return cache.GetMessage(ctx, key, id)
 }
 
-func CacheSize() int {
-	return cache.Size()
+func SetToCache(ctx context.Context, key string, data []*Message, duration time.Duration) error {
+	return cache.Set(ctx, key, data, duration)
 }
 
-func GetBoardNameFromCache(ip string) (string, bool) {
-	return cache.GetIp2BoardName(ip)
+func DeleteFromCache(ctx context.Context, key string) error {
+	return cache.Delete(ctx, key)
 }
 
-func SetBoardNameToCache(ip, boardName string, duration time.Duration) {
-	cache.SetIp2BoardName(ip, boardName, duration)
+func GetExpireAt(ctx context.Context, key string) (string, error) {
+	return cache.GetExpireAt(ctx, key)
+}
+
+func GetAllKeys(ctx context.Context) ([]string, error) {
+	return cache.GetAllKeys(ctx)
+}
+
+func CacheSize(ctx context.Context) (Usage, error) {
+	return cache.Size(ctx)
+}
+
+func GetBoardNameFromCache(ctx context.Context, ip string) (string, bool, error) {
+	return cache.GetIp2BoardName(ctx, ip)
+}
+
+func SetBoardNameToCache(ctx context.Context, ip, boardName string, duration time.Duration) error {
+	return cache.SetIp2BoardName(ctx, ip, boardName, duration)
+}
+
+func GetPeerRoom(ctx context.Context, device string) (string, bool, error) {
+	return cache.GetPeerRoom(ctx, device)
+}
+
+func SetPeerRoom(ctx context.Context, device, room string, duration time.Duration) error {
+	return cache.SetPeerRoom(ctx, device, room, duration)
+}
+
+func DeletePeerRoom(ctx context.Context, device string) error {
+	return cache.DeletePeerRoom(ctx, device)
+}
+
+func GetBoardMetaFromCache(ctx context.Context, key string) (*BoardMeta, bool, error) {
+	return cache.GetMeta(ctx, key)
+}
+
+func CreateBoard(ctx context.Context, key string, meta *BoardMeta, duration time.Duration) (bool, error) {
+	return cache.CreateBoard(ctx, key, meta, duration)
+}
+
+func UpdateBoardMeta(ctx context.Context, key string, fn func(meta *BoardMeta) error) error {
+	return cache.UpdateMeta(ctx, key, fn)
+}
+
+func AppendMessage(ctx context.Context, key string, msg *Message, max Retention) ([]*Message, error) {
+	return cache.AppendMessage(ctx, key, msg, max)
+}
+
+func RemoveMessage(ctx context.Context, key, id string) (*Message, error) {
+	return cache.RemoveMessage(ctx, key, id)
+}
+
+func SetPinned(ctx context.Context, key, id string, pinned bool, max Retention) (*Message, []*Message, error) {
+	return cache.SetPinned(ctx, key, id, pinned, max)
+}
+
+// CloseCache 退出前关闭缓存
+func CloseCache() {
+	if err := cache.Close(); err != nil {
+		log.Printf("ERROR: close cache failed: %v", err)
+	}
 }
@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// MaxTombstones 每个剪贴板保留的墓碑条数，游标早于被丢弃的墓碑时需要全量同步
+const MaxTombstones = 100
+
+var (
+	ErrBoardNotFound   = errors.New("board not found")
+	ErrMessageNotFound = errors.New("message not found")
+	ErrTooManyPinned   = errors.New("too many pinned messages")
+)
+
+// Retention 剪贴板的保留策略，由服务端根据剪贴板设置和服务端限制计算
+type Retention struct {
+	MaxMessages int           // 保留的记录条数，置顶记录不计入
+	MaxBytes    int64         // 保留的总字节数，置顶记录不计入
+	MaxPinned   int           // 最多置顶的记录条数
+	TTL         time.Duration // 有内容时的过期时间
+	PinnedTTL   time.Duration // 有置顶记录时的最短过期时间
+}
+
+// boardState 原子操作中读取到的剪贴板状态，操作完成后整体写回
+type boardState struct {
+	Data []*Message
+	Meta *BoardMeta
+	Seq  int64
+}
+
+// appendMessage 分配记录 ID 并将记录放在最前面，按保留策略淘汰最旧的记录，返回被淘汰的记录
+func (s *boardState) appendMessage(msg *Message, r Retention) []*Message {
+	s.ensureEpoch()
+	s.Seq++
+	msg.Id = MessageId(s.Meta.Epoch, s.Seq)
+	msg.Seq = s.Seq
+
+	msgs := append([]*Message{msg}, s.Data...)
+	s.Data = r.apply(msgs)
+	evicted := evictedMessages(msgs, s.Data)
+	s.addTombstones(evicted)
+	return evicted
+}
+
+// removeMessage 删除记录并记录墓碑
+func (s *boardState) removeMessage(id string) (*Message, error) {
+	idx := s.indexOf(id)
+	if idx < 0 {
+		return nil, ErrMessageNotFound
+	}
+	s.Seq++
+
+	removed := s.Data[idx]
+	msgs := make([]*Message, 0, len(s.Data)-1)
+	msgs = append(msgs, s.Data[:idx]...)
+	s.Data = append(msgs, s.Data[idx+1:]...)
+	s.addTombstones([]*Message{removed})
+	return removed, nil
+}
+
+// setPinned 修改记录的置顶状态，取消置顶后重新按保留策略裁剪，返回修改后的记录和被淘汰的记录
+func (s *boardState) setPinned(id string, pinned bool, r Retention) (*Message, []*Message, error) {
+	idx := s.indexOf(id)
+	if idx < 0 {
+		return nil, nil, ErrMessageNotFound
+	}
+	if pinned {
+		pinnedCount := 0
+		for i, msg := range s.Data {
+			if i != idx && msg.Pinned {
+				pinnedCount++
+			}
+		}
+		if pinnedCount >= r.MaxPinned {
+			return nil, nil, ErrTooManyPinned
+		}
+	}
+	s.Seq++
+
+	// 复制后再修改，其他请求可能正在读取原记录
+	updated := *s.Data[idx]
+	updated.Pinned = pinned
+	updated.Seq = s.Seq
+	msgs := append([]*Message(nil), s.Data...)
+	msgs[idx] = &updated
+
+	s.Data = r.apply(msgs)
+	evicted := evictedMessages(msgs, s.Data)
+	s.addTombstones(evicted)
+	return &updated, evicted, nil
+}
+
+// updateMeta 复制元数据后交给 fn 修改，其他请求可能正在读取原元数据
+func (s *boardState) updateMeta(fn func(meta *BoardMeta) error) error {
+	var meta BoardMeta
+	if s.Meta != nil {
+		meta = *s.Meta
+	}
+	if err := fn(&meta); err != nil {
+		return err
+	}
+	s.Meta = &meta
+	return nil
+}
+
+func (s *boardState) indexOf(id string) int {
+	for i, msg := range s.Data {
+		if msg.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// ensureEpoch 为没有纪元的剪贴板生成纪元，如旧版本创建的剪贴板
+func (s *boardState) ensureEpoch() {
+	if s.Meta != nil && s.Meta.Epoch != "" {
+		return
+	}
+	s.Meta = withEpoch(s.Meta)
+}
+
+// withEpoch 复制元数据并生成新的纪元，meta 可以为 nil
+func withEpoch(meta *BoardMeta) *BoardMeta {
+	var m BoardMeta
+	if meta != nil {
+		m = *meta
+	}
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		m.Epoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+	} else {
+		m.Epoch = hex.EncodeToString(b)
+	}
+	return &m
+}
+
+// MessageId 记录 ID 为 纪元-变更序号，没有纪元的旧剪贴板只使用序号
+func MessageId(epoch string, seq int64) string {
+	if epoch == "" {
+		return strconv.FormatInt(seq, 10)
+	}
+	return epoch + "-" + strconv.FormatInt(seq, 10)
+}
+
+// addTombstones 以当前序号记录被删除或淘汰的记录
+func (s *boardState) addTombstones(removed []*Message) {
+	if len(removed) == 0 {
+		return
+	}
+	var meta BoardMeta
+	if s.Meta != nil {
+		meta = *s.Meta
+	}
+	tombstones := append([]Tombstone(nil), meta.Tombstones...)
+	for _, msg := range removed {
+		tombstones = append(tombstones, Tombstone{Id: msg.Id, Seq: s.Seq})
+	}
+	if n := len(tombstones) - MaxTombstones; n > 0 {
+		meta.Pruned = tombstones[n-1].Seq
+		tombstones = tombstones[n:]
+	}
+	meta.Tombstones = tombstones
+	s.Meta = &meta
+}
+
+// apply 按保留策略裁剪记录，msgs 需按时间倒序排列，优先淘汰最旧的记录，置顶的记录不参与淘汰
+func (r Retention) apply(msgs []*Message) []*Message {
+	kept := make([]*Message, 0, len(msgs))
+	var count int
+	var total int64
+	for _, msg := range msgs {
+		if msg.Pinned {
+			kept = append(kept, msg)
+			continue
+		}
+		count++
+		total += MessageSize(msg)
+		if count > r.MaxMessages || total > r.MaxBytes {
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	return kept
+}
+
+// ttl 根据剪贴板内容计算过期时间，有置顶记录时至少保留 PinnedTTL
+func (r Retention) ttl(msgs []*Message) time.Duration {
+	for _, msg := range msgs {
+		if msg.Pinned && r.PinnedTTL > r.TTL {
+			return r.PinnedTTL
+		}
+	}
+	return r.TTL
+}
+
+// evictedMessages 获取 before 中存在而 after 中不存在的记录
+func evictedMessages(before, after []*Message) []*Message {
+	kept := make(map[string]bool, len(after))
+	for _, msg := range after {
+		kept[msg.Id] = true
+	}
+	var evicted []*Message
+	for _, msg := range before {
+		if !kept[msg.Id] {
+			evicted = append(evicted, msg)
+		}
+	}
+	return evicted
+}
+
+// MessageSize 获取记录的原始字节数，兼容未记录 Size 的旧数据
+func MessageSize(msg *Message) int64 {
+	if msg.Size > 0 {
+		return msg.Size
+	}
+	if msg.IsFile {
+		return int64(len(msg.Content)) * 3 / 4
+	}
+	return int64(len(msg.Content))
+}
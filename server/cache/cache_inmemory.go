@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"context"
 	"log"
 	"sync"
 	"time"
@@ -9,70 +10,272 @@ import (
 type InMemoryCache struct {
 	cache          map[string]cachedItem
 	cacheBoardName map[string]cachedBoardName
+	cachePeerRoom  map[string]cachedPeerRoom
 	lock           sync.Mutex
+	snapshotPath   string // 快照文件路径，为空时不保存快照
 }
 
-func NewInMemoryCache() *InMemoryCache {
-	return &InMemoryCache{
+// NewInMemoryCache 创建内存缓存，snapshotPath 不为空时从快照文件恢复
+func NewInMemoryCache(snapshotPath string) *InMemoryCache {
+	c := &InMemoryCache{
 		cache:          make(map[string]cachedItem),
 		cacheBoardName: make(map[string]cachedBoardName),
+		cachePeerRoom:  make(map[string]cachedPeerRoom),
+		snapshotPath:   snapshotPath,
 	}
+	if snapshotPath != "" {
+		if err := c.loadSnapshot(); err != nil {
+			log.Printf("ERROR: load snapshot %s failed: %v", snapshotPath, err)
+		}
+	}
+	return c
 }
 
-func (c *InMemoryCache) Get(key string) ([]*Message, bool) {
+func (c *InMemoryCache) Get(ctx context.Context, key string) ([]*Message, bool, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
 	item, found := c.cache[key]
 	if !found {
-		return nil, false
+		return nil, false, nil
 	}
 
-	if item.Expiration < time.Now().UnixNano() {
+	now := time.Now().UnixNano()
+	if item.Expiration < now {
 		delete(c.cache, key)
-		return nil, false
+		go notifyExpired(key)
+		return nil, false, nil
 	}
 
-	return item.Data, true
+	item.AccessedAt = now
+	c.cache[key] = item
+	return item.Data, true, nil
 }
 
-func (c *InMemoryCache) GetExpireAt(key string) string {
+// List 内存中的记录本身就在进程内，直接返回完整内容
+func (c *InMemoryCache) List(ctx context.Context, key string) ([]*Message, bool, error) {
+	return c.Get(ctx, key)
+}
+
+func (c *InMemoryCache) ListBlobRefs(ctx context.Context, key string) ([]string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	item, found := c.cache[key]
+	if !found || item.Expiration < time.Now().UnixNano() {
+		return nil, nil
+	}
+	return blobRefs(item.Data), nil
+}
+
+func (c *InMemoryCache) GetMessage(ctx context.Context, key, id string) (*Message, bool, error) {
+	msgs, ok, err := c.Get(ctx, key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	for _, msg := range msgs {
+		if msg.Id == id {
+			return msg, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (c *InMemoryCache) GetExpireAt(ctx context.Context, key string) (string, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
 	item, found := c.cache[key]
 	if !found {
-		return ""
+		return "", nil
 	}
 
 	expireAt := time.Unix(0, item.Expiration)
 	if expireAt.Before(time.Now()) {
 		delete(c.cache, key)
-		return ""
+		go notifyExpired(key)
+		return "", nil
 	}
 
-	return expireAt.Format("2006-01-02 15:04:05")
+	return expireAt.Format("2006-01-02 15:04:05"), nil
 }
 
-func (c *InMemoryCache) Set(key string, data []*Message, duration time.Duration) {
+func (c *InMemoryCache) Set(ctx context.Context, key string, data []*Message, duration time.Duration) error {
 	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	expiration := time.Now().Add(duration).UnixNano()
+	now := time.Now()
+	expiration := now.Add(duration).UnixNano()
+	// 覆盖内容时保留未过期剪贴板的元数据和变更序号
+	var meta *BoardMeta
+	var seq int64
+	if item, found := c.cache[key]; found && item.Expiration >= now.UnixNano() {
+		meta = item.Meta
+		seq = item.Seq
+	}
 	c.cache[key] = cachedItem{
 		Data:       data,
+		Meta:       meta,
+		Seq:        seq,
 		Expiration: expiration,
+		Bytes:      boardBytes(data),
+		AccessedAt: now.UnixNano(),
+	}
+	evicted := c.evictLocked(key)
+	c.lock.Unlock()
+
+	notifyEvicted(evicted)
+	return nil
+}
+
+func (c *InMemoryCache) CreateBoard(ctx context.Context, key string, meta *BoardMeta, duration time.Duration) (bool, error) {
+	c.lock.Lock()
+	now := time.Now()
+	if item, found := c.cache[key]; found && item.Expiration >= now.UnixNano() {
+		c.lock.Unlock()
+		return false, nil
+	}
+	c.cache[key] = cachedItem{
+		Data:       make([]*Message, 0),
+		Meta:       withEpoch(meta),
+		Expiration: now.Add(duration).UnixNano(),
+		AccessedAt: now.UnixNano(),
+	}
+	evicted := c.evictLocked(key)
+	c.lock.Unlock()
+
+	notifyEvicted(evicted)
+	return true, nil
+}
+
+func (c *InMemoryCache) UpdateMeta(ctx context.Context, key string, fn func(meta *BoardMeta) error) error {
+	return c.update(key, func(s *boardState) (time.Duration, error) {
+		return 0, s.updateMeta(fn)
+	})
+}
+
+func (c *InMemoryCache) AppendMessage(ctx context.Context, key string, msg *Message, max Retention) ([]*Message, error) {
+	var evicted []*Message
+	err := c.update(key, func(s *boardState) (time.Duration, error) {
+		evicted = s.appendMessage(msg, max)
+		return max.ttl(s.Data), nil
+	})
+	return evicted, err
+}
+
+func (c *InMemoryCache) RemoveMessage(ctx context.Context, key, id string) (*Message, error) {
+	var removed *Message
+	err := c.update(key, func(s *boardState) (time.Duration, error) {
+		var err error
+		removed, err = s.removeMessage(id)
+		return 0, err
+	})
+	return removed, err
+}
+
+func (c *InMemoryCache) SetPinned(ctx context.Context, key, id string, pinned bool, max Retention) (*Message, []*Message, error) {
+	var updated *Message
+	var evicted []*Message
+	err := c.update(key, func(s *boardState) (time.Duration, error) {
+		var err error
+		updated, evicted, err = s.setPinned(id, pinned, max)
+		return max.ttl(s.Data), err
+	})
+	return updated, evicted, err
+}
+
+// update 在锁内读取、修改并写回剪贴板，fn 返回新的过期时间，返回 0 时保持原过期时间，返回错误时不写回
+func (c *InMemoryCache) update(key string, fn func(s *boardState) (time.Duration, error)) error {
+	c.lock.Lock()
+	now := time.Now()
+	item, found := c.cache[key]
+	if !found || item.Expiration < now.UnixNano() {
+		c.lock.Unlock()
+		return ErrBoardNotFound
+	}
+
+	s := boardState{Data: item.Data, Meta: item.Meta, Seq: item.Seq}
+	ttl, err := fn(&s)
+	if err != nil {
+		c.lock.Unlock()
+		return err
+	}
+	item.Data, item.Meta, item.Seq = s.Data, s.Meta, s.Seq
+	if ttl > 0 {
+		item.Expiration = now.Add(ttl).UnixNano()
+	}
+	item.Bytes = boardBytes(s.Data)
+	item.AccessedAt = now.UnixNano()
+	c.cache[key] = item
+	evicted := c.evictLocked(key)
+	c.lock.Unlock()
+
+	notifyEvicted(evicted)
+	return nil
+}
+
+// evictLocked 超出容量上限时淘汰最久未访问的剪贴板，正在写入的剪贴板 except 不会被淘汰，需在锁内调用
+func (c *InMemoryCache) evictLocked(except string) []string {
+	if !budget.enabled() {
+		return nil
+	}
+	usage := c.usageLocked()
+	evicted := make([]string, 0)
+	for budget.exceeded(usage) {
+		victim := ""
+		var oldest int64
+		for k, v := range c.cache {
+			if k != except && (victim == "" || v.AccessedAt < oldest) {
+				victim, oldest = k, v.AccessedAt
+			}
+		}
+		if victim == "" {
+			break
+		}
+		usage.Boards--
+		usage.Bytes -= c.cache[victim].Bytes
+		delete(c.cache, victim)
+		evicted = append(evicted, victim)
 	}
+	return evicted
 }
 
-func (c *InMemoryCache) Delete(key string) {
+func (c *InMemoryCache) usageLocked() Usage {
+	usage := Usage{Boards: len(c.cache)}
+	for _, v := range c.cache {
+		usage.Bytes += v.Bytes
+	}
+	return usage
+}
+
+func (c *InMemoryCache) GetMeta(ctx context.Context, key string) (*BoardMeta, bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	item, found := c.cache[key]
+	if !found || item.Meta == nil {
+		return nil, false, nil
+	}
+
+	now := time.Now().UnixNano()
+	if item.Expiration < now {
+		delete(c.cache, key)
+		go notifyExpired(key)
+		return nil, false, nil
+	}
+
+	item.AccessedAt = now
+	c.cache[key] = item
+	return item.Meta, true, nil
+}
+
+func (c *InMemoryCache) Delete(ctx context.Context, key string) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
 	delete(c.cache, key)
+	return nil
 }
 
-func (c *InMemoryCache) GetAllKeys() []string {
+func (c *InMemoryCache) GetAllKeys(ctx context.Context) ([]string, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
@@ -80,22 +283,24 @@ func (c *InMemoryCache) GetAllKeys() []string {
 	for k := range c.cache {
 		keys = append(keys, k)
 	}
-	return keys
+	return keys, nil
 }
 
-func (c *InMemoryCache) Size() int {
+func (c *InMemoryCache) Size(ctx context.Context) (Usage, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	return len(c.cache)
+	return c.usageLocked(), nil
 }
-func (c *InMemoryCache) Clean() {
+
+func (c *InMemoryCache) Clean(ctx context.Context) error {
 	c.lock.Lock()
-	defer c.lock.Unlock()
+	expired := make([]string, 0)
 	for k, v := range c.cache {
 		// 清理缓存中那些已经过期的项
 		if v.Expiration < time.Now().UnixNano() {
 			delete(c.cache, k)
+			expired = append(expired, k)
 			continue
 		}
 	}
@@ -107,28 +312,83 @@ func (c *InMemoryCache) Clean() {
 			continue
 		}
 	}
+	for k, v := range c.cachePeerRoom {
+		if v.Expiration < time.Now().UnixNano() {
+			delete(c.cachePeerRoom, k)
+		}
+	}
+	c.lock.Unlock()
 
-	log.Printf("清理过期缓存完成，当前缓存大小：%v", c.Size())
+	for _, k := range expired {
+		notifyExpired(k)
+	}
+	return nil
 }
 
-func (c *InMemoryCache) SetIp2BoardName(ip, boardName string, duration time.Duration) {
+func (c *InMemoryCache) SetIp2BoardName(ctx context.Context, ip, boardName string, duration time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	expiration := time.Now().Add(duration).UnixNano()
 	c.cacheBoardName[ip] = cachedBoardName{
 		BoardName:  boardName,
 		Expiration: expiration,
 	}
+	return nil
 }
 
-func (c *InMemoryCache) GetIp2BoardName(ip string) (string, bool) {
+func (c *InMemoryCache) GetIp2BoardName(ctx context.Context, ip string) (string, bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	item, found := c.cacheBoardName[ip]
 	if !found {
-		return "", false
+		return "", false, nil
 	}
 
 	if item.Expiration < time.Now().UnixNano() {
 		delete(c.cacheBoardName, ip)
-		return "", false
+		return "", false, nil
 	}
 
-	return item.BoardName, true
+	return item.BoardName, true, nil
+}
+
+func (c *InMemoryCache) SetPeerRoom(ctx context.Context, device, room string, duration time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.cachePeerRoom[device] = cachedPeerRoom{
+		Room:       room,
+		Expiration: time.Now().Add(duration).UnixNano(),
+	}
+	return nil
+}
+
+func (c *InMemoryCache) GetPeerRoom(ctx context.Context, device string) (string, bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	item, found := c.cachePeerRoom[device]
+	if !found {
+		return "", false, nil
+	}
+	if item.Expiration < time.Now().UnixNano() {
+		delete(c.cachePeerRoom, device)
+		return "", false, nil
+	}
+	return item.Room, true, nil
+}
+
+func (c *InMemoryCache) DeletePeerRoom(ctx context.Context, device string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.cachePeerRoom, device)
+	return nil
+}
+
+// Close 保存快照
+func (c *InMemoryCache) Close() error {
+	return c.SaveSnapshot()
 }
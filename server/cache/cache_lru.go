@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"encoding/base64"
+	"log"
+)
+
+// budget 缓存的容量上限，由 InitCache 设置
+var budget Budget
+
+// Budget 缓存的容量上限，超出时淘汰最久未访问的剪贴板，零值表示不限制
+type Budget struct {
+	MaxBoards int   // 剪贴板数量上限
+	MaxBytes  int64 // 所有剪贴板占用的总字节数上限
+}
+
+// Usage 缓存的当前用量
+type Usage struct {
+	Boards int   `json:"boards"`
+	Bytes  int64 `json:"bytes"`
+}
+
+func (b Budget) enabled() bool {
+	return b.MaxBoards > 0 || b.MaxBytes > 0
+}
+
+func (b Budget) exceeded(u Usage) bool {
+	return (b.MaxBoards > 0 && u.Boards > b.MaxBoards) || (b.MaxBytes > 0 && u.Bytes > b.MaxBytes)
+}
+
+// boardBytes 剪贴板在缓存中占用的字节数，保存在 BlobStore 中的文件内容不计入
+func boardBytes(msgs []*Message) int64 {
+	var total int64
+	for _, msg := range msgs {
+		total += storedBytes(msg)
+	}
+	return total
+}
+
+func storedBytes(msg *Message) int64 {
+	content := len(msg.Content)
+	if msg.IsFile && msg.BlobRef == "" {
+		// 删除、置顶等操作只读取元数据，此时文件内容为空，按原始大小换算为 base64 长度，与读取了内容时一致
+		content = base64.StdEncoding.EncodedLen(int(MessageSize(msg)))
+	}
+	return int64(len(msg.Id) + content + len(msg.Time) + len(msg.Ip) +
+		len(msg.FileType) + len(msg.FileName) + len(msg.BlobRef))
+}
+
+// notifyEvicted 被淘汰的剪贴板与过期的剪贴板一样通知监听者
+func notifyEvicted(keys []string) {
+	for _, k := range keys {
+		log.Printf("缓存容量超出上限，淘汰最久未访问的剪贴板：%s", k)
+		notifyExpired(k)
+	}
+}
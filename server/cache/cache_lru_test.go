@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setBudget 在测试期间设置容量上限
+func setBudget(t *testing.T, b Budget) {
+	old := budget
+	budget = b
+	t.Cleanup(func() { budget = old })
+}
+
+// recordExpired 在测试期间记录过期和被淘汰的剪贴板
+func recordExpired(t *testing.T) *[]string {
+	var keys []string
+	old := expireListeners
+	expireListeners = []func(key string){func(key string) { keys = append(keys, key) }}
+	t.Cleanup(func() { expireListeners = old })
+	return &keys
+}
+
+// checkUsage 用量记录与各剪贴板的实际内容一致
+func checkUsage(t *testing.T, c Cache, boards ...string) {
+	t.Helper()
+	ctx := context.Background()
+	want := Usage{Boards: len(boards)}
+	for _, key := range boards {
+		msgs, ok, err := c.Get(ctx, key)
+		if err != nil || !ok {
+			t.Fatalf("Get(%s) = %v, %v", key, ok, err)
+		}
+		want.Bytes += boardBytes(msgs)
+	}
+	usage, err := c.Size(ctx)
+	if err != nil || usage != want {
+		t.Fatalf("usage = %+v, %v, want %+v", usage, err, want)
+	}
+}
+
+func sortedKeys(t *testing.T, c Cache) []string {
+	t.Helper()
+	keys, err := c.GetAllKeys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// TestEvictLeastRecentlyUsed 超出 MaxBoards 或 MaxBytes 时淘汰最久未访问的剪贴板，读取会刷新访问时间
+func TestEvictLeastRecentlyUsed(t *testing.T) {
+	for _, b := range testBackends(t) {
+		c := b.c
+		t.Run(b.name, func(t *testing.T) {
+			evicted := recordExpired(t)
+			r := testRetention(10)
+			// 访问时间精度为毫秒，相邻操作之间留出间隔
+			step := func() { time.Sleep(5 * time.Millisecond) }
+
+			setBudget(t, Budget{MaxBoards: 2})
+			mustCreate(t, c, "a")
+			mustAppend(t, c, "a", textMessage("a"), r)
+			step()
+			mustCreate(t, c, "b")
+			mustAppend(t, c, "b", textMessage("b"), r)
+			step()
+			mustList(t, c, "a")
+			step()
+			mustCreate(t, c, "c")
+			if keys := sortedKeys(t, c); !reflect.DeepEqual(keys, []string{"a", "c"}) {
+				t.Fatalf("boards after exceeding MaxBoards: %v, want [a c]", keys)
+			}
+			if !reflect.DeepEqual(*evicted, []string{"b"}) {
+				t.Fatalf("evicted %v, want [b]", *evicted)
+			}
+			checkUsage(t, c, "a", "c")
+
+			// 单条记录约 1KB，MaxBytes 只能容纳两条
+			big := strings.Repeat("x", 1000)
+			setBudget(t, Budget{MaxBytes: 2500})
+			step()
+			mustAppend(t, c, "c", textMessage(big), r)
+			step()
+			mustAppend(t, c, "a", textMessage(big), r)
+			step()
+			mustCreate(t, c, "d")
+			mustAppend(t, c, "d", textMessage(big), r)
+			if keys := sortedKeys(t, c); !reflect.DeepEqual(keys, []string{"a", "d"}) {
+				t.Fatalf("boards after exceeding MaxBytes: %v, want [a d]", keys)
+			}
+			if !reflect.DeepEqual(*evicted, []string{"b", "c"}) {
+				t.Fatalf("evicted %v, want [b c]", *evicted)
+			}
+			checkUsage(t, c, "a", "d")
+		})
+	}
+}
+
+// TestUsageAfterRemoveAndExpire 删除记录和剪贴板过期后用量记录随之更新
+func TestUsageAfterRemoveAndExpire(t *testing.T) {
+	for _, b := range testBackends(t) {
+		b := b
+		c := b.c
+		t.Run(b.name, func(t *testing.T) {
+			ctx := context.Background()
+			expired := recordExpired(t)
+			setBudget(t, Budget{MaxBytes: 1 << 20})
+			r := testRetention(10)
+
+			mustCreate(t, c, "kept")
+			mustAppend(t, c, "kept", textMessage(strings.Repeat("a", 100)), r)
+			mustAppend(t, c, "kept", &Message{Content: "ZmlsZQ==", IsFile: true, FileName: "a.txt", Size: 4}, r)
+			// 删除文本记录时只读取了元数据，剩余文件记录的内容仍需计入
+			msgs := mustList(t, c, "kept")
+			if _, err := c.RemoveMessage(ctx, "kept", msgs[1].Id); err != nil {
+				t.Fatal(err)
+			}
+			checkUsage(t, c, "kept")
+
+			short := r
+			short.TTL = 200 * time.Millisecond
+			mustCreate(t, c, "short")
+			mustAppend(t, c, "short", textMessage("short"), short)
+			checkUsage(t, c, "kept", "short")
+
+			b.elapse(300 * time.Millisecond)
+			if err := c.Clean(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*expired, []string{"short"}) {
+				t.Fatalf("expired %v, want [short]", *expired)
+			}
+			checkUsage(t, c, "kept")
+
+			if err := c.Delete(ctx, "kept"); err != nil {
+				t.Fatal(err)
+			}
+			if usage, err := c.Size(ctx); err != nil || usage != (Usage{}) {
+				t.Fatalf("usage after deleting every board = %+v, %v", usage, err)
+			}
+		})
+	}
+}
@@ -7,17 +7,62 @@ import (
 	"fmt"
 	"github.com/go-redis/redis/v8"
 	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-var prefixBoard = "sync-board."
+// Redis 中每个剪贴板由以下几类 key 组成，key 中的 {board} 为 Redis Cluster 的 hash tag，保证同一剪贴板的 key 位于同一节点：
+//
+//	sync-board:{board}                 hash，字段 seq 为变更序号，meta 为元数据 JSON，该 key 存在即表示剪贴板存在
+//	sync-board:{board}:ids             sorted set，成员为记录 ID，分数为记录创建时的序号
+//	sync-board:{board}:msg:<id>        hash，记录的元数据，文本记录同时保存内容
+//	sync-board:{board}:blob:<id>       string，文件记录的 base64 内容，内容保存在 BlobStore 中时不使用
+//
+// 列表只读取元数据，下载时只读取一个 blob，所有 key 保持相同的过期时间。
+// 此外 ip:<ip> 保存 IP 最近使用的剪贴板名称，peer:<device> 保存设备配对后所在的房间，均为带过期时间的 string。
+// 配置了前缀时，以下所有 key 以及 pub/sub 频道名称前都会加上该前缀。
+// 另有两个全局 key 记录各剪贴板的用量，用于淘汰最久未访问的剪贴板：
+//
+//	sync-boards:lru                    sorted set，成员为剪贴板名称，分数为最近一次访问的毫秒时间戳
+//	sync-boards:bytes                  hash，字段为剪贴板名称，值为占用的字节数
+var prefixBoard = "sync-board:"
 var prefixIp = "ip:"
+var prefixPeer = "peer:"
+var lruKey = "sync-boards:lru"
+var bytesKey = "sync-boards:bytes"
+
+// eventsChannel 剪贴板事件的 pub/sub 频道，所有实例（包括发布者自身）都从该频道接收事件，保证各实例收到的顺序一致
+var eventsChannel = "sync-boards:events"
+
+// 旧版本将整个剪贴板序列化为一个 JSON 字符串，启动时迁移到新的结构
+var legacyPrefixBoard = "sync-board."
+
+// maxTxRetries 乐观事务因并发修改失败时的最大重试次数
+const maxTxRetries = 20
+
+// createBoardScript 剪贴板不存在时创建 head key，返回 1 表示已创建。
+// 剪贴板的其他 key 与 head key 同时过期，不存在 head key 时也不会残留旧的记录
+var createBoardScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'seq', 0, 'meta', ARGV[1])
+if tonumber(ARGV[2]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 1
+`)
 
 type RedisCache struct {
-	client *redis.Client
+	client   redis.UniversalClient
+	keys     redisKeys
+	onChange func(ctx context.Context, key string) // 剪贴板变更、删除或过期后调用，用于丢弃上层缓存
 }
 
-func NewRedisCache(client *redis.Client) *RedisCache {
+func NewRedisCache(client redis.UniversalClient, prefix string) *RedisCache {
 
 	statusCmd := client.Ping(context.Background())
 	if statusCmd.Err() != nil {
@@ -25,96 +70,767 @@ func NewRedisCache(client *redis.Client) *RedisCache {
 		return nil
 	}
 
-	return &RedisCache{client: client}
+	c := &RedisCache{client: client, keys: redisKeys{prefix: prefix}}
+	ctx := context.Background()
+	if prefix == "" {
+		// 旧版本的 key 没有前缀，只迁移到同样没有前缀的部署中
+		c.migrateLegacyBoards(ctx)
+	}
+	if err := c.syncUsage(ctx); err != nil {
+		log.Printf("ERROR: Redis sync usage failed: %v", err)
+	}
+	go c.watchExpired()
+	// 先完成订阅再返回，避免本实例启动后最早发布的事件自己收不到
+	pubsub := client.Subscribe(ctx, c.keys.events())
+	if _, err := pubsub.Receive(ctx); err != nil {
+		log.Fatalf("ERROR: Redis subscribe events failed: %v", err)
+		return nil
+	}
+	go c.watchEvents(pubsub)
+	return c
 }
 
-func (c *RedisCache) Get(key string) ([]*Message, bool) {
-	val, err := c.client.Get(context.Background(), keyPrefix(prefixBoard, key)).Result()
-	if errors.Is(err, redis.Nil) {
-		return nil, false
-	} else if err != nil {
-		log.Printf("ERROR: Redis GET failed: %v", err)
-		return nil, false
+// watchEvents 接收各实例通过 Broadcast 发布的事件
+func (c *RedisCache) watchEvents(pubsub *redis.PubSub) {
+	defer pubsub.Close()
+	for msg := range pubsub.Channel() {
+		notifyBroadcast([]byte(msg.Payload))
 	}
+}
 
-	var data []*Message
-	err = json.Unmarshal([]byte(val), &data)
+func (c *RedisCache) broadcast(ctx context.Context, payload []byte) error {
+	return c.client.Publish(ctx, c.keys.events(), payload).Err()
+}
+
+// watchExpired 订阅 Redis 的过期事件，需要 Redis 开启 notify-keyspace-events Ex
+func (c *RedisCache) watchExpired() {
+	cluster, ok := c.client.(*redis.ClusterClient)
+	if !ok {
+		db := 0
+		if client, ok := c.client.(*redis.Client); ok {
+			db = client.Options().DB
+		}
+		c.watchNodeExpired(c.client, db)
+		return
+	}
+	// 集群中过期事件只在 key 所在的节点上发布，需要分别订阅每个主节点
+	err := cluster.ForEachMaster(context.Background(), func(ctx context.Context, node *redis.Client) error {
+		go c.watchNodeExpired(node, 0)
+		return nil
+	})
 	if err != nil {
-		log.Printf("ERROR: Redis unmarshal failed: %v", err)
-		return nil, false
+		log.Printf("ERROR: Redis subscribe expired events failed: %v", err)
 	}
-
-	return data, true
 }
 
-func (c *RedisCache) GetExpireAt(key string) string {
+func (c *RedisCache) watchNodeExpired(client redis.UniversalClient, db int) {
 	ctx := context.Background()
-	ttl, err := c.client.TTL(ctx, keyPrefix(prefixBoard, key)).Result()
-	if err != nil || ttl == -2 { // -2 means the key does not exist
-		return ""
+	channel := fmt.Sprintf("__keyevent@%d__:expired", db)
+	pubsub := client.Subscribe(ctx, channel)
+	defer pubsub.Close()
+
+	for msg := range pubsub.Channel() {
+		if key, ok := c.keys.boardName(msg.Payload); ok {
+			c.removeUsage(ctx, key)
+			c.changed(ctx, key)
+			notifyExpired(key)
+		}
+	}
+}
+
+func (c *RedisCache) Get(ctx context.Context, key string) ([]*Message, bool, error) {
+	msgs, ok, err := c.List(ctx, key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	contents := make(map[*Message]*redis.StringCmd)
+	_, err = c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, msg := range msgs {
+			if msg.IsFile && msg.BlobRef == "" {
+				contents[msg] = pipe.Get(ctx, c.keys.blob(key, msg.Id))
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, false, err
+	}
+	for msg, cmd := range contents {
+		msg.Content = cmd.Val()
+	}
+	return msgs, true, nil
+}
+
+// List 只读取记录的元数据，文件记录不包含内容
+func (c *RedisCache) List(ctx context.Context, key string) ([]*Message, bool, error) {
+	s, ok, err := c.readBoardState(ctx, c.client, key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	c.touch(ctx, key)
+	return s.Data, true, nil
+}
+
+func (c *RedisCache) ListBlobRefs(ctx context.Context, key string) ([]string, error) {
+	s, ok, err := c.readBoardState(ctx, c.client, key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return blobRefs(s.Data), nil
+}
+
+func (c *RedisCache) GetMessage(ctx context.Context, key, id string) (*Message, bool, error) {
+	fields, err := c.client.HGetAll(ctx, c.keys.message(key, id)).Result()
+	if err != nil {
+		return nil, false, err
+	}
+	msg := parseMessage(fields)
+	if msg == nil {
+		return nil, false, nil
+	}
+	c.touch(ctx, key)
+	if msg.IsFile && msg.BlobRef == "" {
+		msg.Content, err = c.client.Get(ctx, c.keys.blob(key, id)).Result()
+		if errors.Is(err, redis.Nil) {
+			// 读取元数据后记录刚好被删除
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+	}
+	return msg, true, nil
+}
+
+func (c *RedisCache) GetExpireAt(ctx context.Context, key string) (string, error) {
+	ttl, err := c.client.TTL(ctx, c.keys.board(key)).Result()
+	if err != nil {
+		return "", err
+	}
+	if ttl == -2 { // -2 means the key does not exist
+		return "", nil
 	}
 
 	if ttl == -1 { // -1 means the key has no expiration
-		return ""
+		return "", nil
 	}
 
 	expireAt := time.Now().Add(ttl)
-	return expireAt.Format("2006-01-02 15:04:05")
+	return expireAt.Format("2006-01-02 15:04:05"), nil
+}
+
+// Set 覆盖剪贴板的记录列表，剪贴板不存在时创建，保留已有的元数据和变更序号
+func (c *RedisCache) Set(ctx context.Context, key string, data []*Message, duration time.Duration) error {
+	return c.update(ctx, key, true, func(s *boardState) (time.Duration, error) {
+		s.Data = data
+		return duration, nil
+	})
+}
+
+func (c *RedisCache) Delete(ctx context.Context, key string) error {
+	return c.deleteBoard(ctx, key)
 }
 
-func (c *RedisCache) Set(key string, data []*Message, duration time.Duration) {
-	val, err := json.Marshal(data)
+func (c *RedisCache) deleteBoard(ctx context.Context, key string) error {
+	ids, err := c.client.ZRange(ctx, c.keys.ids(key), 0, -1).Result()
 	if err != nil {
-		log.Printf("ERROR: Redis marshal failed: %v", err)
-		return
+		return err
+	}
+	keys := []string{c.keys.board(key), c.keys.ids(key)}
+	for _, id := range ids {
+		keys = append(keys, c.keys.message(key, id), c.keys.blob(key, id))
+	}
+	if err = c.client.Del(ctx, keys...).Err(); err != nil {
+		return err
+	}
+	c.removeUsage(ctx, key)
+	c.changed(ctx, key)
+	return nil
+}
+
+func (c *RedisCache) changed(ctx context.Context, key string) {
+	if c.onChange != nil {
+		c.onChange(ctx, key)
+	}
+}
+
+func (c *RedisCache) GetMeta(ctx context.Context, key string) (*BoardMeta, bool, error) {
+	val, err := c.client.HGet(ctx, c.keys.board(key), "meta").Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	var meta BoardMeta
+	if err = json.Unmarshal([]byte(val), &meta); err != nil {
+		return nil, false, fmt.Errorf("invalid meta of board %s: %w", key, err)
 	}
 
-	err = c.client.Set(context.Background(), keyPrefix(prefixBoard, key), val, duration).Err()
+	c.touch(ctx, key)
+	return &meta, true, nil
+}
+
+func (c *RedisCache) CreateBoard(ctx context.Context, key string, meta *BoardMeta, duration time.Duration) (bool, error) {
+	val, err := json.Marshal(withEpoch(meta))
 	if err != nil {
-		log.Printf("ERROR: Redis SET failed: %v", err)
+		return false, err
 	}
+	created, err := createBoardScript.Run(ctx, c.client, []string{c.keys.board(key)}, val, duration.Milliseconds()).Int()
+	if err != nil || created == 0 {
+		return false, err
+	}
+	c.changed(ctx, key)
+	c.setUsage(ctx, key, 0)
+	c.evict(ctx, key)
+	return true, nil
 }
 
-func (c *RedisCache) Delete(key string) {
-	err := c.client.Del(context.Background(), keyPrefix(prefixBoard, key)).Err()
+func (c *RedisCache) GetAllKeys(ctx context.Context) ([]string, error) {
+	keys := make([]string, 0)
+	err := c.scan(ctx, c.keys.boardPattern(), func(k string) {
+		if name, ok := c.keys.boardName(k); ok {
+			keys = append(keys, name)
+		}
+	})
 	if err != nil {
-		log.Printf("ERROR: Redis DEL failed: %v", err)
+		return nil, err
+	}
+	return keys, nil
+}
+
+// scan 遍历匹配 pattern 的 key，集群模式下遍历所有主节点，fn 不会被并发调用
+func (c *RedisCache) scan(ctx context.Context, pattern string, fn func(k string)) error {
+	cluster, ok := c.client.(*redis.ClusterClient)
+	if !ok {
+		return scanNode(ctx, c.client, pattern, fn)
+	}
+	var lock sync.Mutex
+	return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		return scanNode(ctx, node, pattern, func(k string) {
+			lock.Lock()
+			defer lock.Unlock()
+			fn(k)
+		})
+	})
+}
+
+func scanNode(ctx context.Context, client redis.Cmdable, pattern string, fn func(k string)) error {
+	iter := client.Scan(ctx, 0, pattern, 1000).Iterator()
+	for iter.Next(ctx) {
+		fn(iter.Val())
 	}
+	return iter.Err()
+}
+
+func (c *RedisCache) Size(ctx context.Context) (Usage, error) {
+	return c.usage(ctx)
+}
+
+// Clean 过期由 Redis 完成，这里只校正用量记录，未开启过期事件通知时过期的剪贴板在此时移除
+func (c *RedisCache) Clean(ctx context.Context) error {
+	return c.syncUsage(ctx)
+}
+
+func (c *RedisCache) Close() error {
+	return c.client.Close()
 }
 
-func (c *RedisCache) GetAllKeys() []string {
-	var cursor uint64
-	var keys []string
+func (c *RedisCache) UpdateMeta(ctx context.Context, key string, fn func(meta *BoardMeta) error) error {
+	return c.update(ctx, key, false, func(s *boardState) (time.Duration, error) {
+		return 0, s.updateMeta(fn)
+	})
+}
+
+func (c *RedisCache) AppendMessage(ctx context.Context, key string, msg *Message, max Retention) ([]*Message, error) {
+	var evicted []*Message
+	err := c.update(ctx, key, false, func(s *boardState) (time.Duration, error) {
+		evicted = s.appendMessage(msg, max)
+		return max.ttl(s.Data), nil
+	})
+	return evicted, err
+}
+
+func (c *RedisCache) RemoveMessage(ctx context.Context, key, id string) (*Message, error) {
+	var removed *Message
+	err := c.update(ctx, key, false, func(s *boardState) (time.Duration, error) {
+		var err error
+		removed, err = s.removeMessage(id)
+		return 0, err
+	})
+	return removed, err
+}
 
-	for {
-		var k []string
+func (c *RedisCache) SetPinned(ctx context.Context, key, id string, pinned bool, max Retention) (*Message, []*Message, error) {
+	var updated *Message
+	var evicted []*Message
+	err := c.update(ctx, key, false, func(s *boardState) (time.Duration, error) {
 		var err error
-		k, cursor, err = c.client.Scan(context.Background(), cursor, keyPrefix(prefixBoard, "*"), 1000).Result()
+		updated, evicted, err = s.setPinned(id, pinned, max)
+		return max.ttl(s.Data), err
+	})
+	return updated, evicted, err
+}
+
+// update 使用 WATCH/MULTI 乐观事务读取、修改并写回剪贴板，其他实例并发修改时重新执行 fn，
+// 每次写入都会修改 head key，因此只需 WATCH head key。
+// fn 返回新的过期时间，返回 0 时保持原过期时间，返回错误时不写回；create 为 true 时剪贴板不存在则创建
+func (c *RedisCache) update(ctx context.Context, key string, create bool, fn func(s *boardState) (time.Duration, error)) error {
+	head := c.keys.board(key)
+
+	var bytes int64
+	txf := func(tx *redis.Tx) error {
+		ttl, err := tx.PTTL(ctx, head).Result()
+		if err != nil {
+			return err
+		}
+		if ttl == -2 && !create { // -2 means the key does not exist
+			return ErrBoardNotFound
+		}
+
+		s, _, err := c.readBoardState(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		before := s.Data
+		newTTL, err := fn(s)
 		if err != nil {
-			log.Printf("ERROR: Redis SCAN failed: %v", err)
+			return err
+		}
+		bytes = boardBytes(s.Data)
+		if newTTL <= 0 {
+			newTTL = ttl
+		}
+		if newTTL < 0 { // -1 means the key has no expiration
+			newTTL = 0
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return c.writeBoardState(ctx, pipe, key, before, s, newTTL)
+		})
+		return err
+	}
+
+	for i := 0; i < maxTxRetries; i++ {
+		err := c.client.Watch(ctx, txf, head)
+		if errors.Is(err, redis.TxFailedErr) {
+			// 随机退避，避免多个实例同时重试再次冲突
+			time.Sleep(time.Duration(rand.Intn(5*(i+1))+1) * time.Millisecond)
+			continue
+		}
+		if err == nil {
+			c.changed(ctx, key)
+			// 用量记录位于其他 slot，不能放在同一个事务中，写入失败时由 Clean 校正
+			c.setUsage(ctx, key, bytes)
+			c.evict(ctx, key)
+		}
+		return err
+	}
+	return fmt.Errorf("redis transaction on %s failed after %d retries: %w", key, maxTxRetries, redis.TxFailedErr)
+}
+
+// touch 刷新剪贴板的访问时间，只更新已有的用量记录，避免为刚被删除的剪贴板留下记录
+func (c *RedisCache) touch(ctx context.Context, key string) {
+	err := c.client.ZAddXX(ctx, c.keys.lru(), &redis.Z{Score: float64(time.Now().UnixMilli()), Member: key}).Err()
+	if err != nil {
+		log.Printf("ERROR: Redis ZADD failed: %v", err)
+	}
+}
+
+func (c *RedisCache) setUsage(ctx context.Context, key string, bytes int64) {
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, c.keys.lru(), &redis.Z{Score: float64(time.Now().UnixMilli()), Member: key})
+		pipe.HSet(ctx, c.keys.bytes(), key, bytes)
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: Redis set usage failed: %v", err)
+	}
+}
+
+func (c *RedisCache) removeUsage(ctx context.Context, key string) {
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, c.keys.lru(), key)
+		pipe.HDel(ctx, c.keys.bytes(), key)
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: Redis remove usage failed: %v", err)
+	}
+}
+
+func (c *RedisCache) usage(ctx context.Context) (Usage, error) {
+	var countCmd *redis.IntCmd
+	var bytesCmd *redis.StringSliceCmd
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		countCmd = pipe.ZCard(ctx, c.keys.lru())
+		bytesCmd = pipe.HVals(ctx, c.keys.bytes())
+		return nil
+	})
+	if err != nil {
+		return Usage{}, err
+	}
+	usage := Usage{Boards: int(countCmd.Val())}
+	for _, val := range bytesCmd.Val() {
+		n, _ := strconv.ParseInt(val, 10, 64)
+		usage.Bytes += n
+	}
+	return usage, nil
+}
+
+// evict 超出容量上限时淘汰最久未访问的剪贴板，正在写入的剪贴板 except 不会被淘汰
+func (c *RedisCache) evict(ctx context.Context, except string) {
+	if !budget.enabled() {
+		return
+	}
+	usage, err := c.usage(ctx)
+	if err != nil {
+		log.Printf("ERROR: Redis read usage failed: %v", err)
+		return
+	}
+	evicted := make([]string, 0)
+	for budget.exceeded(usage) {
+		oldest, err := c.client.ZRange(ctx, c.keys.lru(), 0, 1).Result()
+		if err != nil {
+			log.Printf("ERROR: Redis ZRANGE failed: %v", err)
 			break
 		}
-		keys = append(keys, k...)
-		if cursor == 0 {
+		victim := ""
+		for _, k := range oldest {
+			if k != except {
+				victim = k
+				break
+			}
+		}
+		if victim == "" {
+			break
+		}
+		bytes, _ := c.client.HGet(ctx, c.keys.bytes(), victim).Int64()
+		if err = c.deleteBoard(ctx, victim); err != nil {
+			log.Printf("ERROR: Redis delete board failed: %v", err)
 			break
 		}
+		usage.Boards--
+		usage.Bytes -= bytes
+		evicted = append(evicted, victim)
+	}
+	notifyEvicted(evicted)
+}
+
+// syncUsage 校正用量记录：移除已过期剪贴板的记录，为缺少记录的剪贴板（如旧版本创建的剪贴板）补充记录
+func (c *RedisCache) syncUsage(ctx context.Context) error {
+	// 先读取用量记录再扫描剪贴板，期间新建的剪贴板不会被误认为已过期
+	indexed, err := c.client.ZRange(ctx, c.keys.lru(), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	keys, err := c.GetAllKeys(ctx)
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool)
+	for _, key := range keys {
+		exists[key] = true
+	}
+
+	for _, key := range indexed {
+		if exists[key] {
+			delete(exists, key)
+			continue
+		}
+		n, err := c.client.Exists(ctx, c.keys.board(key)).Result()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		c.removeUsage(ctx, key)
+		c.changed(ctx, key)
+		notifyExpired(key)
+	}
+	for key := range exists {
+		s, ok, err := c.readBoardState(ctx, c.client, key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		_, err = c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZAddNX(ctx, c.keys.lru(), &redis.Z{Score: float64(time.Now().UnixMilli()), Member: key})
+			pipe.HSetNX(ctx, c.keys.bytes(), key, boardBytes(s.Data))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBoardState 读取剪贴板的变更序号、元数据和记录元数据，剪贴板不存在时返回空状态和 false
+func (c *RedisCache) readBoardState(ctx context.Context, rdb redis.Cmdable, key string) (*boardState, bool, error) {
+	s := &boardState{Data: make([]*Message, 0)}
+
+	var headCmd *redis.StringStringMapCmd
+	var idsCmd *redis.StringSliceCmd
+	_, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		headCmd = pipe.HGetAll(ctx, c.keys.board(key))
+		idsCmd = pipe.ZRevRange(ctx, c.keys.ids(key), 0, -1)
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	head := headCmd.Val()
+	if len(head) == 0 {
+		return s, false, nil
+	}
+	if s.Seq, err = strconv.ParseInt(head["seq"], 10, 64); err != nil {
+		return nil, false, fmt.Errorf("invalid seq of board %s: %w", key, err)
+	}
+	if val, found := head["meta"]; found {
+		s.Meta = &BoardMeta{}
+		if err = json.Unmarshal([]byte(val), s.Meta); err != nil {
+			return nil, false, err
+		}
+	}
+
+	ids := idsCmd.Val()
+	if len(ids) == 0 {
+		return s, true, nil
+	}
+	cmds := make([]*redis.StringStringMapCmd, 0, len(ids))
+	_, err = rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			cmds = append(cmds, pipe.HGetAll(ctx, c.keys.message(key, id)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	for _, cmd := range cmds {
+		if msg := parseMessage(cmd.Val()); msg != nil {
+			s.Data = append(s.Data, msg)
+		}
+	}
+	return s, true, nil
+}
+
+// writeBoardState 写回剪贴板的变更，只写入新增或变更过的记录，删除不再保留的记录，并刷新所有 key 的过期时间
+func (c *RedisCache) writeBoardState(ctx context.Context, pipe redis.Pipeliner, key string, before []*Message, s *boardState, ttl time.Duration) error {
+	head := c.keys.board(key)
+	pipe.HSet(ctx, head, "seq", s.Seq)
+	if s.Meta != nil {
+		meta, err := json.Marshal(s.Meta)
+		if err != nil {
+			return err
+		}
+		pipe.HSet(ctx, head, "meta", meta)
+	}
+
+	beforeSeq := make(map[string]int64, len(before))
+	for _, msg := range before {
+		beforeSeq[msg.Id] = msg.Seq
+	}
+	kept := make(map[string]bool, len(s.Data))
+	expireKeys := []string{head, c.keys.ids(key)}
+	for _, msg := range s.Data {
+		kept[msg.Id] = true
+		expireKeys = append(expireKeys, c.keys.message(key, msg.Id))
+		if msg.IsFile {
+			expireKeys = append(expireKeys, c.keys.blob(key, msg.Id))
+		}
+
+		seq, found := beforeSeq[msg.Id]
+		if !found {
+			pipe.ZAdd(ctx, c.keys.ids(key), &redis.Z{Score: float64(msg.Seq), Member: msg.Id})
+		}
+		if found && seq == msg.Seq {
+			continue
+		}
+		pipe.HSet(ctx, c.keys.message(key, msg.Id), messageFields(msg))
+		// 修改置顶状态等操作只读取了元数据，此时 Content 为空，保留原 blob
+		if msg.IsFile && msg.Content != "" {
+			pipe.Set(ctx, c.keys.blob(key, msg.Id), msg.Content, 0)
+		}
+	}
+	for _, msg := range before {
+		if !kept[msg.Id] {
+			pipe.ZRem(ctx, c.keys.ids(key), msg.Id)
+			pipe.Del(ctx, c.keys.message(key, msg.Id), c.keys.blob(key, msg.Id))
+		}
+	}
+
+	if ttl > 0 {
+		for _, k := range expireKeys {
+			pipe.PExpire(ctx, k, ttl)
+		}
+	}
+	return nil
+}
+
+// messageFields 将记录的元数据转换为 hash 字段，文件内容单独保存在 blob 中
+func messageFields(msg *Message) map[string]interface{} {
+	fields := map[string]interface{}{
+		"id":       msg.Id,
+		"time":     msg.Time,
+		"ip":       msg.Ip,
+		"isFile":   msg.IsFile,
+		"fileType": msg.FileType,
+		"fileName": msg.FileName,
+		"size":     MessageSize(msg),
+		"pinned":   msg.Pinned,
+		"seq":      msg.Seq,
+		"blobRef":  msg.BlobRef,
+	}
+	if !msg.IsFile {
+		fields["content"] = msg.Content
+	}
+	return fields
+}
+
+func parseMessage(fields map[string]string) *Message {
+	if len(fields) == 0 {
+		return nil
+	}
+	msg := &Message{
+		Id:       fields["id"],
+		Content:  fields["content"],
+		Time:     fields["time"],
+		Ip:       fields["ip"],
+		FileType: fields["fileType"],
+		FileName: fields["fileName"],
+		BlobRef:  fields["blobRef"],
+	}
+	msg.IsFile, _ = strconv.ParseBool(fields["isFile"])
+	msg.Pinned, _ = strconv.ParseBool(fields["pinned"])
+	msg.Size, _ = strconv.ParseInt(fields["size"], 10, 64)
+	msg.Seq, _ = strconv.ParseInt(fields["seq"], 10, 64)
+	return msg
+}
+
+// migrateLegacyBoards 将旧版本整个序列化为 JSON 的剪贴板迁移到新的结构，保留剩余的过期时间
+func (c *RedisCache) migrateLegacyBoards(ctx context.Context) {
+	legacy := make([]string, 0)
+	err := c.scan(ctx, escapeGlob(legacyPrefixBoard)+"*", func(k string) {
+		legacy = append(legacy, removeKeyPrefix(legacyPrefixBoard, k))
+	})
+	if err != nil {
+		log.Printf("ERROR: Redis SCAN failed: %v", err)
+	}
+	for _, key := range legacy {
+		if err = c.migrateLegacyBoard(ctx, key); err != nil {
+			log.Printf("ERROR: migrate legacy board %s failed: %v", key, err)
+		}
+	}
+}
+
+func (c *RedisCache) migrateLegacyBoard(ctx context.Context, key string) error {
+	legacyKey := keyPrefix(legacyPrefixBoard, key)
+	val, err := c.client.Get(ctx, legacyKey).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	ttl, err := c.client.PTTL(ctx, legacyKey).Result()
+	if err != nil {
+		return err
+	}
+	var data []*Message
+	if err = json.Unmarshal([]byte(val), &data); err != nil {
+		return err
 	}
 
-	removedPrefixKeys := make([]string, 0, len(keys))
-	for _, k := range keys {
-		removedPrefixKeys = append(removedPrefixKeys, removeKeyPrefix(prefixBoard, k))
+	err = c.update(ctx, key, true, func(s *boardState) (time.Duration, error) {
+		// 记录按时间倒序排列，从最旧的开始分配序号，序号同时作为排序依据
+		for i := len(data) - 1; i >= 0; i-- {
+			s.Seq++
+			data[i].Seq = s.Seq
+		}
+		s.Data = data
+		return ttl, nil
+	})
+	if err != nil {
+		return err
 	}
+	log.Printf("已迁移旧版本剪贴板：%s，记录数：%d", key, len(data))
+	return c.client.Del(ctx, legacyKey).Err()
+}
+
+// redisKeys 生成 Redis 中使用的 key，prefix 为所有 key 共同的前缀，多个部署共用一个 Redis 时用于隔离
+type redisKeys struct {
+	prefix string
+}
+
+func (k redisKeys) board(key string) string {
+	return k.prefix + prefixBoard + "{" + key + "}"
+}
+
+func (k redisKeys) ids(key string) string {
+	return k.board(key) + ":ids"
+}
+
+func (k redisKeys) message(key, id string) string {
+	return k.board(key) + ":msg:" + id
+}
+
+func (k redisKeys) blob(key, id string) string {
+	return k.board(key) + ":blob:" + id
+}
+
+func (k redisKeys) ip(ip string) string {
+	return k.prefix + prefixIp + ip
+}
+
+func (k redisKeys) peer(device string) string {
+	return k.prefix + prefixPeer + device
+}
+
+func (k redisKeys) lru() string {
+	return k.prefix + lruKey
+}
+
+func (k redisKeys) bytes() string {
+	return k.prefix + bytesKey
+}
+
+func (k redisKeys) invalidate() string {
+	return k.prefix + invalidateChannel
+}
+
+func (k redisKeys) events() string {
+	return k.prefix + eventsChannel
+}
 
-	return removedPrefixKeys
+// boardPattern 匹配所有剪贴板 head key 的 SCAN 模式，不包含记录和 blob
+func (k redisKeys) boardPattern() string {
+	return escapeGlob(k.prefix+prefixBoard) + "{*}"
 }
 
-func (c *RedisCache) Size() int {
-	keys := c.GetAllKeys()
-	return len(keys)
+// boardName 从剪贴板的 head key 中解析剪贴板名称，其他 key 返回 false
+func (k redisKeys) boardName(s string) (string, bool) {
+	head := k.prefix + prefixBoard + "{"
+	if !strings.HasPrefix(s, head) || !strings.HasSuffix(s, "}") {
+		return "", false
+	}
+	return s[len(head) : len(s)-1], true
 }
 
-func (c *RedisCache) Clean() {
-	return
+// escapeGlob 转义 SCAN 模式中的特殊字符
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
 }
 
 func keyPrefix(prefix, key string) string {
@@ -125,20 +841,34 @@ func removeKeyPrefix(prefix, key string) string {
 	return key[len(prefix):]
 }
 
-func (c *RedisCache) SetIp2BoardName(ip, boardName string, duration time.Duration) {
-	err := c.client.Set(context.Background(), keyPrefix(prefixIp, ip), boardName, duration).Err()
-	if err != nil {
-		log.Printf("ERROR: Redis SET failed: %v", err)
+func (c *RedisCache) SetIp2BoardName(ctx context.Context, ip, boardName string, duration time.Duration) error {
+	return c.client.Set(ctx, c.keys.ip(ip), boardName, duration).Err()
+}
+
+func (c *RedisCache) GetIp2BoardName(ctx context.Context, ip string) (string, bool, error) {
+	val, err := c.client.Get(ctx, c.keys.ip(ip)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
 	}
+	return val, true, nil
+}
+
+func (c *RedisCache) SetPeerRoom(ctx context.Context, device, room string, duration time.Duration) error {
+	return c.client.Set(ctx, c.keys.peer(device), room, duration).Err()
 }
 
-func (c *RedisCache) GetIp2BoardName(ip string) (string, bool) {
-	val, err := c.client.Get(context.Background(), keyPrefix(prefixIp, ip)).Result()
+func (c *RedisCache) GetPeerRoom(ctx context.Context, device string) (string, bool, error) {
+	val, err := c.client.Get(ctx, c.keys.peer(device)).Result()
 	if errors.Is(err, redis.Nil) {
-		return "", false
+		return "", false, nil
 	} else if err != nil {
-		log.Printf("ERROR: Redis GET failed: %v", err)
-		return "", false
+		return "", false, err
 	}
-	return val, true
+	return val, true, nil
+}
+
+func (c *RedisCache) DeletePeerRoom(ctx context.Context, device string) error {
+	return c.client.Del(ctx, c.keys.peer(device)).Err()
 }
@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// newRedisClient 根据配置创建单节点、Sentinel 或 Cluster 客户端，配置了 RedisURL 时以 URL 为准
+func newRedisClient(config Config) (redis.UniversalClient, error) {
+	if strings.ContainsAny(config.RedisKeyPrefix, "{}") {
+		// 前缀中的花括号会改变 Cluster 的 hash tag，导致同一剪贴板的 key 分散到不同节点
+		return nil, errors.New("redis key prefix must not contain '{' or '}'")
+	}
+	tlsConfig, err := redisTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.RedisURL != "" {
+		opt, err := redis.ParseURL(config.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+		if opt.TLSConfig != nil && tlsConfig == nil {
+			// rediss:// 且未配置证书时使用系统根证书
+			tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		opt.TLSConfig = nil
+		if tlsConfig != nil {
+			opt.Dialer = redisTLSDialer(tlsConfig)
+		}
+		return redis.NewClient(opt), nil
+	}
+
+	opt := &redis.UniversalOptions{
+		Username:         config.RedisUsername,
+		Password:         config.RedisPassword,
+		DB:               config.RedisDB,
+		MasterName:       config.RedisSentinelMaster,
+		SentinelUsername: config.RedisSentinelUsername,
+		SentinelPassword: config.RedisSentinelPassword,
+	}
+	if tlsConfig != nil {
+		opt.Dialer = redisTLSDialer(tlsConfig)
+	}
+
+	switch {
+	case len(config.RedisClusterAddrs) > 0 && config.RedisSentinelMaster != "":
+		return nil, errors.New("redis cluster and sentinel can not be used together")
+	case len(config.RedisClusterAddrs) > 0:
+		if config.RedisDB != 0 {
+			return nil, errors.New("redis cluster only supports db 0")
+		}
+		opt.Addrs = config.RedisClusterAddrs
+		return redis.NewClusterClient(opt.Cluster()), nil
+	case config.RedisSentinelMaster != "":
+		if len(config.RedisSentinelAddrs) == 0 {
+			return nil, errors.New("redis sentinel addresses are required")
+		}
+		opt.Addrs = config.RedisSentinelAddrs
+		return redis.NewFailoverClient(opt.Failover()), nil
+	default:
+		opt.Addrs = []string{config.RedisAddr}
+		return redis.NewClient(opt.Simple()), nil
+	}
+}
+
+// redisTLSConfig 未开启 TLS 且未配置证书时返回 nil
+func redisTLSConfig(config Config) (*tls.Config, error) {
+	if !config.RedisTLS && config.RedisTLSCA == "" && config.RedisTLSCert == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.RedisTLSCA != "" {
+		pem, err := os.ReadFile(config.RedisTLSCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", config.RedisTLSCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.RedisTLSCert != "" || config.RedisTLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.RedisTLSCert, config.RedisTLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// redisTLSDialer 按实际连接的地址设置 ServerName，Sentinel 和 Cluster 会连接多个不同的节点
+func redisTLSDialer(tlsConfig *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		config := tlsConfig.Clone()
+		if config.ServerName == "" {
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				config.ServerName = host
+			}
+		}
+		dialer := &tls.Dialer{
+			NetDialer: &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 5 * time.Minute},
+			Config:    config,
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
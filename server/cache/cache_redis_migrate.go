@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"log"
+)
+
+// MigrateRedisKeys 将前缀为 from 的剪贴板、IP 对应关系和设备配对关系重命名到 config.RedisKeyPrefix 下，返回迁移的剪贴板数量。
+// 迁移期间使用旧前缀的实例应当停止，目标前缀下已存在同名剪贴板时跳过该剪贴板。
+// from 为空时不迁移 ip: 和 peer: 开头的 key，无法区分它们是否属于其他应用
+func MigrateRedisKeys(config Config, from string) (int, error) {
+	if from == config.RedisKeyPrefix {
+		return 0, errors.New("source and target prefix are the same")
+	}
+	client, err := newRedisClient(config)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	if err = client.Ping(ctx).Err(); err != nil {
+		return 0, err
+	}
+
+	source := &RedisCache{client: client, keys: redisKeys{prefix: from}}
+	target := &RedisCache{client: client, keys: redisKeys{prefix: config.RedisKeyPrefix}}
+	if from == "" {
+		// 旧版本的 key 先迁移到新的结构
+		source.migrateLegacyBoards(ctx)
+	}
+
+	boards, err := source.GetAllKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for _, key := range boards {
+		ok, err := migrateRedisBoard(ctx, source, target, key)
+		if err != nil {
+			return migrated, fmt.Errorf("migrate board %s: %w", key, err)
+		}
+		if ok {
+			migrated++
+		}
+	}
+
+	if from != "" {
+		for _, prefix := range []string{prefixIp, prefixPeer} {
+			keys := make([]string, 0)
+			err = source.scan(ctx, escapeGlob(from+prefix)+"*", func(k string) {
+				keys = append(keys, k)
+			})
+			if err != nil {
+				return migrated, err
+			}
+			for _, k := range keys {
+				if err = moveStringKey(ctx, client, k, config.RedisKeyPrefix+removeKeyPrefix(from, k)); err != nil {
+					return migrated, fmt.Errorf("migrate %s: %w", k, err)
+				}
+			}
+			log.Printf("已迁移 %s 对应关系：%d", prefix, len(keys))
+		}
+	}
+
+	// 用量记录按目标前缀重新生成
+	if err = client.Del(ctx, source.keys.lru()).Err(); err != nil {
+		return migrated, err
+	}
+	if err = client.Del(ctx, source.keys.bytes()).Err(); err != nil {
+		return migrated, err
+	}
+	return migrated, target.syncUsage(ctx)
+}
+
+// migrateRedisBoard 在一个事务中重命名剪贴板的所有 key，新旧 key 的 hash tag 相同，集群模式下位于同一个 slot
+func migrateRedisBoard(ctx context.Context, source, target *RedisCache, key string) (bool, error) {
+	exists, err := target.client.Exists(ctx, target.keys.board(key)).Result()
+	if err != nil {
+		return false, err
+	}
+	if exists > 0 {
+		log.Printf("WARN: board %s already exists in the target prefix, skipped", key)
+		return false, nil
+	}
+
+	ids, err := source.client.ZRange(ctx, source.keys.ids(key), 0, -1).Result()
+	if err != nil {
+		return false, err
+	}
+	renames := map[string]string{
+		source.keys.board(key): target.keys.board(key),
+		source.keys.ids(key):   target.keys.ids(key),
+	}
+	for _, id := range ids {
+		renames[source.keys.message(key, id)] = target.keys.message(key, id)
+		renames[source.keys.blob(key, id)] = target.keys.blob(key, id)
+	}
+
+	// 文本记录没有 blob，空剪贴板没有 ids，只重命名存在的 key
+	existing := make(map[string]*redis.IntCmd, len(renames))
+	_, err = source.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for from := range renames {
+			existing[from] = pipe.Exists(ctx, from)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	_, err = source.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for from, to := range renames {
+			if existing[from].Val() > 0 {
+				pipe.Rename(ctx, from, to)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// moveStringKey 移动 IP 对应关系或设备配对关系并保留过期时间，新旧 key 在集群模式下可能位于不同的 slot，不能使用 RENAME
+func moveStringKey(ctx context.Context, client redis.UniversalClient, from, to string) error {
+	val, err := client.Get(ctx, from).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	ttl, err := client.PTTL(ctx, from).Result()
+	if err != nil {
+		return err
+	}
+	if ttl == -2 { // -2 means the key does not exist
+		return nil
+	}
+	if ttl < 0 { // -1 means the key has no expiration
+		ttl = 0
+	}
+	if err = client.Set(ctx, to, val, ttl).Err(); err != nil {
+		return err
+	}
+	return client.Del(ctx, from).Err()
+}
@@ -0,0 +1,188 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRedisUpdateRetriesOnConflict 另一个实例在读取与写回之间修改了剪贴板时 EXEC 失败，重新执行后两次修改都保留
+func TestRedisUpdateRetriesOnConflict(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestRedis(t)
+	c := NewRedisCache(client, "")
+	other := NewRedisCache(client, "")
+	mustCreate(t, c, "board")
+
+	calls := 0
+	err := c.update(ctx, "board", false, func(s *boardState) (time.Duration, error) {
+		calls++
+		if calls == 1 {
+			mustAppend(t, other, "board", textMessage("other"), testRetention(10))
+		}
+		s.appendMessage(textMessage("mine"), testRetention(10))
+		return time.Hour, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("update ran %d times, want a retry after the conflict", calls)
+	}
+	msgs := mustList(t, c, "board")
+	if len(msgs) != 2 || msgs[0].Content != "mine" || msgs[0].Seq != 2 || msgs[1].Content != "other" || msgs[1].Seq != 1 {
+		t.Fatalf("messages after retry: %+v %+v", msgs[0], msgs[len(msgs)-1])
+	}
+}
+
+// TestRedisConcurrentAppends 多个实例并发追加时序号不重复，用量记录与实际内容一致
+func TestRedisConcurrentAppends(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestRedis(t)
+	instances := []*RedisCache{NewRedisCache(client, ""), NewRedisCache(client, ""), NewRedisCache(client, "")}
+	mustCreate(t, instances[0], "board")
+
+	const perInstance = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, len(instances)*perInstance)
+	for i, c := range instances {
+		wg.Add(1)
+		go func(i int, c *RedisCache) {
+			defer wg.Done()
+			for j := 0; j < perInstance; j++ {
+				content := fmt.Sprintf("instance %d message %d", i, j)
+				if _, err := c.AppendMessage(ctx, "board", textMessage(content), testRetention(100)); err != nil {
+					errs <- err
+				}
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	msgs, _, err := instances[0].Get(ctx, "board")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := len(instances) * perInstance
+	seqs := make(map[int64]bool)
+	for _, msg := range msgs {
+		seqs[msg.Seq] = true
+	}
+	if len(msgs) != total || len(seqs) != total {
+		t.Fatalf("%d messages with %d distinct seqs, want %d", len(msgs), len(seqs), total)
+	}
+	seq, err := client.HGet(ctx, instances[0].keys.board("board"), "seq").Int64()
+	if err != nil || seq != int64(total) {
+		t.Fatalf("head seq = %d, %v, want %d", seq, err, total)
+	}
+	usage, err := instances[1].Size(ctx)
+	if err != nil || usage.Boards != 1 || usage.Bytes != boardBytes(msgs) {
+		t.Fatalf("usage = %+v, %v, want 1 board with %d bytes", usage, err, boardBytes(msgs))
+	}
+}
+
+// TestMigrateRedisKeys 迁移前缀时保留所有 key 的过期时间，目标前缀下已存在的剪贴板跳过且不被覆盖
+func TestMigrateRedisKeys(t *testing.T) {
+	ctx := context.Background()
+	mr, client := newTestRedis(t)
+	source := NewRedisCache(client, "old:")
+	target := NewRedisCache(client, "new:")
+
+	mustCreate(t, source, "moved")
+	mustAppend(t, source, "moved", textMessage("hello"), testRetention(10))
+	mustAppend(t, source, "moved", &Message{Content: "ZmlsZQ==", IsFile: true, FileName: "a.txt", Size: 4}, testRetention(10))
+	mustCreate(t, source, "kept")
+	mustAppend(t, source, "kept", textMessage("source"), testRetention(10))
+	mustCreate(t, target, "kept")
+	mustAppend(t, target, "kept", textMessage("target"), testRetention(10))
+	if err := source.SetIp2BoardName(ctx, "1.2.3.4", "moved", 30*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.SetPeerRoom(ctx, "device", "room", 48*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := client.ZRange(ctx, source.keys.ids("moved"), 0, -1).Result()
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("source ids = %v, %v", ids, err)
+	}
+	ttls := map[string]time.Duration{
+		target.keys.board("moved"):           mr.TTL(source.keys.board("moved")),
+		target.keys.ids("moved"):             mr.TTL(source.keys.ids("moved")),
+		target.keys.message("moved", ids[0]): mr.TTL(source.keys.message("moved", ids[0])),
+		target.keys.message("moved", ids[1]): mr.TTL(source.keys.message("moved", ids[1])),
+		target.keys.blob("moved", ids[1]):    mr.TTL(source.keys.blob("moved", ids[1])),
+		target.keys.ip("1.2.3.4"):            30 * time.Minute,
+		target.keys.peer("device"):           48 * time.Hour,
+	}
+
+	migrated, err := MigrateRedisKeys(Config{RedisAddr: mr.Addr(), RedisKeyPrefix: "new:"}, "old:")
+	if err != nil || migrated != 1 {
+		t.Fatalf("MigrateRedisKeys = %d, %v, want 1 board", migrated, err)
+	}
+	for key, want := range ttls {
+		if !mr.Exists(key) {
+			t.Errorf("%s was not migrated", key)
+		} else if got := mr.TTL(key); got != want || got <= 0 {
+			t.Errorf("TTL of %s = %v, want %v", key, got, want)
+		}
+	}
+
+	msgs := mustList(t, target, "moved")
+	if len(msgs) != 2 || msgs[1].Content != "hello" {
+		t.Fatalf("migrated messages: %+v", msgs)
+	}
+	if kept := mustList(t, target, "kept"); len(kept) != 1 || kept[0].Content != "target" {
+		t.Fatalf("existing board in the target was overwritten: %+v", kept)
+	}
+	if kept := mustList(t, source, "kept"); len(kept) != 1 || kept[0].Content != "source" {
+		t.Fatalf("skipped board was removed from the source: %+v", kept)
+	}
+	if board, ok, err := target.GetIp2BoardName(ctx, "1.2.3.4"); err != nil || !ok || board != "moved" {
+		t.Fatalf("migrated ip mapping = %q, %v, %v", board, ok, err)
+	}
+	usage, err := target.Size(ctx)
+	if err != nil || usage.Boards != 2 {
+		t.Fatalf("target usage = %+v, %v, want 2 boards", usage, err)
+	}
+}
+
+// TestMigrateLegacyBoard 旧版本的 JSON 剪贴板迁移后保留剩余的过期时间，序号按时间顺序分配
+func TestMigrateLegacyBoard(t *testing.T) {
+	mr, client := newTestRedis(t)
+	// 旧版本以创建时的纳秒时间戳作为记录 ID
+	newer, older := textMessage("newer"), textMessage("older")
+	newer.Id, older.Id = "1700000000000000002", "1700000000000000001"
+	data, err := json.Marshal([]*Message{newer, older})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyKey := keyPrefix(legacyPrefixBoard, "legacy")
+	if err = mr.Set(legacyKey, string(data)); err != nil {
+		t.Fatal(err)
+	}
+	mr.SetTTL(legacyKey, 90*time.Minute)
+
+	c := NewRedisCache(client, "")
+	if mr.Exists(legacyKey) {
+		t.Fatal("legacy key was not removed")
+	}
+	if ttl := mr.TTL(c.keys.board("legacy")); ttl != 90*time.Minute {
+		t.Fatalf("TTL after migration = %v, want 1h30m", ttl)
+	}
+	msgs := mustList(t, c, "legacy")
+	if len(msgs) != 2 || msgs[0].Content != "newer" || msgs[0].Seq != 2 || msgs[1].Seq != 1 {
+		t.Fatalf("migrated messages: %+v %+v", msgs[0], msgs[len(msgs)-1])
+	}
+	if n, _ := strconv.Atoi(mr.HGet(c.keys.board("legacy"), "seq")); n != 2 {
+		t.Fatalf("head seq = %d, want 2", n)
+	}
+}
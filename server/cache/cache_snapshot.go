@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const snapshotVersion = 1
+
+// memorySnapshot 内存缓存的快照，以 gzip 压缩的 JSON 保存，过期时间为绝对时间，恢复后继续生效
+type memorySnapshot struct {
+	Version    int                        `json:"version"`
+	SavedAt    int64                      `json:"savedAt"`
+	Boards     map[string]cachedItem      `json:"boards"`
+	BoardNames map[string]cachedBoardName `json:"boardNames"`
+	PeerRooms  map[string]cachedPeerRoom  `json:"peerRooms"`
+}
+
+// SaveSnapshot 将内存中的剪贴板、IP 与剪贴板的对应关系以及设备配对关系写入快照文件
+func (c *InMemoryCache) SaveSnapshot() error {
+	if c.snapshotPath == "" {
+		return nil
+	}
+
+	// 记录是写时复制的，锁内只复制 map，编码和写文件在锁外进行
+	now := time.Now().UnixNano()
+	snapshot := memorySnapshot{
+		Version:    snapshotVersion,
+		SavedAt:    now,
+		Boards:     make(map[string]cachedItem),
+		BoardNames: make(map[string]cachedBoardName),
+		PeerRooms:  make(map[string]cachedPeerRoom),
+	}
+	c.lock.Lock()
+	for k, v := range c.cache {
+		if v.Expiration >= now {
+			snapshot.Boards[k] = v
+		}
+	}
+	for k, v := range c.cacheBoardName {
+		if v.Expiration >= now {
+			snapshot.BoardNames[k] = v
+		}
+	}
+	for k, v := range c.cachePeerRoom {
+		if v.Expiration >= now {
+			snapshot.PeerRooms[k] = v
+		}
+	}
+	c.lock.Unlock()
+
+	// 先写临时文件再重命名，进程中途退出时不会破坏上一次的快照
+	dir := filepath.Dir(c.snapshotPath)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(c.snapshotPath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	zw := gzip.NewWriter(tmp)
+	err = json.NewEncoder(zw).Encode(&snapshot)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.snapshotPath)
+}
+
+// loadSnapshot 从快照文件恢复，文件不存在时不做任何操作，已过期的内容会被丢弃
+func (c *InMemoryCache) loadSnapshot() error {
+	f, err := os.Open(c.snapshotPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	var snapshot memorySnapshot
+	if err = json.NewDecoder(zr).Decode(&snapshot); err != nil {
+		return err
+	}
+	if snapshot.Version != snapshotVersion {
+		return errors.New("unsupported snapshot version")
+	}
+
+	now := time.Now().UnixNano()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for k, v := range snapshot.Boards {
+		if v.Expiration >= now {
+			// 旧版本的快照没有用量信息，恢复时重新计算
+			v.Bytes = boardBytes(v.Data)
+			if v.AccessedAt == 0 {
+				v.AccessedAt = snapshot.SavedAt
+			}
+			c.cache[k] = v
+		}
+	}
+	for k, v := range snapshot.BoardNames {
+		if v.Expiration >= now {
+			c.cacheBoardName[k] = v
+		}
+	}
+	for k, v := range snapshot.PeerRooms {
+		if v.Expiration >= now {
+			c.cachePeerRoom[k] = v
+		}
+	}
+	log.Printf("从快照恢复内存缓存完成，剪贴板数：%v，保存时间：%v",
+		len(c.cache), time.Unix(0, snapshot.SavedAt).Format("2006-01-02 15:04:05"))
+	return nil
+}
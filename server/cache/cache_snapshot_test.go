@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestSnapshotRoundTrip 快照恢复后剪贴板的记录、置顶状态、墓碑、BlobStore 引用、过期时间以及 IP 和配对关系都保持不变
+func TestSnapshotRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "snapshot", "cache.json.gz")
+	c := NewInMemoryCache(path)
+	r := testRetention(10)
+
+	mustCreate(t, c, "board")
+	mustAppend(t, c, "board", textMessage("removed"), r)
+	mustAppend(t, c, "board", textMessage("pinned"), r)
+	mustAppend(t, c, "board", &Message{IsFile: true, FileName: "a.bin", Size: 1 << 20, BlobRef: "0123456789abcdef"}, r)
+	msgs := mustList(t, c, "board")
+	if _, err := c.RemoveMessage(ctx, "board", msgs[2].Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.SetPinned(ctx, "board", msgs[1].Id, true, r); err != nil {
+		t.Fatal(err)
+	}
+	short := testRetention(10)
+	short.TTL = 300 * time.Millisecond
+	mustCreate(t, c, "short")
+	mustAppend(t, c, "short", textMessage("expires after saving"), short)
+	if err := c.SetIp2BoardName(ctx, "1.2.3.4", "board", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetPeerRoom(ctx, "device", "room", 48*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.SaveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	restored := NewInMemoryCache(path)
+
+	want, got := c.cache["board"], restored.cache["board"]
+	if !reflect.DeepEqual(got.Data, want.Data) {
+		t.Fatalf("messages after restore: %+v, want %+v", got.Data, want.Data)
+	}
+	if !reflect.DeepEqual(got.Meta, want.Meta) || len(got.Meta.Tombstones) != 1 || got.Meta.Tombstones[0].Id != msgs[2].Id {
+		t.Fatalf("meta after restore: %+v, want %+v", got.Meta, want.Meta)
+	}
+	if got.Seq != want.Seq || got.Expiration != want.Expiration || got.Bytes != want.Bytes {
+		t.Fatalf("restored seq=%d expiration=%d bytes=%d, want %d %d %d", got.Seq, got.Expiration, got.Bytes, want.Seq, want.Expiration, want.Bytes)
+	}
+	// 置顶记录将过期时间延长到 PinnedTTL
+	if remaining := time.Until(time.Unix(0, got.Expiration)); remaining < r.PinnedTTL-time.Minute {
+		t.Fatalf("restored board expires in %v, want about %v", remaining, r.PinnedTTL)
+	}
+	if !got.Data[1].Pinned || got.Data[0].Pinned {
+		t.Fatalf("pinned flags after restore: %v %v", got.Data[0].Pinned, got.Data[1].Pinned)
+	}
+	refs, err := restored.ListBlobRefs(ctx, "board")
+	if err != nil || !reflect.DeepEqual(refs, []string{"0123456789abcdef"}) {
+		t.Fatalf("blob refs after restore = %v, %v", refs, err)
+	}
+
+	if _, ok := restored.cache["short"]; ok {
+		t.Fatal("board that expired after the snapshot was restored")
+	}
+	if board, ok, err := restored.GetIp2BoardName(ctx, "1.2.3.4"); err != nil || !ok || board != "board" {
+		t.Fatalf("ip mapping after restore = %q, %v, %v", board, ok, err)
+	}
+	if room, ok, err := restored.GetPeerRoom(ctx, "device"); err != nil || !ok || room != "room" {
+		t.Fatalf("peer room after restore = %q, %v, %v", room, ok, err)
+	}
+
+	// 变更序号在恢复后继续递增，不会与恢复前的记录 ID 重复
+	mustAppend(t, restored, "board", textMessage("after restore"), r)
+	if newest := mustList(t, restored, "board")[0]; newest.Seq != want.Seq+1 {
+		t.Fatalf("seq after restore = %d, want %d", newest.Seq, want.Seq+1)
+	}
+}
@@ -0,0 +1,699 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	_ "modernc.org/sqlite"
+	"time"
+)
+
+// sqliteSchema 剪贴板、记录以及 IP 与剪贴板的对应关系分别保存在三张表中，过期时间为 UnixNano，
+// 文件记录的内容解码后保存在 body 列，列表查询不读取该列
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS boards (
+		name        TEXT PRIMARY KEY,
+		seq         INTEGER NOT NULL DEFAULT 0,
+		meta        TEXT,
+		expire_at   INTEGER NOT NULL,
+		bytes       INTEGER NOT NULL DEFAULT 0,
+		accessed_at INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS messages (
+		board     TEXT NOT NULL,
+		id        TEXT NOT NULL,
+		ord       INTEGER NOT NULL,
+		seq       INTEGER NOT NULL,
+		time      TEXT NOT NULL,
+		ip        TEXT NOT NULL,
+		is_file   INTEGER NOT NULL,
+		file_type TEXT NOT NULL,
+		file_name TEXT NOT NULL,
+		size      INTEGER NOT NULL,
+		pinned    INTEGER NOT NULL,
+		content   TEXT NOT NULL,
+		body      BLOB,
+		blob_ref  TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (board, id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_boards_expire_at ON boards (expire_at)`,
+	`CREATE TABLE IF NOT EXISTS ip_boards (
+		ip        TEXT PRIMARY KEY,
+		board     TEXT NOT NULL,
+		expire_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS peer_rooms (
+		peer      TEXT PRIMARY KEY,
+		room      TEXT NOT NULL,
+		expire_at INTEGER NOT NULL
+	)`,
+}
+
+const sqliteMessageColumns = "id, seq, time, ip, is_file, file_type, file_name, size, pinned, content, blob_ref"
+
+// sqliteColumns 旧版本数据库缺少的列，启动时补充
+var sqliteColumns = []struct {
+	table, column, definition string
+}{
+	{"messages", "blob_ref", "TEXT NOT NULL DEFAULT ''"},
+	{"boards", "bytes", "INTEGER NOT NULL DEFAULT 0"},
+	{"boards", "accessed_at", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// sqliteBackfillBytes 为旧版本创建的剪贴板补充占用的字节数，文件内容按 base64 编码后的长度计算，与 storedBytes 一致
+const sqliteBackfillBytes = `UPDATE boards SET bytes = (
+	SELECT COALESCE(SUM(length(id) + length(time) + length(ip) + length(file_type) + length(file_name) +
+		length(content) + length(blob_ref) + (COALESCE(length(body), 0) + 2) / 3 * 4), 0)
+	FROM messages WHERE board = boards.name
+) WHERE bytes = 0`
+
+// sqlExecutor *sql.DB 与 *sql.Tx 的公共方法
+type sqlExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// rowScanner *sql.Row 与 *sql.Rows 的公共方法
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+type SQLiteCache struct {
+	db *sql.DB
+}
+
+func NewSQLiteCache(path string) *SQLiteCache {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		log.Fatalf("ERROR: SQLite open failed: %v", err)
+		return nil
+	}
+	// SQLite 同一时间只允许一个写入者，使用单个连接避免 SQLITE_BUSY，
+	// 因此在遍历查询结果或事务进行中不能再通过 db 发起其他查询
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range sqliteSchema {
+		if _, err = db.Exec(stmt); err != nil {
+			log.Fatalf("ERROR: SQLite init schema failed: %v", err)
+			return nil
+		}
+	}
+	for _, col := range sqliteColumns {
+		if err = ensureSQLiteColumn(db, col.table, col.column, col.definition); err != nil {
+			log.Fatalf("ERROR: SQLite migrate schema failed: %v", err)
+			return nil
+		}
+	}
+	// 列补充完成后才能创建依赖这些列的索引
+	if _, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_boards_accessed_at ON boards (accessed_at)`); err != nil {
+		log.Fatalf("ERROR: SQLite init schema failed: %v", err)
+		return nil
+	}
+	if _, err = db.Exec(sqliteBackfillBytes); err != nil {
+		log.Fatalf("ERROR: SQLite migrate schema failed: %v", err)
+		return nil
+	}
+
+	return &SQLiteCache{db: db}
+}
+
+func (c *SQLiteCache) Get(ctx context.Context, key string) ([]*Message, bool, error) {
+	return c.list(ctx, key, true)
+}
+
+// List 不读取文件记录的内容
+func (c *SQLiteCache) List(ctx context.Context, key string) ([]*Message, bool, error) {
+	return c.list(ctx, key, false)
+}
+
+func (c *SQLiteCache) list(ctx context.Context, key string, withBody bool) ([]*Message, bool, error) {
+	if _, ok, err := c.expireAt(ctx, key); err != nil || !ok {
+		return nil, false, err
+	}
+	msgs, err := listMessages(ctx, c.db, key, withBody)
+	if err != nil {
+		return nil, false, err
+	}
+	c.touch(ctx, key)
+	return msgs, true, nil
+}
+
+func (c *SQLiteCache) ListBlobRefs(ctx context.Context, key string) ([]string, error) {
+	rows, err := c.db.QueryContext(ctx, `SELECT m.blob_ref FROM messages m JOIN boards b ON b.name = m.board
+		WHERE m.board = ? AND m.blob_ref != '' AND b.expire_at >= ?`, key, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var refs []string
+	for rows.Next() {
+		var ref string
+		if err := rows.Scan(&ref); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
+
+func (c *SQLiteCache) GetMessage(ctx context.Context, key, id string) (*Message, bool, error) {
+	if _, ok, err := c.expireAt(ctx, key); err != nil || !ok {
+		return nil, false, err
+	}
+
+	var body []byte
+	row := c.db.QueryRowContext(ctx, `SELECT `+sqliteMessageColumns+`, body FROM messages WHERE board = ? AND id = ?`, key, id)
+	msg, err := scanMessage(row, &body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	if msg.IsFile && msg.BlobRef == "" {
+		msg.Content = base64.StdEncoding.EncodeToString(body)
+	}
+	c.touch(ctx, key)
+	return msg, true, nil
+}
+
+func (c *SQLiteCache) GetExpireAt(ctx context.Context, key string) (string, error) {
+	expireAt, ok, err := c.expireAt(ctx, key)
+	if err != nil || !ok {
+		return "", err
+	}
+	return time.Unix(0, expireAt).Format("2006-01-02 15:04:05"), nil
+}
+
+// touch 刷新剪贴板的访问时间，失败时只影响淘汰顺序，不中断读取
+func (c *SQLiteCache) touch(ctx context.Context, key string) {
+	if _, err := c.db.ExecContext(ctx, `UPDATE boards SET accessed_at = ? WHERE name = ?`, time.Now().UnixNano(), key); err != nil {
+		log.Printf("ERROR: SQLite update accessed_at failed: %v", err)
+	}
+}
+
+// expireAt 获取未过期剪贴板的过期时间
+func (c *SQLiteCache) expireAt(ctx context.Context, key string) (int64, bool, error) {
+	var expireAt int64
+	err := c.db.QueryRowContext(ctx, `SELECT expire_at FROM boards WHERE name = ? AND expire_at >= ?`, key, time.Now().UnixNano()).Scan(&expireAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return expireAt, true, nil
+}
+
+// Set 覆盖剪贴板的记录列表，剪贴板不存在时创建，保留未过期剪贴板的元数据和变更序号
+func (c *SQLiteCache) Set(ctx context.Context, key string, data []*Message, duration time.Duration) error {
+	return c.update(ctx, key, true, func(s *boardState) (time.Duration, error) {
+		s.Data = data
+		return duration, nil
+	})
+}
+
+func (c *SQLiteCache) Delete(ctx context.Context, key string) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = deleteBoards(ctx, tx, []string{key}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c *SQLiteCache) GetMeta(ctx context.Context, key string) (*BoardMeta, bool, error) {
+	var val sql.NullString
+	err := c.db.QueryRowContext(ctx, `SELECT meta FROM boards WHERE name = ? AND expire_at >= ?`, key, time.Now().UnixNano()).Scan(&val)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !val.Valid) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	var meta BoardMeta
+	if err = json.Unmarshal([]byte(val.String), &meta); err != nil {
+		return nil, false, fmt.Errorf("invalid meta of board %s: %w", key, err)
+	}
+	c.touch(ctx, key)
+	return &meta, true, nil
+}
+
+func (c *SQLiteCache) CreateBoard(ctx context.Context, key string, meta *BoardMeta, duration time.Duration) (bool, error) {
+	val, err := json.Marshal(withEpoch(meta))
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// 已过期但尚未清理的剪贴板先删除，连同其记录
+	now := time.Now().UnixNano()
+	var expired int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM boards WHERE name = ? AND expire_at < ?`, key, now).Scan(&expired)
+	if err != nil {
+		return false, err
+	}
+	if expired > 0 {
+		if err = deleteBoards(ctx, tx, []string{key}); err != nil {
+			return false, err
+		}
+	}
+	res, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO boards (name, seq, meta, expire_at, bytes, accessed_at) VALUES (?, 0, ?, ?, 0, ?)`,
+		key, string(val), now+int64(duration), now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+
+	if expired > 0 {
+		go notifyExpired(key)
+	}
+	if n == 0 {
+		return false, nil
+	}
+	c.evict(ctx, key)
+	return true, nil
+}
+
+func (c *SQLiteCache) GetAllKeys(ctx context.Context) ([]string, error) {
+	rows, err := c.db.QueryContext(ctx, `SELECT name FROM boards WHERE expire_at >= ?`, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		keys = append(keys, name)
+	}
+	return keys, rows.Err()
+}
+
+func (c *SQLiteCache) Size(ctx context.Context) (Usage, error) {
+	return sqliteUsage(ctx, c.db)
+}
+
+func sqliteUsage(ctx context.Context, q sqlExecutor) (Usage, error) {
+	var usage Usage
+	err := q.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(bytes), 0) FROM boards WHERE expire_at >= ?`, time.Now().UnixNano()).
+		Scan(&usage.Boards, &usage.Bytes)
+	return usage, err
+}
+
+// evict 超出容量上限时淘汰最久未访问的剪贴板，正在写入的剪贴板 except 不会被淘汰
+func (c *SQLiteCache) evict(ctx context.Context, except string) {
+	if !budget.enabled() {
+		return
+	}
+	evicted, err := c.evictBoards(ctx, except)
+	if err != nil {
+		log.Printf("ERROR: SQLite evict boards failed: %v", err)
+		return
+	}
+	notifyEvicted(evicted)
+}
+
+func (c *SQLiteCache) evictBoards(ctx context.Context, except string) ([]string, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	usage, err := sqliteUsage(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	evicted := make([]string, 0)
+	for budget.exceeded(usage) {
+		var victim string
+		var bytes int64
+		err = tx.QueryRowContext(ctx, `SELECT name, bytes FROM boards WHERE name != ? AND expire_at >= ? ORDER BY accessed_at LIMIT 1`,
+			except, time.Now().UnixNano()).Scan(&victim, &bytes)
+		if errors.Is(err, sql.ErrNoRows) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if err = deleteBoards(ctx, tx, []string{victim}); err != nil {
+			return nil, err
+		}
+		usage.Boards--
+		usage.Bytes -= bytes
+		evicted = append(evicted, victim)
+	}
+	return evicted, tx.Commit()
+}
+
+func (c *SQLiteCache) Close() error {
+	return c.db.Close()
+}
+
+// Clean 删除过期的剪贴板、记录以及 IP 对应关系
+func (c *SQLiteCache) Clean(ctx context.Context) error {
+	expired, err := c.clean(ctx)
+	if err != nil {
+		return err
+	}
+	for _, k := range expired {
+		notifyExpired(k)
+	}
+	return nil
+}
+
+func (c *SQLiteCache) clean(ctx context.Context) ([]string, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UnixNano()
+	rows, err := tx.QueryContext(ctx, `SELECT name FROM boards WHERE expire_at < ?`, now)
+	if err != nil {
+		return nil, err
+	}
+	expired := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		expired = append(expired, name)
+	}
+	rows.Close()
+
+	if err = deleteBoards(ctx, tx, expired); err != nil {
+		return nil, err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM ip_boards WHERE expire_at < ?`, now); err != nil {
+		return nil, err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM peer_rooms WHERE expire_at < ?`, now); err != nil {
+		return nil, err
+	}
+	return expired, tx.Commit()
+}
+
+func (c *SQLiteCache) UpdateMeta(ctx context.Context, key string, fn func(meta *BoardMeta) error) error {
+	return c.update(ctx, key, false, func(s *boardState) (time.Duration, error) {
+		return 0, s.updateMeta(fn)
+	})
+}
+
+func (c *SQLiteCache) AppendMessage(ctx context.Context, key string, msg *Message, max Retention) ([]*Message, error) {
+	var evicted []*Message
+	err := c.update(ctx, key, false, func(s *boardState) (time.Duration, error) {
+		evicted = s.appendMessage(msg, max)
+		return max.ttl(s.Data), nil
+	})
+	return evicted, err
+}
+
+func (c *SQLiteCache) RemoveMessage(ctx context.Context, key, id string) (*Message, error) {
+	var removed *Message
+	err := c.update(ctx, key, false, func(s *boardState) (time.Duration, error) {
+		var err error
+		removed, err = s.removeMessage(id)
+		return 0, err
+	})
+	return removed, err
+}
+
+func (c *SQLiteCache) SetPinned(ctx context.Context, key, id string, pinned bool, max Retention) (*Message, []*Message, error) {
+	var updated *Message
+	var evicted []*Message
+	err := c.update(ctx, key, false, func(s *boardState) (time.Duration, error) {
+		var err error
+		updated, evicted, err = s.setPinned(id, pinned, max)
+		return max.ttl(s.Data), err
+	})
+	return updated, evicted, err
+}
+
+// update 在事务中读取、修改并写回剪贴板，fn 返回新的过期时间，返回 0 时保持原过期时间，返回错误时不写回；
+// create 为 true 时剪贴板不存在则创建，已过期但尚未清理的剪贴板视为不存在
+func (c *SQLiteCache) update(ctx context.Context, key string, create bool, fn func(s *boardState) (time.Duration, error)) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UnixNano()
+	s := &boardState{Data: make([]*Message, 0)}
+	var meta sql.NullString
+	var expireAt int64
+	var expired bool
+	err = tx.QueryRowContext(ctx, `SELECT seq, meta, expire_at FROM boards WHERE name = ?`, key).Scan(&s.Seq, &meta, &expireAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if !create {
+			return ErrBoardNotFound
+		}
+	case err != nil:
+		return err
+	case expireAt < now:
+		if !create {
+			return ErrBoardNotFound
+		}
+		if err = deleteBoards(ctx, tx, []string{key}); err != nil {
+			return err
+		}
+		s.Seq = 0
+		expired = true
+	default:
+		if meta.Valid {
+			s.Meta = &BoardMeta{}
+			if err = json.Unmarshal([]byte(meta.String), s.Meta); err != nil {
+				return err
+			}
+		}
+		if s.Data, err = listMessages(ctx, tx, key, false); err != nil {
+			return err
+		}
+	}
+
+	before := s.Data
+	ttl, err := fn(s)
+	if err != nil {
+		return err
+	}
+	if ttl > 0 {
+		expireAt = now + int64(ttl)
+	}
+	if err = writeSQLiteBoard(ctx, tx, key, before, s, expireAt); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if expired {
+		go notifyExpired(key)
+	}
+	c.evict(ctx, key)
+	return nil
+}
+
+// writeSQLiteBoard 写回剪贴板的变更，只写入新增或变更过的记录，删除不再保留的记录
+func writeSQLiteBoard(ctx context.Context, tx *sql.Tx, key string, before []*Message, s *boardState, expireAt int64) error {
+	var meta sql.NullString
+	if s.Meta != nil {
+		val, err := json.Marshal(s.Meta)
+		if err != nil {
+			return err
+		}
+		meta = sql.NullString{String: string(val), Valid: true}
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO boards (name, seq, meta, expire_at, bytes, accessed_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET seq = excluded.seq, meta = excluded.meta, expire_at = excluded.expire_at,
+		bytes = excluded.bytes, accessed_at = excluded.accessed_at`,
+		key, s.Seq, meta, expireAt, boardBytes(s.Data), time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+
+	beforeSeq := make(map[string]int64, len(before))
+	for _, msg := range before {
+		beforeSeq[msg.Id] = msg.Seq
+	}
+	kept := make(map[string]bool, len(s.Data))
+	for _, msg := range s.Data {
+		kept[msg.Id] = true
+		seq, found := beforeSeq[msg.Id]
+		switch {
+		case !found:
+			if err = insertMessage(ctx, tx, key, msg); err != nil {
+				return err
+			}
+		case seq != msg.Seq:
+			// 修改置顶状态等操作只读取了元数据，不修改文件内容
+			_, err = tx.ExecContext(ctx, `UPDATE messages SET seq = ?, pinned = ? WHERE board = ? AND id = ?`, msg.Seq, msg.Pinned, key, msg.Id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, msg := range before {
+		if !kept[msg.Id] {
+			if _, err = tx.ExecContext(ctx, `DELETE FROM messages WHERE board = ? AND id = ?`, key, msg.Id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func insertMessage(ctx context.Context, tx *sql.Tx, key string, msg *Message) error {
+	content := msg.Content
+	var body []byte
+	if msg.IsFile && msg.Content != "" {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(msg.Content); err != nil {
+			return err
+		}
+		content = ""
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO messages (board, `+sqliteMessageColumns+`, ord, body) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		key, msg.Id, msg.Seq, msg.Time, msg.Ip, msg.IsFile, msg.FileType, msg.FileName, MessageSize(msg), msg.Pinned, content, msg.BlobRef, msg.Seq, body)
+	return err
+}
+
+// listMessages 按创建顺序倒序查询剪贴板的记录，withBody 为 false 时不读取文件内容
+func listMessages(ctx context.Context, q sqlExecutor, key string, withBody bool) ([]*Message, error) {
+	columns := sqliteMessageColumns + ", NULL"
+	if withBody {
+		columns = sqliteMessageColumns + ", body"
+	}
+	rows, err := q.QueryContext(ctx, `SELECT `+columns+` FROM messages WHERE board = ? ORDER BY ord DESC`, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs := make([]*Message, 0)
+	for rows.Next() {
+		var body []byte
+		msg, err := scanMessage(rows, &body)
+		if err != nil {
+			return nil, err
+		}
+		if msg.IsFile && msg.BlobRef == "" && withBody {
+			msg.Content = base64.StdEncoding.EncodeToString(body)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+func scanMessage(row rowScanner, body *[]byte) (*Message, error) {
+	msg := &Message{}
+	err := row.Scan(&msg.Id, &msg.Seq, &msg.Time, &msg.Ip, &msg.IsFile, &msg.FileType, &msg.FileName, &msg.Size, &msg.Pinned, &msg.Content, &msg.BlobRef, body)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// ensureSQLiteColumn 列不存在时添加该列
+func ensureSQLiteColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	found := false
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		if name == column {
+			found = true
+		}
+	}
+	rows.Close()
+	if found {
+		return nil
+	}
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+	return err
+}
+
+func deleteBoards(ctx context.Context, tx *sql.Tx, keys []string) error {
+	for _, key := range keys {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE board = ?`, key); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM boards WHERE name = ?`, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *SQLiteCache) SetIp2BoardName(ctx context.Context, ip, boardName string, duration time.Duration) error {
+	_, err := c.db.ExecContext(ctx, `INSERT INTO ip_boards (ip, board, expire_at) VALUES (?, ?, ?)
+		ON CONFLICT (ip) DO UPDATE SET board = excluded.board, expire_at = excluded.expire_at`,
+		ip, boardName, time.Now().Add(duration).UnixNano())
+	return err
+}
+
+func (c *SQLiteCache) GetIp2BoardName(ctx context.Context, ip string) (string, bool, error) {
+	var board string
+	err := c.db.QueryRowContext(ctx, `SELECT board FROM ip_boards WHERE ip = ? AND expire_at >= ?`, ip, time.Now().UnixNano()).Scan(&board)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return board, true, nil
+}
+
+func (c *SQLiteCache) SetPeerRoom(ctx context.Context, device, room string, duration time.Duration) error {
+	_, err := c.db.ExecContext(ctx, `INSERT INTO peer_rooms (peer, room, expire_at) VALUES (?, ?, ?)
+		ON CONFLICT (peer) DO UPDATE SET room = excluded.room, expire_at = excluded.expire_at`,
+		device, room, time.Now().Add(duration).UnixNano())
+	return err
+}
+
+func (c *SQLiteCache) GetPeerRoom(ctx context.Context, device string) (string, bool, error) {
+	var room string
+	err := c.db.QueryRowContext(ctx, `SELECT room FROM peer_rooms WHERE peer = ? AND expire_at >= ?`, device, time.Now().UnixNano()).Scan(&room)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return room, true, nil
+}
+
+func (c *SQLiteCache) DeletePeerRoom(ctx context.Context, device string) error {
+	_, err := c.db.ExecContext(ctx, `DELETE FROM peer_rooms WHERE peer = ?`, device)
+	return err
+}
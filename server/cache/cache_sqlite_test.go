@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// sqliteLegacySchema 添加 blob_ref、bytes 和 accessed_at 列之前的表结构
+var sqliteLegacySchema = []string{
+	`CREATE TABLE boards (
+		name      TEXT PRIMARY KEY,
+		seq       INTEGER NOT NULL DEFAULT 0,
+		meta      TEXT,
+		expire_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE messages (
+		board     TEXT NOT NULL,
+		id        TEXT NOT NULL,
+		ord       INTEGER NOT NULL,
+		seq       INTEGER NOT NULL,
+		time      TEXT NOT NULL,
+		ip        TEXT NOT NULL,
+		is_file   INTEGER NOT NULL,
+		file_type TEXT NOT NULL,
+		file_name TEXT NOT NULL,
+		size      INTEGER NOT NULL,
+		pinned    INTEGER NOT NULL,
+		content   TEXT NOT NULL,
+		body      BLOB,
+		PRIMARY KEY (board, id)
+	)`,
+	`INSERT INTO boards (name, seq, meta, expire_at) VALUES ('old', 2, '{"epoch":"beef"}', 9000000000000000000)`,
+	`INSERT INTO messages VALUES ('old', 'beef-1', 1, 1, '2024-01-01 00:00:00', '127.0.0.1', 0, '', '', 5, 0, 'hello', NULL)`,
+	`INSERT INTO messages VALUES ('old', 'beef-2', 2, 2, '2024-01-01 00:00:01', '127.0.0.1', 1, 'text/plain', 'a.txt', 4, 0, '', x'66696c65')`,
+}
+
+func sqliteColumnNames(t *testing.T, db *sql.DB, table string) []string {
+	t.Helper()
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSQLiteSchemaMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range sqliteLegacySchema {
+		if _, err = db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	c := NewSQLiteCache(path)
+	defer c.Close()
+	for _, col := range sqliteColumns {
+		found := false
+		for _, name := range sqliteColumnNames(t, c.db, col.table) {
+			found = found || name == col.column
+		}
+		if !found {
+			t.Errorf("column %s.%s was not added", col.table, col.column)
+		}
+	}
+	// 再次执行不会重复添加
+	before := sqliteColumnNames(t, c.db, "messages")
+	if err = ensureSQLiteColumn(c.db, "messages", "blob_ref", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		t.Fatal(err)
+	}
+	if after := sqliteColumnNames(t, c.db, "messages"); len(after) != len(before) {
+		t.Fatalf("columns changed from %v to %v", before, after)
+	}
+
+	ctx := context.Background()
+	msgs, ok, err := c.Get(ctx, "old")
+	if err != nil || !ok || len(msgs) != 2 || msgs[0].Content != "ZmlsZQ==" || msgs[1].Content != "hello" {
+		t.Fatalf("old board after migration: %v, %v, %+v", ok, err, msgs)
+	}
+	// 旧剪贴板的占用字节数按 base64 编码后的长度估算补充
+	usage, err := c.Size(ctx)
+	if err != nil || usage.Boards != 1 || usage.Bytes == 0 {
+		t.Fatalf("usage after migration = %+v, %v", usage, err)
+	}
+	mustAppend(t, c, "old", textMessage("new"), testRetention(10))
+	if msgs = mustList(t, c, "old"); len(msgs) != 3 || msgs[0].Id != "beef-3" {
+		t.Fatalf("append after migration: %+v", msgs[0])
+	}
+}
+
+func TestSQLiteAppendRemoveExpire(t *testing.T) {
+	ctx := context.Background()
+	c := NewSQLiteCache(filepath.Join(t.TempDir(), "cache.db"))
+	defer c.Close()
+
+	var expired []string
+	old := expireListeners
+	expireListeners = []func(key string){func(key string) { expired = append(expired, key) }}
+	t.Cleanup(func() { expireListeners = old })
+
+	short := testRetention(10)
+	short.TTL = 200 * time.Millisecond
+	mustCreate(t, c, "short")
+	mustAppend(t, c, "short", textMessage("gone"), short)
+	mustCreate(t, c, "long")
+	mustAppend(t, c, "long", textMessage("text"), testRetention(10))
+	mustAppend(t, c, "long", &Message{Content: "ZmlsZQ==", IsFile: true, FileName: "a.txt", Size: 4}, testRetention(10))
+	if err := c.SetIp2BoardName(ctx, "1.2.3.4", "short", 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetPeerRoom(ctx, "device", "room", 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// 列表不读取文件内容，下载时读取
+	msgs := mustList(t, c, "long")
+	if len(msgs) != 2 || msgs[0].Content != "" || msgs[1].Content != "text" {
+		t.Fatalf("list: %+v", msgs)
+	}
+	file, ok, err := c.GetMessage(ctx, "long", msgs[0].Id)
+	if err != nil || !ok || file.Content != "ZmlsZQ==" {
+		t.Fatalf("GetMessage = %+v, %v, %v", file, ok, err)
+	}
+	if _, err = c.RemoveMessage(ctx, "long", msgs[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ = c.GetMessage(ctx, "long", msgs[0].Id); ok {
+		t.Fatal("removed message is still readable")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if _, ok, err = c.List(ctx, "short"); err != nil || ok {
+		t.Fatalf("expired board is listed: %v, %v", ok, err)
+	}
+	if _, err = c.AppendMessage(ctx, "short", textMessage("late"), short); !errors.Is(err, ErrBoardNotFound) {
+		t.Fatalf("append to an expired board: %v, want ErrBoardNotFound", err)
+	}
+	if _, ok, _ = c.GetIp2BoardName(ctx, "1.2.3.4"); ok {
+		t.Fatal("expired ip mapping is returned")
+	}
+
+	if err = c.Clean(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0] != "short" {
+		t.Fatalf("expired boards notified: %v, want [short]", expired)
+	}
+	for table, want := range map[string]int{"boards": 1, "messages": 1, "ip_boards": 0, "peer_rooms": 0} {
+		var n int
+		if err = c.db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil || n != want {
+			t.Errorf("%d rows left in %s, want %d (%v)", n, table, want, err)
+		}
+	}
+	keys, err := c.GetAllKeys(ctx)
+	if err != nil || len(keys) != 1 || keys[0] != "long" {
+		t.Fatalf("keys after clean = %v, %v", keys, err)
+	}
+}
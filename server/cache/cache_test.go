@@ -0,0 +1,193 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	// miniredis 关闭时 go-redis 会打印订阅连接断开的日志
+	redis.SetLogger(discardLogger{})
+	os.Exit(m.Run())
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Printf(ctx context.Context, format string, v ...interface{}) {}
+
+// newTestRedis 启动进程内的 miniredis，返回服务端和连接它的客户端
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, redis.UniversalClient) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return mr, client
+}
+
+// testBackend 测试用的后端，elapse 让时间前进 d，miniredis 的过期时间需要手动推进
+type testBackend struct {
+	name   string
+	c      Cache
+	elapse func(d time.Duration)
+}
+
+// testBackends 每种后端各创建一个空的缓存，Redis 后端连接 miniredis
+func testBackends(t *testing.T) []testBackend {
+	t.Helper()
+	mr, client := newTestRedis(t)
+	tieredMr, tieredClient := newTestRedis(t)
+	sqlite := NewSQLiteCache(filepath.Join(t.TempDir(), "cache.db"))
+	t.Cleanup(func() { sqlite.Close() })
+	sleep := time.Sleep
+	fastForward := func(mr *miniredis.Miniredis) func(d time.Duration) {
+		return func(d time.Duration) {
+			time.Sleep(d)
+			mr.FastForward(d)
+		}
+	}
+	return []testBackend{
+		{name: "memory", c: NewInMemoryCache(""), elapse: sleep},
+		{name: "sqlite", c: sqlite, elapse: sleep},
+		{name: "redis", c: NewRedisCache(client, "test:"), elapse: fastForward(mr)},
+		{name: "tiered", c: NewTieredCache(NewRedisCache(tieredClient, ""), 10, time.Minute), elapse: fastForward(tieredMr)},
+	}
+}
+
+func testRetention(maxMessages int) Retention {
+	return Retention{MaxMessages: maxMessages, MaxBytes: 1 << 30, MaxPinned: 2, TTL: time.Hour, PinnedTTL: 24 * time.Hour}
+}
+
+func textMessage(content string) *Message {
+	return &Message{Content: content, Time: "2024-01-01 00:00:00", Ip: "127.0.0.1", Size: int64(len(content))}
+}
+
+func mustCreate(t *testing.T, c Cache, key string) {
+	t.Helper()
+	created, err := c.CreateBoard(context.Background(), key, &BoardMeta{}, time.Hour)
+	if err != nil || !created {
+		t.Fatalf("CreateBoard(%s) = %v, %v", key, created, err)
+	}
+}
+
+func mustAppend(t *testing.T, c Cache, key string, msg *Message, r Retention) []*Message {
+	t.Helper()
+	evicted, err := c.AppendMessage(context.Background(), key, msg, r)
+	if err != nil {
+		t.Fatalf("AppendMessage(%s): %v", key, err)
+	}
+	return evicted
+}
+
+func mustList(t *testing.T, c Cache, key string) []*Message {
+	t.Helper()
+	msgs, ok, err := c.List(context.Background(), key)
+	if err != nil || !ok {
+		t.Fatalf("List(%s) = %v, %v", key, ok, err)
+	}
+	return msgs
+}
+
+// TestCacheAtomicOperations 所有后端的 AppendMessage、RemoveMessage 和 SetPinned 行为一致，并发修改不会丢失
+func TestCacheAtomicOperations(t *testing.T) {
+	for _, b := range testBackends(t) {
+		c := b.c
+		t.Run(b.name, func(t *testing.T) {
+			ctx := context.Background()
+			r := testRetention(100)
+
+			if _, err := c.AppendMessage(ctx, "missing", textMessage("a"), r); !errors.Is(err, ErrBoardNotFound) {
+				t.Fatalf("append to a missing board: %v, want ErrBoardNotFound", err)
+			}
+			mustCreate(t, c, "board")
+			if created, err := c.CreateBoard(ctx, "board", &BoardMeta{}, time.Hour); err != nil || created {
+				t.Fatalf("second CreateBoard = %v, %v, want false", created, err)
+			}
+
+			const workers, perWorker = 8, 5
+			var wg sync.WaitGroup
+			errs := make(chan error, workers*perWorker)
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < perWorker; i++ {
+						if _, err := c.AppendMessage(ctx, "board", textMessage(fmt.Sprintf("%d-%d", w, i)), r); err != nil {
+							errs <- err
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+
+			msgs := mustList(t, c, "board")
+			if len(msgs) != workers*perWorker {
+				t.Fatalf("%d messages after concurrent appends, want %d", len(msgs), workers*perWorker)
+			}
+			meta, _, err := c.GetMeta(ctx, "board")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, msg := range msgs {
+				// 按时间倒序排列，序号连续且与 ID 一致
+				want := int64(len(msgs) - i)
+				if msg.Seq != want || msg.Id != MessageId(meta.Epoch, want) {
+					t.Fatalf("message %d has seq %d id %s, want seq %d", i, msg.Seq, msg.Id, want)
+				}
+			}
+
+			removed, err := c.RemoveMessage(ctx, "board", msgs[3].Id)
+			if err != nil || removed.Id != msgs[3].Id {
+				t.Fatalf("RemoveMessage = %v, %v", removed, err)
+			}
+			if _, err = c.RemoveMessage(ctx, "board", msgs[3].Id); !errors.Is(err, ErrMessageNotFound) {
+				t.Fatalf("second RemoveMessage: %v, want ErrMessageNotFound", err)
+			}
+			meta, _, err = c.GetMeta(ctx, "board")
+			if err != nil || len(meta.Tombstones) != 1 || meta.Tombstones[0].Id != msgs[3].Id || meta.Tombstones[0].Seq != int64(len(msgs)+1) {
+				t.Fatalf("tombstones after removal: %+v, %v", meta, err)
+			}
+
+			// 置顶的记录不参与淘汰，超出置顶上限时拒绝
+			oldest := msgs[len(msgs)-1]
+			if _, _, err = c.SetPinned(ctx, "board", oldest.Id, true, r); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err = c.SetPinned(ctx, "board", msgs[len(msgs)-2].Id, true, r); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err = c.SetPinned(ctx, "board", msgs[0].Id, true, r); !errors.Is(err, ErrTooManyPinned) {
+				t.Fatalf("pinning over the limit: %v, want ErrTooManyPinned", err)
+			}
+			// 删除一条、新增一条后，除 2 条置顶记录外只保留最新的 3 条
+			evicted := mustAppend(t, c, "board", textMessage("new"), testRetention(3))
+			if want := len(msgs) - 2 - 3; len(evicted) != want {
+				t.Fatalf("%d messages evicted, want %d", len(evicted), want)
+			}
+			kept := mustList(t, c, "board")
+			pinned := 0
+			for _, msg := range kept {
+				if msg.Pinned {
+					pinned++
+				}
+			}
+			if len(kept) != 5 || pinned != 2 || kept[0].Content != "new" {
+				t.Fatalf("kept %d messages with %d pinned, newest %q", len(kept), pinned, kept[0].Content)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// invalidateChannel 剪贴板变更后发布剪贴板名称，各实例收到后丢弃进程内的缓存
+var invalidateChannel = "sync-boards:invalidate"
+
+// TieredCache 在 RedisCache 之上增加进程内的缓存，缓存剪贴板的记录元数据、元数据和过期时间，
+// 文件内容仍从 Redis 读取。任一实例修改剪贴板后通过 Redis pub/sub 通知所有实例丢弃缓存，
+// 缓存项同时有较短的有效期，pub/sub 断线期间错过的通知最多影响一个有效期
+type TieredCache struct {
+	*RedisCache
+
+	size int
+	ttl  time.Duration
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // 最近访问的在前
+	gen     uint64     // 每次丢弃缓存时递增，加载期间发生变更时不写入缓存
+	cancel  context.CancelFunc
+}
+
+type tieredEntry struct {
+	key      string
+	state    *boardState
+	expireAt time.Time // 零值表示没有过期时间
+	loadedAt time.Time
+}
+
+func NewTieredCache(redisCache *RedisCache, size int, ttl time.Duration) *TieredCache {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &TieredCache{
+		RedisCache: redisCache,
+		size:       size,
+		ttl:        ttl,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		cancel:     cancel,
+	}
+	redisCache.onChange = t.publish
+	go t.watchInvalidate(ctx)
+	return t
+}
+
+// watchInvalidate 订阅其他实例发布的变更通知
+func (t *TieredCache) watchInvalidate(ctx context.Context) {
+	pubsub := t.client.Subscribe(ctx, t.keys.invalidate())
+	defer pubsub.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-pubsub.Channel():
+			if !ok {
+				return
+			}
+			t.drop(msg.Payload)
+		}
+	}
+}
+
+// publish 先丢弃本实例的缓存再通知其他实例，保证本实例写入后立即读到新内容
+func (t *TieredCache) publish(ctx context.Context, key string) {
+	t.drop(key)
+	if err := t.client.Publish(ctx, t.keys.invalidate(), key).Err(); err != nil {
+		log.Printf("ERROR: Redis PUBLISH failed: %v", err)
+	}
+}
+
+func (t *TieredCache) drop(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.gen++
+	if el, found := t.entries[key]; found {
+		t.order.Remove(el)
+		delete(t.entries, key)
+	}
+}
+
+// load 读取剪贴板状态，优先使用进程内的缓存，剪贴板不存在时返回 false
+func (t *TieredCache) load(ctx context.Context, key string) (*tieredEntry, bool, error) {
+	now := time.Now()
+	t.lock.Lock()
+	if el, found := t.entries[key]; found {
+		entry := el.Value.(*tieredEntry)
+		if now.Sub(entry.loadedAt) < t.ttl && (entry.expireAt.IsZero() || now.Before(entry.expireAt)) {
+			t.order.MoveToFront(el)
+			t.lock.Unlock()
+			// 命中进程内缓存时仍需刷新 Redis 中的访问时间，避免剪贴板被误认为最久未访问
+			t.touch(ctx, key)
+			return entry, true, nil
+		}
+		t.order.Remove(el)
+		delete(t.entries, key)
+	}
+	gen := t.gen
+	t.lock.Unlock()
+
+	s, ok, err := t.readBoardState(ctx, t.client, key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	ttl, err := t.client.PTTL(ctx, t.keys.board(key)).Result()
+	if err != nil {
+		return nil, false, err
+	}
+	if ttl == -2 { // -2 means the key does not exist
+		return nil, false, nil
+	}
+	t.touch(ctx, key)
+
+	entry := &tieredEntry{key: key, state: s, loadedAt: now}
+	if ttl > 0 {
+		entry.expireAt = now.Add(ttl)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if gen != t.gen {
+		// 加载期间有剪贴板发生变更，读取到的可能是旧内容，不写入缓存
+		return entry, true, nil
+	}
+	if el, found := t.entries[key]; found {
+		t.order.Remove(el)
+	}
+	t.entries[key] = t.order.PushFront(entry)
+	for t.order.Len() > t.size {
+		oldest := t.order.Back()
+		t.order.Remove(oldest)
+		delete(t.entries, oldest.Value.(*tieredEntry).key)
+	}
+	return entry, true, nil
+}
+
+// List 从进程内的缓存读取记录元数据，文件记录不包含内容
+func (t *TieredCache) List(ctx context.Context, key string) ([]*Message, bool, error) {
+	entry, ok, err := t.load(ctx, key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return entry.state.Data, true, nil
+}
+
+func (t *TieredCache) GetMeta(ctx context.Context, key string) (*BoardMeta, bool, error) {
+	entry, ok, err := t.load(ctx, key)
+	if err != nil || !ok || entry.state.Meta == nil {
+		return nil, false, err
+	}
+	return entry.state.Meta, true, nil
+}
+
+func (t *TieredCache) GetExpireAt(ctx context.Context, key string) (string, error) {
+	entry, ok, err := t.load(ctx, key)
+	if err != nil || !ok || entry.expireAt.IsZero() {
+		return "", err
+	}
+	return entry.expireAt.Format("2006-01-02 15:04:05"), nil
+}
+
+func (t *TieredCache) Close() error {
+	t.cancel()
+	return t.RedisCache.Close()
+}
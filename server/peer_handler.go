@@ -1,6 +1,8 @@
 package server
 
 import (
+	"airclipboard/server/cache"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
@@ -8,6 +10,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/ua-parser/uap-go/uaparser"
 	"hash/fnv"
+	"io"
 	"log"
 	"math"
 	"net/http"
@@ -34,59 +37,72 @@ var (
 		"海诺", "敖隐", "大司命"}
 )
 
-type PeerName struct {
-	model       string `json:"model"`
-	os          string `json:"os"`
-	browser     string `json:"browser"`
-	deviceType  string `json:"type"`
-	deviceName  string `json:"deviceName"`
-	displayName string `json:"displayName"`
-}
-
+// Peer 一个 WebSocket 连接。socket 的写操作只在 writePump 中进行，其他协程通过 PeerServer.send 写入 outbox
 type Peer struct {
-	socket       *websocket.Conn `json:"-"`
-	ip           string          `json:"-"`
-	id           string          `json:"id"`
-	rtcSupported bool            `json:"rtcSupported"`
-	name         *PeerName       `json:"name"`
-	board        string          `json:"board"`
-	lastBeat     time.Time       `json:"-"`
-	timer        *time.Timer     `json:"-"`
-
-	cancelKeepAlive chan struct{} `json:"-"`
-	mu              sync.Mutex    `json:"-"`
+	socket       *websocket.Conn
+	ip           string
+	addr         string // 连接的 RemoteAddr 中的 IP，不受请求头影响
+	id           string
+	credential   string // 设备密钥的摘要，配对关系和中转以此确认身份
+	rtcSupported bool
+	name         *PeerName
+	version      int       // 协商后的协议版本，消息格式变化时据此兼容旧客户端
+	board        string    // 由 PeerServer.mu 保护
+	lastBeat     time.Time // 由 PeerServer.mu 保护
+	pairedRoom   string    // 与其他网络的设备配对后所在的房间，由 PeerServer.mu 保护
+	iceExpiresAt time.Time // 已下发的 TURN 凭据的过期时间，建立连接后只在 keepAlive 中读写
+
+	outbox     chan []byte   // 待发送的消息，写满说明客户端消费过慢
+	closing    chan struct{} // 关闭后 writePump 发送 closeFrame 并断开连接
+	closeFrame []byte
+	closeOnce  sync.Once
+	writerDone chan struct{} // writePump 退出后关闭
 }
 
+// PeerServer 的 rooms、paired、boards、配对码以及 peer 的 board、lastBeat、pairedRoom 均由 mu 保护。
+// 向 peer 发送消息只是写入其 outbox，不会阻塞，可以在持有 mu 时调用
 type PeerServer struct {
-	upgrader websocket.Upgrader
-	rooms    map[string]map[string]*Peer
-	boards   map[string]map[string]map[string]bool
-	mu       sync.Mutex
+	upgrader        websocket.Upgrader
+	rooms           map[string]map[string]*Peer
+	paired          map[string]map[string]*Peer
+	boards          map[string]map[string]map[string]bool
+	pairings        map[string]*pairing
+	pairingTokens   map[string]*pairing
+	pairingFailures map[string]*pairingFailures
+	relays          map[string]*relay
+	relayBandwidth  *bandwidthLimiter // 所有中转共用的限速
+	closing         bool              // 服务退出中，不再接受新的连接
+	mu              sync.Mutex
 }
 
+const (
+	// peerOutboxSize 每个 peer 最多排队的消息数，超过后断开该 peer
+	peerOutboxSize = 64
+	// peerWriteTimeout 单条消息的写超时
+	peerWriteTimeout = 10 * time.Second
+	// shutdownWriteTimeout 退出时向每个 peer 发送剩余消息的超时时间，避免个别网络不佳的 peer 拖慢退出
+	shutdownWriteTimeout = 2 * time.Second
+)
+
 // NewPeer creates a new Peer
 func NewPeer(socket *websocket.Conn, c *gin.Context) *Peer {
 	newPeer := &Peer{
-		socket:          socket,
-		cancelKeepAlive: make(chan struct{}),
+		socket:     socket,
+		outbox:     make(chan []byte, peerOutboxSize),
+		closing:    make(chan struct{}),
+		writerDone: make(chan struct{}),
 	}
 
 	// set ip
-	newPeer.ip = LogApiRequestIP(c, "NewPeer", -1)
-	// if ip is localhost, set it to 127.0.0.1
-	if newPeer.ip == "::1" || newPeer.ip == "::ffff:127.0.0.1" {
-		newPeer.ip = "127.0.0.1"
-	}
+	newPeer.ip = peerIP(c)
+	newPeer.addr = remoteHost(c.Request)
 	// peerId由PeerServer生成，写入Cookie
 	if peerId, err := c.Cookie("peerid"); err == nil {
 		newPeer.id = peerId
 	}
-	// set rtcSupported
-	if strings.Index(c.Request.URL.String(), "webrtc") > -1 {
-		newPeer.rtcSupported = true
-	} else {
-		newPeer.rtcSupported = false
-	}
+	// 客户端通过 rtc 参数声明是否支持 WebRTC，不支持时文件经 /server/relay 中转。
+	// 旧版客户端不带该参数，且只在支持 WebRTC 时才会连接
+	newPeer.rtcSupported = c.Query("rtc") != "0"
 	// set name
 	uaString := c.GetHeader("User-Agent")
 	parser := uaparser.NewFromSaved()
@@ -121,12 +137,12 @@ func NewPeer(socket *websocket.Conn, c *gin.Context) *Peer {
 	displayName := getRandomHero(newPeer.id)
 
 	newPeer.name = &PeerName{
-		model:       client.Device.Model,     // 设备型号
-		os:          client.Os.Family,        // 操作系统
-		browser:     client.UserAgent.Family, // 浏览器
-		deviceType:  client.Device.Family,    // 设备类型
-		deviceName:  deviceName,              // 显示设备名称
-		displayName: displayName,             // 显示名称
+		Model:       client.Device.Model,     // 设备型号
+		OS:          client.Os.Family,        // 操作系统
+		Browser:     client.UserAgent.Family, // 浏览器
+		DeviceType:  client.Device.Family,    // 设备类型
+		DeviceName:  deviceName,              // 显示设备名称
+		DisplayName: displayName,             // 显示名称
 	}
 
 	newPeer.lastBeat = time.Now()
@@ -134,25 +150,23 @@ func NewPeer(socket *websocket.Conn, c *gin.Context) *Peer {
 	return newPeer
 }
 
-func (p *Peer) getInfo() map[string]interface{} {
-	return map[string]interface{}{
-		"id":           p.id,
-		"ip":           p.ip,
-		"rtcSupported": p.rtcSupported,
-		"name": map[string]interface{}{
-			"model":       p.name.model,
-			"os":          p.name.os,
-			"browser":     p.name.browser,
-			"deviceType":  p.name.deviceType,
-			"deviceName":  p.name.deviceName,
-			"displayName": p.name.displayName,
-		},
+// peerIP 信令和中转连接所属房间的 IP
+func peerIP(c *gin.Context) string {
+	ip := LogApiRequestIP(c, "Peer", -1)
+	// if ip is localhost, set it to 127.0.0.1
+	if ip == "::1" || ip == "::ffff:127.0.0.1" {
+		ip = "127.0.0.1"
 	}
+	return ip
+}
+
+func (p *Peer) info() PeerInfo {
+	return PeerInfo{Id: p.id, RtcSupported: p.rtcSupported, Name: p.name}
 }
 
 // NewPeerServer creates a new PeerServer
 func NewPeerServer() *PeerServer {
-	return &PeerServer{
+	s := &PeerServer{
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
@@ -160,9 +174,17 @@ func NewPeerServer() *PeerServer {
 				return true
 			},
 		},
-		rooms:  make(map[string]map[string]*Peer),           // room -> id -> peer
-		boards: make(map[string]map[string]map[string]bool), // board -> room -> id -> bool
+		rooms:           make(map[string]map[string]*Peer),           // ip -> id -> peer
+		paired:          make(map[string]map[string]*Peer),           // paired room -> id -> peer
+		boards:          make(map[string]map[string]map[string]bool), // board -> ip -> id -> bool
+		pairings:        make(map[string]*pairing),                   // code slot -> pairing
+		pairingTokens:   make(map[string]*pairing),                   // token -> pairing
+		pairingFailures: make(map[string]*pairingFailures),           // remote addr -> failures
+		relays:          make(map[string]*relay),                     // relay id -> relay
+		relayBandwidth:  newBandwidthLimiter(PeerRelayLimits.TotalBandwidth),
 	}
+	boardEvents.Subscribe(s.onBoardEvent)
+	return s
 }
 
 // HandleConnection handles a new peer connection
@@ -179,6 +201,20 @@ func (s *PeerServer) HandleConnection(c *gin.Context) {
 		c.Header("Set-Cookie", "peerid="+peerId+";SameSite=Strict;Secure")
 		//log.Println("Set Cookie peerid:", peerId)
 	}
+	credential, err := issuePeerSecret(c)
+	if err != nil {
+		log.Printf("生成设备密钥失败，err=%v", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	closing := s.closing
+	s.mu.Unlock()
+	if closing {
+		c.Status(http.StatusServiceUnavailable)
+		return
+	}
 
 	// Upgrade the connection to a websocket connection
 	socket, err := s.upgrader.Upgrade(c.Writer, c.Request, c.Writer.Header())
@@ -186,45 +222,96 @@ func (s *PeerServer) HandleConnection(c *gin.Context) {
 		log.Println("Upgrade error:", err)
 		return
 	}
-	defer socket.Close()
 
 	// Create a new Peer instance
 	peer := NewPeer(socket, c)
 	peer.id = peerId
-	s.joinRoom(peer)
+	peer.credential = credential
+	go peer.writePump()
+	defer peer.close(nil)
+
+	// 协议版本不兼容时回复错误后断开，浏览器无法读取握手失败的 HTTP 响应
+	version, err := negotiateVersion(c.Query("v"))
+	if err != nil {
+		s.send(peer, err.(*ProtocolError).reply())
+		peer.close(websocket.FormatCloseMessage(websocket.CloseProtocolError, "unsupported protocol version"))
+		return
+	}
+	peer.version = version
+
+	// 恢复之前的配对关系，并重新计算有效期。缓存不可用时仅影响配对，不影响同一网络内的设备
+	ctx := c.Request.Context()
+	if room, found, err := cache.GetPeerRoom(ctx, peer.credential); err != nil {
+		log.Printf("读取配对关系失败，peerId=%s, err=%v", peer.id, err)
+	} else if found {
+		peer.pairedRoom = room
+		if err := cache.SetPeerRoom(ctx, peer.credential, room, pairedRoomTTL); err != nil {
+			log.Printf("刷新配对关系失败，peerId=%s, err=%v", peer.id, err)
+		}
+	}
+	var servers []IceServer
+	servers, peer.iceExpiresAt = iceServers(peer.id, time.Now())
+	s.send(peer, HelloMessage{
+		Type:       MessageHello,
+		Version:    version,
+		PeerId:     peer.id,
+		Paired:     peer.pairedRoom != "",
+		IceServers: servers,
+	})
+
+	if !s.joinRoom(peer) {
+		peer.close(websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting"))
+		return
+	}
+	defer s.leaveRoom(peer)
 
 	// Start a goroutine to keep the connection alive
 	go s.keepAlive(peer)
 
 	// Send a display-name message to the peer
-	s.send(peer, map[string]interface{}{
-		"type": "display-name",
-		"message": map[string]string{
-			"displayName": peer.name.displayName,
-			"deviceName":  peer.name.deviceName,
-		},
+	s.send(peer, DisplayNameMessage{
+		Type:    MessageDisplayName,
+		Message: DisplayName{DisplayName: peer.name.DisplayName, DeviceName: peer.name.DeviceName},
 	})
 
 	// Read messages from the socket
 	for {
-		_, message, err := socket.ReadMessage()
+		messageType, r, err := socket.NextReader()
 		if err != nil {
 			//log.Println("Read error:", err)
-			s.leaveRoom(peer)
-			break
+			return
+		}
+		if messageType != websocket.TextMessage {
+			s.send(peer, ErrorMessage{Type: MessageError, Code: ErrCodeInvalidMessage, Message: "only text messages are supported"})
+			continue
+		}
+		// 超出上限的部分不再读取，读取下一条消息时会被丢弃
+		message, err := io.ReadAll(io.LimitReader(r, maxSignalMessageSize+1))
+		if err != nil {
+			return
+		}
+		if len(message) > maxSignalMessageSize {
+			s.send(peer, ErrorMessage{
+				Type:    MessageError,
+				Code:    ErrCodeMessageTooLarge,
+				Message: fmt.Sprintf("message must not be larger than %d bytes", maxSignalMessageSize),
+			})
+			continue
 		}
 		// Handle the received message
-		s.handleMessage(peer, message)
+		s.handleMessage(ctx, peer, message)
 	}
-
-	// Cancel the keep alive goroutine
-	s.cancelKeepAlive(peer)
 }
 
-func (s *PeerServer) joinRoom(peer *Peer) {
+// joinRoom 服务退出中时返回 false
+func (s *PeerServer) joinRoom(peer *Peer) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.closing {
+		return false
+	}
+
 	// if room doesn't exist, create it
 	if _, exists := s.rooms[peer.ip]; !exists {
 		s.rooms[peer.ip] = make(map[string]*Peer)
@@ -232,165 +319,278 @@ func (s *PeerServer) joinRoom(peer *Peer) {
 
 	// add peer to room
 	s.rooms[peer.ip][peer.id] = peer
+	s.addToPairedRoom(peer)
 	log.Printf("Peer joined: %s (ID: %s, Board: %s)", peer.ip, peer.id, peer.board)
 
-	// Notify other peers in the room
-	for _, otherPeer := range s.rooms[peer.ip] {
-		if otherPeer.id != peer.id {
-			s.send(otherPeer, map[string]interface{}{
-				"type": "peer-joined",
-				"peer": peer.getInfo(),
-			})
-		}
-	}
-
-	// Send current peers to the new peer
-	peers := make([]map[string]interface{}, 0, len(s.rooms[peer.ip])-1)
-	for _, otherPeer := range s.rooms[peer.ip] {
-		if otherPeer.id != peer.id {
-			peers = append(peers, otherPeer.getInfo())
-		}
+	// Notify other peers in the room and the paired room, then send them to the new peer
+	visible := s.visiblePeers(peer)
+	peers := make([]PeerInfo, 0, len(visible))
+	for _, otherPeer := range visible {
+		s.send(otherPeer, PeerJoinedMessage{Type: MessagePeerJoined, Peer: peer.info()})
+		peers = append(peers, otherPeer.info())
 	}
-	s.send(peer, map[string]interface{}{
-		"type":  "peers",
-		"peers": peers,
-	})
+	s.send(peer, PeersMessage{Type: MessagePeers, Peers: peers})
+	return true
 }
 
 func (s *PeerServer) leaveRoom(peer *Peer) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// remove peer from room
-	if room, exists := s.rooms[peer.ip]; exists {
-		if _, peerExists := room[peer.id]; !peerExists {
-			return
-		}
-		s.cancelKeepAlive(peer)
-		peer.socket.Close()
-		delete(room, peer.id)
-		log.Printf("Peer left: %s (ID: %s, Board: %s)", peer.ip, peer.id, peer.board)
-
-		if len(room) == 0 {
-			// if room is empty, remove it
-			delete(s.rooms, peer.ip)
-		} else {
-			// notify all other peers
-			for _, otherPeer := range room {
-				s.send(otherPeer, map[string]interface{}{
-					"type":   "peer-left",
-					"peerId": peer.id,
-				})
-			}
-		}
+	peer.close(nil)
+
+	// remove peer from room, the same id may have reconnected with a new peer
+	room, exists := s.rooms[peer.ip]
+	if !exists || room[peer.id] != peer {
+		return
+	}
+	visible := s.visiblePeers(peer)
+	delete(room, peer.id)
+	if len(room) == 0 {
+		// if room is empty, remove it
+		delete(s.rooms, peer.ip)
 	}
+	s.removeFromPairedRoom(peer)
+	s.removeFromBoard(peer)
+	log.Printf("Peer left: %s (ID: %s, Board: %s)", peer.ip, peer.id, peer.board)
 
-	if peer.board != "" {
-		delete(s.boards[peer.board][peer.ip], peer.id)
-		if len(s.boards[peer.board][peer.ip]) == 0 {
-			delete(s.boards[peer.board], peer.ip)
-		}
-		if len(s.boards[peer.board]) == 0 {
-			delete(s.boards, peer.board)
-		}
+	// notify all other peers
+	for _, otherPeer := range visible {
+		s.send(otherPeer, PeerLeftMessage{Type: MessagePeerLeft, PeerId: peer.id})
 	}
 }
 
-func (s *PeerServer) handleMessage(sender *Peer, message []byte) {
-	var msg map[string]interface{}
-	if err := json.Unmarshal(message, &msg); err != nil {
-		log.Println("Unmarshal error:", err)
+// removeFromBoard 将 peer 从其所在剪贴板的索引中移除，调用方需持有 s.mu
+func (s *PeerServer) removeFromBoard(peer *Peer) {
+	if peer.board == "" {
+		return
+	}
+	delete(s.boards[peer.board][peer.ip], peer.id)
+	if len(s.boards[peer.board][peer.ip]) == 0 {
+		delete(s.boards[peer.board], peer.ip)
+	}
+	if len(s.boards[peer.board]) == 0 {
+		delete(s.boards, peer.board)
+	}
+}
+
+// handleMessage 处理客户端的消息，不符合协议的消息以 error 消息回复
+func (s *PeerServer) handleMessage(ctx context.Context, sender *Peer, message []byte) {
+	parsed, err := parseClientMessage(message)
+	if err != nil {
+		s.send(sender, err.(*ProtocolError).reply())
 		return
 	}
 
-	switch msg["type"] {
-	case "disconnect":
+	switch msg := parsed.(type) {
+	case *DisconnectMessage:
 		s.leaveRoom(sender)
-	case "pong":
-		sender.lastBeat = time.Now()
-		board, _ := msg["board"].(string)
-		sender.board = board
+	case *PongMessage:
 		s.mu.Lock()
-		if _, exists := s.boards[board]; !exists {
-			s.boards[board] = make(map[string]map[string]bool)
-		}
-		if _, exists := s.boards[board][sender.ip]; !exists {
-			s.boards[board][sender.ip] = make(map[string]bool)
+		sender.lastBeat = time.Now()
+		// 已离开房间的 peer 不再加入剪贴板索引
+		if s.rooms[sender.ip][sender.id] == sender {
+			if sender.board != msg.Board {
+				s.removeFromBoard(sender)
+				sender.board = msg.Board
+			}
+			if _, exists := s.boards[msg.Board]; !exists {
+				s.boards[msg.Board] = make(map[string]map[string]bool)
+			}
+			if _, exists := s.boards[msg.Board][sender.ip]; !exists {
+				s.boards[msg.Board][sender.ip] = make(map[string]bool)
+			}
+			s.boards[msg.Board][sender.ip][sender.id] = true
 		}
-		s.boards[board][sender.ip][sender.id] = true
-		log.Printf("Receive pong from board=%s, ip=%v, id=%v", board, sender.ip, sender.id)
 		s.mu.Unlock()
-	case "board-update":
+		log.Printf("Receive pong from board=%s, ip=%v, id=%v", msg.Board, sender.ip, sender.id)
+	case *BoardUpdateMessage:
+		//log.Printf("Receive board-update from board=%s, ip=%v, id=%v", msg.Board, sender.ip, sender.id)
+		update := BoardUpdateMessage{Type: MessageBoardUpdate, Board: msg.Board}
+		s.mu.Lock()
 		sender.lastBeat = time.Now()
-		board, _ := msg["board"].(string)
-		//log.Printf("Receive board-update from board=%s, ip=%v, id=%v", board, sender.ip, sender.id)
-		if peers, exists := s.boards[board]; exists {
-			for ip, ids := range peers {
-				if room, exists := s.rooms[ip]; exists {
-					for id := range ids {
-						if id != sender.id {
-							s.send(room[id], map[string]interface{}{
-								"type":  "board-update",
-								"board": board,
-							})
-						}
-					}
+		for ip, ids := range s.boards[msg.Board] {
+			for id := range ids {
+				if id != sender.id {
+					s.send(s.rooms[ip][id], update)
 				}
 			}
 		}
+		s.mu.Unlock()
+	case *SignalMessage:
+		// RTC message to specified peer in the same room or the paired room
+		s.mu.Lock()
+		recipient := s.visiblePeer(sender, msg.To)
+		s.mu.Unlock()
+		if recipient == nil {
+			s.send(sender, ErrorMessage{Type: MessageError, Code: ErrCodePeerNotFound, Message: "peer not found", RequestType: MessageSignal})
+			return
+		}
+		msg.Sender, msg.To = sender.id, ""
+		s.send(recipient, msg)
+	case *PairRequestMessage:
+		s.handlePairRequest(sender)
+	case *PairJoinMessage:
+		s.handlePairJoin(ctx, sender, msg)
+	case *UnpairMessage:
+		s.handleUnpair(ctx, sender)
 	}
+}
 
-	// RTC message tp specified peer
-	if to, exists := msg["to"]; exists {
-		recipientId, _ := to.(string)
-		if room, exists := s.rooms[sender.ip]; exists {
-			if recipient, exists := room[recipientId]; exists {
-				msg["sender"] = sender.id
-				delete(msg, "to")
-				s.send(recipient, msg)
-			}
+// onBoardEvent 将剪贴板变更事件推送给正在查看该剪贴板的所有 peer，客户端据此增量更新，无需重新拉取整个剪贴板
+func (s *PeerServer) onBoardEvent(evt BoardEvent) {
+	message := BoardUpdateMessage{
+		Type:     MessageBoardUpdate,
+		Board:    evt.Board,
+		Event:    evt.Type,
+		Id:       evt.Id,
+		ExpireAt: evt.ExpireAt,
+	}
+	// WebSocket 连接未经剪贴板认证，受密码保护的剪贴板只通知变更，由客户端自行拉取
+	if !evt.Protected {
+		message.Message = evt.Message
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ip, ids := range s.boards[evt.Board] {
+		for id := range ids {
+			s.send(s.rooms[ip][id], message)
+		}
+	}
+}
+
+// Shutdown 通知所有 peer 服务即将重启并关闭连接，客户端在 reconnectAfter 之后重连。
+// WebSocket 连接已被接管，http.Server.Shutdown 既不会等待也不会关闭它们
+func (s *PeerServer) Shutdown(reconnectAfter time.Duration) {
+	message := ServerRestartingMessage{Type: ServerRestarting, ReconnectAfter: reconnectAfter.Milliseconds()}
+	closeFrame := websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting")
+
+	s.mu.Lock()
+	s.closing = true
+	peers := make([]*Peer, 0)
+	for _, room := range s.rooms {
+		for _, peer := range room {
+			s.send(peer, message)
+			peer.close(closeFrame)
+			peers = append(peers, peer)
 		}
 	}
+	// 清空房间，连接关闭后 leaveRoom 不会再向其他即将关闭的 peer 发送 peer-left
+	s.rooms = make(map[string]map[string]*Peer)
+	s.paired = make(map[string]map[string]*Peer)
+	s.boards = make(map[string]map[string]map[string]bool)
+	relays := make([]*relay, 0, len(s.relays))
+	for _, r := range s.relays {
+		relays = append(relays, r)
+	}
+	s.mu.Unlock()
+
+	// 中转中的传输无法续传，直接断开，客户端重连后重新发送
+	for _, r := range relays {
+		r.close(websocket.CloseServiceRestart, "server restarting")
+	}
+
+	for _, peer := range peers {
+		<-peer.writerDone
+	}
+	log.Printf("Notified %d peers of the restart", len(peers))
 }
 
-func (s *PeerServer) send(peer *Peer, message map[string]interface{}) {
+// send 将消息放入 peer 的发送队列，队列已满时断开该 peer，避免一个慢客户端拖住其他 peer
+func (s *PeerServer) send(peer *Peer, message interface{}) {
 	if peer == nil {
 		return
 	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Marshal message:%v error:%v", message, err)
+		return
+	}
+
+	select {
+	case <-peer.closing:
+	case peer.outbox <- data:
+	default:
+		log.Printf("Peer %s (ID: %s) is too slow, disconnecting", peer.ip, peer.id)
+		peer.close(websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+	}
+}
 
-	peer.mu.Lock()
-	defer peer.mu.Unlock()
+// close 通知 writePump 发送 closeFrame（为 nil 时不发送）后断开连接，可重复调用
+func (p *Peer) close(closeFrame []byte) {
+	p.closeOnce.Do(func() {
+		p.closeFrame = closeFrame
+		close(p.closing)
+	})
+}
+
+// writePump 依次发送 outbox 中的消息，是唯一写 socket 的协程。
+// 关闭时在 shutdownWriteTimeout 内尽量发送已排队的消息和 closeFrame
+func (p *Peer) writePump() {
+	defer close(p.writerDone)
+	defer p.socket.Close()
 
-	if err := peer.socket.WriteJSON(message); err != nil {
-		log.Printf("Write msssage:%v error:%v", message, err)
+	for {
+		select {
+		case data := <-p.outbox:
+			_ = p.socket.SetWriteDeadline(time.Now().Add(peerWriteTimeout))
+			if err := p.socket.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Printf("Write message to peer %s error:%v", p.id, err)
+				p.close(nil)
+				return
+			}
+		case <-p.closing:
+			deadline := time.Now().Add(shutdownWriteTimeout)
+			_ = p.socket.SetWriteDeadline(deadline)
+			for pending := true; pending; {
+				select {
+				case data := <-p.outbox:
+					pending = p.socket.WriteMessage(websocket.TextMessage, data) == nil
+				default:
+					pending = false
+				}
+			}
+			if p.closeFrame != nil {
+				_ = p.socket.WriteControl(websocket.CloseMessage, p.closeFrame, deadline)
+			}
+			return
+		}
 	}
 }
 
 func (s *PeerServer) keepAlive(peer *Peer) {
-	s.send(peer, map[string]interface{}{"type": "ping", "board": peer.board})
-
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
 	for {
+		s.mu.Lock()
+		board, lastBeat := peer.board, peer.lastBeat
+		s.mu.Unlock()
+		if lastBeat.Add(60 * time.Second).Before(time.Now()) {
+			s.leaveRoom(peer)
+			return
+		}
+		s.send(peer, PingMessage{Type: MessagePing, Board: board})
+
+		s.refreshIceServers(peer, time.Now())
+
 		select {
 		case <-ticker.C:
-			if peer.lastBeat.Add(60 * time.Second).Before(time.Now()) {
-				s.leaveRoom(peer)
-				return
-			}
-			s.send(peer, map[string]interface{}{"type": "ping", "board": peer.board})
-		case <-peer.cancelKeepAlive:
-			//log.Println("KeepAlive canceled for peer:", peer.id)
+		case <-peer.closing:
 			return
 		}
 	}
 }
 
-func (s *PeerServer) cancelKeepAlive(peer *Peer) {
-	if peer != nil && peer.cancelKeepAlive != nil && !isClosed(peer.cancelKeepAlive) {
-		close(peer.cancelKeepAlive)
+// refreshIceServers TURN 凭据过半有效期后下发新的凭据，页面长时间打开时新建的 WebRTC 连接仍可使用 TURN
+func (s *PeerServer) refreshIceServers(peer *Peer, now time.Time) {
+	if peer.iceExpiresAt.IsZero() || peer.iceExpiresAt.Sub(now) >= PeerIceConfig.TurnTTL/2 {
+		return
 	}
+	var servers []IceServer
+	servers, peer.iceExpiresAt = iceServers(peer.id, now)
+	s.send(peer, IceServersMessage{Type: MessageIceServers, IceServers: servers})
 }
 
 // seededRandom is a function that implements the Linear Congruential Generator (LCG) algorithm.
@@ -419,14 +619,3 @@ func getRandomHero(seedStr string) string {
 	levelIndex := int(math.Floor(seededRandom(levelSeed) * float64(len(levels))))
 	return fmt.Sprintf("%s %s", levels[levelIndex], heroes[heroIndex])
 }
-
-// isClosed checks if the given channel is closed.
-// It returns true if the channel is closed, otherwise false.
-func isClosed(ch <-chan struct{}) bool {
-	select {
-	case <-ch:
-		return true
-	default:
-		return false
-	}
-}
@@ -0,0 +1,395 @@
+package server
+
+import (
+	"airclipboard/server/cache"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	// 每个连接都会打印多行日志，测试中只关心结果
+	log.SetOutput(io.Discard)
+	cache.InitCache(cache.Config{CacheType: cache.CacheTypeMemory, CleanInterval: time.Hour})
+	os.Exit(m.Run())
+}
+
+// newTestPeerServer 启动只提供信令和中转接口的测试服务，返回信令的 WebSocket 地址
+func newTestPeerServer(t *testing.T) (*PeerServer, string) {
+	s := NewPeerServer()
+	r := gin.New()
+	r.GET("/server/webrtc", s.HandleConnection)
+	r.GET("/server/relay", s.HandleRelay)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return s, "ws" + strings.TrimPrefix(srv.URL, "http") + "/server/webrtc?v=1"
+}
+
+// dialPeer 以 ip 所在网络的身份连接，读取 hello 消息后返回连接和服务端分配的 peerId
+func dialPeer(url, ip string) (*websocket.Conn, string, error) {
+	conn, id, _, err := dialPeerSecret(url, ip)
+	return conn, id, err
+}
+
+// dialPeerSecret 与 dialPeer 相同，同时返回服务端颁发的设备密钥
+func dialPeerSecret(url, ip string) (*websocket.Conn, string, string, error) {
+	conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"X-Forwarded-For": {ip}})
+	if err != nil {
+		return nil, "", "", err
+	}
+	var secret string
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == peerSecretCookie {
+			secret = cookie.Value
+		}
+	}
+	var hello HelloMessage
+	if err := conn.ReadJSON(&hello); err != nil {
+		conn.Close()
+		return nil, "", "", err
+	}
+	if hello.Type != MessageHello || hello.PeerId == "" || secret == "" {
+		conn.Close()
+		return nil, "", "", fmt.Errorf("unexpected first message %+v", hello)
+	}
+	return conn, hello.PeerId, secret, nil
+}
+
+// dialRelay 以 peerId 和设备密钥连接中转接口
+func dialRelay(url, ip, peerId, secret, query string) (*websocket.Conn, error) {
+	url = strings.Replace(url, "/server/webrtc", "/server/relay", 1) + "&" + query
+	header := http.Header{
+		"X-Forwarded-For": {ip},
+		"Cookie":          {fmt.Sprintf("peerid=%s; %s=%s", peerId, peerSecretCookie, secret)},
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	return conn, err
+}
+
+// expectClose 读取连接直到收到关闭帧，返回关闭原因
+func expectClose(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) {
+				t.Fatalf("expected a close frame, got %v", err)
+			}
+			return closeErr.Text
+		}
+	}
+}
+
+func signalTo(to string) map[string]interface{} {
+	return map[string]interface{}{"type": MessageSignal, "to": to, "ice": map[string]interface{}{"candidate": "candidate:0"}}
+}
+
+// waitEmpty 等待所有 peer 离开后房间和剪贴板索引被清空
+func waitEmpty(t *testing.T, s *PeerServer) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		rooms, paired, boards := len(s.rooms), len(s.paired), len(s.boards)
+		s.mu.Unlock()
+		if rooms == 0 && paired == 0 && boards == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peers left behind: rooms=%d paired=%d boards=%d", rooms, paired, boards)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestPeerServerConcurrent 大量 peer 并发加入、离开、发送信令，其中部分 peer 读取缓慢，
+// 同时推送剪贴板事件，需配合 -race 运行。两个常驻的 peer 之间的信令不应因其他 peer 的变动而丢失
+func TestPeerServerConcurrent(t *testing.T) {
+	s, url := newTestPeerServer(t)
+
+	const signals = 50
+	sender, senderId, err := dialPeer(url, "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, receiverId, err := dialPeer(url, "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	received := make(chan error, 1)
+	go func() {
+		_ = receiver.SetReadDeadline(time.Now().Add(30 * time.Second))
+		for n := 0; n < signals; {
+			var msg SignalMessage
+			if err := receiver.ReadJSON(&msg); err != nil {
+				received <- fmt.Errorf("received %d of %d signals: %v", n, signals, err)
+				return
+			}
+			if msg.Type == MessageSignal {
+				if msg.Sender != senderId || msg.ICE == nil {
+					received <- fmt.Errorf("unexpected signal %+v", msg)
+					return
+				}
+				n++
+			}
+		}
+		received <- nil
+	}()
+	go func() {
+		// sender 丢弃其他 peer 的加入和离开消息
+		_ = sender.SetReadDeadline(time.Now().Add(30 * time.Second))
+		for {
+			if _, _, err := sender.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.onBoardEvent(BoardEvent{Type: BoardEventMessageAdded, Board: fmt.Sprintf("board%d", i%3), Id: fmt.Sprint(i)})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var churn sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		churn.Add(1)
+		go func(i int) {
+			defer churn.Done()
+			ip := fmt.Sprintf("10.0.0.%d", i%3)
+			for round := 0; round < 2; round++ {
+				conn, id, err := dialPeer(url, ip)
+				if err != nil {
+					t.Errorf("peer %d: %v", i, err)
+					return
+				}
+				slow := i%4 == 0
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					for {
+						if slow {
+							time.Sleep(20 * time.Millisecond)
+						}
+						if _, _, err := conn.NextReader(); err != nil {
+							return
+						}
+					}
+				}()
+				writes := []interface{}{
+					map[string]string{"type": MessagePong, "board": fmt.Sprintf("board%d", i%3)},
+					signalTo(senderId),
+					signalTo(id),
+					signalTo("missing"),
+					map[string]string{"type": MessageBoardUpdate, "board": fmt.Sprintf("board%d", i%3)},
+				}
+				for _, msg := range writes {
+					if err := conn.WriteJSON(msg); err != nil {
+						break
+					}
+				}
+				if i%2 == 0 {
+					_ = conn.WriteJSON(map[string]string{"type": MessageDisconnect})
+				}
+				conn.Close()
+				<-done
+			}
+		}(i)
+	}
+
+	for i := 0; i < signals; i++ {
+		if err := sender.WriteJSON(signalTo(receiverId)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-received; err != nil {
+		t.Fatal(err)
+	}
+
+	churn.Wait()
+	close(stop)
+	wg.Wait()
+	sender.Close()
+	receiver.Close()
+	waitEmpty(t, s)
+}
+
+// TestPeerServerSendDropsSlowConsumer 发送队列写满时断开 peer，而不是阻塞调用方
+func TestPeerServerSendDropsSlowConsumer(t *testing.T) {
+	s := &PeerServer{}
+	peer := &Peer{
+		id:         "slow",
+		outbox:     make(chan []byte, peerOutboxSize),
+		closing:    make(chan struct{}),
+		writerDone: make(chan struct{}),
+	}
+
+	for i := 0; i < peerOutboxSize; i++ {
+		s.send(peer, PingMessage{Type: MessagePing})
+	}
+	select {
+	case <-peer.closing:
+		t.Fatal("peer closed before its outbox was full")
+	default:
+	}
+
+	s.send(peer, PingMessage{Type: MessagePing})
+	select {
+	case <-peer.closing:
+	default:
+		t.Fatal("peer not closed after its outbox overflowed")
+	}
+	if want := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"); !bytes.Equal(peer.closeFrame, want) {
+		t.Fatalf("close frame = %q, want %q", peer.closeFrame, want)
+	}
+
+	// 已关闭的 peer 不再排队，也不会阻塞
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.send(peer, PingMessage{Type: MessagePing})
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("send blocked on a closed peer")
+	}
+}
+
+// TestPeerServerDisconnectsSlowReader 客户端不读取消息时服务端写入阻塞，发送队列写满后断开该客户端，
+// 同一房间的其他 peer 收到 peer-left
+func TestPeerServerDisconnectsSlowReader(t *testing.T) {
+	s, url := newTestPeerServer(t)
+
+	watcher, _, err := dialPeer(url, "10.0.0.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	slow, slowId, err := dialPeer(url, "10.0.0.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+
+	s.mu.Lock()
+	peer := s.rooms["10.0.0.9"][slowId]
+	s.mu.Unlock()
+	if peer == nil {
+		t.Fatal("slow peer not in its room")
+	}
+
+	// 消息足够大，填满 TCP 缓冲区后 writePump 阻塞，之后的消息在 outbox 中排队直至写满
+	payload := strings.Repeat("x", 32<<10)
+	deadline := time.After(10 * time.Second)
+	for closed := false; !closed; {
+		s.send(peer, BoardUpdateMessage{Type: MessageBoardUpdate, Board: payload})
+		select {
+		case <-peer.closing:
+			closed = true
+		case <-deadline:
+			t.Fatal("slow reader was not disconnected")
+		default:
+		}
+	}
+
+	// 阻塞中的写入在 peerWriteTimeout 后失败，连接随之关闭
+	_ = watcher.SetReadDeadline(time.Now().Add(peerWriteTimeout + 5*time.Second))
+	for {
+		var msg PeerLeftMessage
+		if err := watcher.ReadJSON(&msg); err != nil {
+			t.Fatalf("no peer-left for the slow reader: %v", err)
+		}
+		if msg.Type == MessagePeerLeft && msg.PeerId == slowId {
+			break
+		}
+	}
+}
+
+// TestRelayRequiresPeerSecret 中转以设备密钥确认身份，只知道其他设备的 peerId 无法冒用其发起或接入中转
+func TestRelayRequiresPeerSecret(t *testing.T) {
+	_, url := newTestPeerServer(t)
+	const ip = "10.0.0.8"
+
+	sender, senderId, senderSecret, err := dialPeerSecret(url, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	recipient, recipientId, recipientSecret, err := dialPeerSecret(url, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recipient.Close()
+
+	// peerid 对房间内的其他设备可见，但密钥不同
+	spoofed, err := dialRelay(url, ip, senderId, recipientSecret, "to="+recipientId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := expectClose(t, spoofed); reason != ErrCodePeerNotFound {
+		t.Fatalf("spoofed sender closed with %q, want %q", reason, ErrCodePeerNotFound)
+	}
+	spoofed.Close()
+
+	open, err := dialRelay(url, ip, senderId, senderSecret, "to="+recipientId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	_ = recipient.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg RelayMessage
+	for msg.Type != MessageRelay {
+		if err := recipient.ReadJSON(&msg); err != nil {
+			t.Fatalf("no relay message: %v", err)
+		}
+	}
+	if msg.Sender != senderId {
+		t.Fatalf("relay sender = %q, want %q", msg.Sender, senderId)
+	}
+
+	spoofed, err = dialRelay(url, ip, recipientId, senderSecret, "id="+msg.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := expectClose(t, spoofed); reason != ErrCodeRelayNotFound {
+		t.Fatalf("spoofed recipient closed with %q, want %q", reason, ErrCodeRelayNotFound)
+	}
+	spoofed.Close()
+
+	accept, err := dialRelay(url, ip, recipientId, recipientSecret, "id="+msg.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accept.Close()
+	var ready RelayReadyMessage
+	_ = open.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := open.ReadJSON(&ready); err != nil || ready.Type != MessageRelayReady {
+		t.Fatalf("relay not ready: %+v %v", ready, err)
+	}
+}
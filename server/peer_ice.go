@@ -0,0 +1,45 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"time"
+)
+
+// IceConfig 下发给客户端建立 WebRTC 连接时使用的 STUN/TURN 服务器。
+// TURN 使用 REST API 的共享密钥方案（coturn 的 use-auth-secret），服务端为每个 peer 生成有时效的凭据，不下发固定密码
+type IceConfig struct {
+	StunURLs   []string      // STUN 服务器，如 stun:stun.l.google.com:19302
+	TurnURLs   []string      // TURN 服务器，如 turn:turn.example.com:3478?transport=udp，为空时不使用 TURN
+	TurnSecret string        // 与 TURN 服务器共享的密钥，即 coturn 的 static-auth-secret
+	TurnTTL    time.Duration // TURN 凭据的有效期
+}
+
+var PeerIceConfig = IceConfig{
+	StunURLs: []string{"stun:stun.l.google.com:19302"},
+	TurnTTL:  time.Hour,
+}
+
+// iceServers 生成 peerId 使用的 ICE 服务器列表，TURN 凭据在 expiresAt 过期
+func iceServers(peerId string, now time.Time) (servers []IceServer, expiresAt time.Time) {
+	servers = make([]IceServer, 0, 2)
+	if len(PeerIceConfig.StunURLs) > 0 {
+		servers = append(servers, IceServer{URLs: PeerIceConfig.StunURLs})
+	}
+	if len(PeerIceConfig.TurnURLs) > 0 {
+		expiresAt = now.Add(PeerIceConfig.TurnTTL)
+		username, credential := turnCredential(PeerIceConfig.TurnSecret, peerId, expiresAt)
+		servers = append(servers, IceServer{URLs: PeerIceConfig.TurnURLs, Username: username, Credential: credential})
+	}
+	return servers, expiresAt
+}
+
+// turnCredential 按 TURN REST API 生成凭据：用户名为 "过期时间戳:peerId"，密码为以共享密钥对用户名做 HMAC-SHA1 后的 Base64
+func turnCredential(secret, peerId string, expiresAt time.Time) (username, credential string) {
+	username = strconv.FormatInt(expiresAt.Unix(), 10) + ":" + peerId
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
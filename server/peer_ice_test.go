@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// setIceConfig 在测试期间替换 ICE 服务器配置
+func setIceConfig(t *testing.T, config IceConfig) {
+	old := PeerIceConfig
+	PeerIceConfig = config
+	t.Cleanup(func() { PeerIceConfig = old })
+}
+
+// TestTurnCredential 与 coturn 按 use-auth-secret 计算的结果一致
+func TestTurnCredential(t *testing.T) {
+	username, credential := turnCredential("north", "peer-1", time.Unix(1700000000, 0))
+	if username != "1700000000:peer-1" || credential != "izFBtBN0tC8mfzbn9GsbjcqtfUw=" {
+		t.Fatalf("turnCredential = %q, %q", username, credential)
+	}
+	if _, other := turnCredential("south", "peer-1", time.Unix(1700000000, 0)); other == credential {
+		t.Fatal("credential does not depend on the secret")
+	}
+}
+
+func TestIceServers(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	setIceConfig(t, IceConfig{StunURLs: []string{"stun:a.example"}, TurnTTL: time.Hour})
+	servers, expiresAt := iceServers("peer-1", now)
+	if !reflect.DeepEqual(servers, []IceServer{{URLs: []string{"stun:a.example"}}}) || !expiresAt.IsZero() {
+		t.Fatalf("servers without TURN = %+v, expires at %v", servers, expiresAt)
+	}
+
+	setIceConfig(t, IceConfig{TurnURLs: []string{"turn:a.example:3478"}, TurnSecret: "north", TurnTTL: time.Hour})
+	servers, expiresAt = iceServers("peer-1", now)
+	username, credential := turnCredential("north", "peer-1", now.Add(time.Hour))
+	want := []IceServer{{URLs: []string{"turn:a.example:3478"}, Username: username, Credential: credential}}
+	if !reflect.DeepEqual(servers, want) || !expiresAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("servers with TURN = %+v, expires at %v", servers, expiresAt)
+	}
+}
+
+// TestRefreshIceServers 凭据剩余有效期不足 TurnTTL/2 时才下发新的凭据，未使用 TURN 时不下发
+func TestRefreshIceServers(t *testing.T) {
+	setIceConfig(t, IceConfig{TurnURLs: []string{"turn:a.example:3478"}, TurnSecret: "north", TurnTTL: time.Hour})
+	s := NewPeerServer()
+	peer := &Peer{id: "peer-1", outbox: make(chan []byte, 4), closing: make(chan struct{})}
+	now := time.Unix(1700000000, 0)
+
+	for _, remaining := range []time.Duration{0, 31 * time.Minute, 30 * time.Minute} {
+		peer.iceExpiresAt = time.Time{}
+		if remaining > 0 {
+			peer.iceExpiresAt = now.Add(remaining)
+		}
+		s.refreshIceServers(peer, now)
+		if len(peer.outbox) != 0 {
+			t.Fatalf("refreshed with %v remaining", remaining)
+		}
+	}
+
+	peer.iceExpiresAt = now.Add(29 * time.Minute)
+	s.refreshIceServers(peer, now)
+	if len(peer.outbox) != 1 {
+		t.Fatalf("%d messages sent with 29m remaining, want 1", len(peer.outbox))
+	}
+	var msg IceServersMessage
+	if err := json.Unmarshal(<-peer.outbox, &msg); err != nil {
+		t.Fatal(err)
+	}
+	username, credential := turnCredential("north", "peer-1", now.Add(time.Hour))
+	if msg.Type != MessageIceServers || len(msg.IceServers) != 1 || msg.IceServers[0].Username != username || msg.IceServers[0].Credential != credential {
+		t.Fatalf("refresh message = %+v", msg)
+	}
+	if !peer.iceExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("expires at %v after refresh, want %v", peer.iceExpiresAt, now.Add(time.Hour))
+	}
+
+	// 刚刷新过的凭据在下一次检查时不会再次下发
+	s.refreshIceServers(peer, now.Add(30*time.Second))
+	if len(peer.outbox) != 0 {
+		t.Fatal("refreshed again right after a refresh")
+	}
+}
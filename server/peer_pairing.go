@@ -0,0 +1,343 @@
+package server
+
+import (
+	"airclipboard/server/cache"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+const (
+	// pairingCodeTTL 配对码和二维码令牌的有效期
+	pairingCodeTTL = 2 * time.Minute
+	// pairedRoomTTL 配对关系的有效期，设备每次连接时重新计算
+	pairedRoomTTL = 30 * 24 * time.Hour
+	// pairingAttemptLimit 同一连接地址在 pairingAttemptWindow 内最多输错配对码的次数，防止穷举。
+	// 按连接的 RemoteAddr 计数，客户端可以伪造 CF-Connecting-IP 等请求头
+	pairingAttemptLimit  = 10
+	pairingAttemptWindow = 10 * time.Minute
+	// 配对码共 8 位数字，前 pairingSlotDigits 位标识发起方，后面为校验部分。
+	// 前缀命中但校验部分错误时计入该配对码，累计 pairingCodeMaxMisses 次后配对码失效，
+	// 无论攻击者使用多少个地址，每个配对码最多被猜测这么多次，且不影响其他配对码
+	pairingCodeDigits    = 8
+	pairingSlotDigits    = 4
+	pairingCodeMaxMisses = 5
+	// peerSecretCookie 服务端颁发的设备密钥，配对关系和中转以它确认设备身份。
+	// peerid 会通过 peers 消息发给其他设备，且由客户端提交，不能作为凭据
+	peerSecretCookie = "peersecret"
+)
+
+// pairing 一个等待另一台设备输入的配对码，code 和 token 只能使用一次
+type pairing struct {
+	code      string
+	token     string
+	peer      *Peer
+	room      string // 配对后双方所在的房间，发起方已配对时沿用其房间
+	expiresAt time.Time
+	misses    int // 前缀命中但校验部分错误的次数
+}
+
+// pairingFailures 一个连接地址输错配对码的次数
+type pairingFailures struct {
+	count   int
+	resetAt time.Time
+}
+
+// handlePairRequest 为 peer 生成配对码，同一 peer 之前的配对码随之失效
+func (s *PeerServer) handlePairRequest(peer *Peer) {
+	token, err := randomToken()
+	var newRoom string
+	if err == nil {
+		newRoom, err = randomToken()
+	}
+	if err != nil {
+		log.Printf("生成配对令牌失败，err=%v", err)
+		s.send(peer, ErrorMessage{Type: MessageError, Code: ErrCodeUnavailable, Message: "failed to create a pairing code", RequestType: MessagePairRequest})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweepPairings()
+	for _, p := range s.pairings {
+		if p.peer.id == peer.id {
+			s.removePairing(p)
+		}
+	}
+	code, err := s.newPairingCode()
+	if err != nil {
+		log.Printf("生成配对码失败，err=%v", err)
+		s.send(peer, ErrorMessage{Type: MessageError, Code: ErrCodeUnavailable, Message: "failed to create a pairing code", RequestType: MessagePairRequest})
+		return
+	}
+	room := peer.pairedRoom
+	if room == "" {
+		room = newRoom
+	}
+	p := &pairing{code: code, token: token, peer: peer, room: room, expiresAt: time.Now().Add(pairingCodeTTL)}
+	s.pairings[pairingSlot(p.code)] = p
+	s.pairingTokens[p.token] = p
+
+	s.send(peer, PairCodeMessage{
+		Type:      MessagePairCode,
+		Code:      p.code,
+		Token:     p.token,
+		ExpiresIn: int64(pairingCodeTTL / time.Second),
+	})
+}
+
+// handlePairJoin 使用另一台设备的配对码完成配对，双方的配对关系以各自的设备密钥保存在缓存中，重新连接后依然有效
+func (s *PeerServer) handlePairJoin(ctx context.Context, peer *Peer, msg *PairJoinMessage) {
+	s.mu.Lock()
+	s.sweepPairings()
+	if f := s.pairingFailures[peer.addr]; f != nil && f.count >= pairingAttemptLimit {
+		s.mu.Unlock()
+		s.send(peer, ErrorMessage{Type: MessageError, Code: ErrCodeTooManyAttempts, Message: "too many invalid pairing codes, please try again later", RequestType: MessagePairJoin})
+		return
+	}
+	var p *pairing
+	if msg.Token != "" {
+		p = s.pairingTokens[msg.Token]
+	} else if p = s.pairings[pairingSlot(msg.Code)]; p != nil && p.code != msg.Code {
+		s.recordPairingMiss(p)
+		p = nil
+	}
+	if p == nil || p.peer.id == peer.id {
+		f := s.pairingFailures[peer.addr]
+		if f == nil {
+			f = &pairingFailures{resetAt: time.Now().Add(pairingAttemptWindow)}
+			s.pairingFailures[peer.addr] = f
+		}
+		f.count++
+		s.mu.Unlock()
+		s.send(peer, ErrorMessage{Type: MessageError, Code: ErrCodeInvalidPairingCode, Message: "pairing code is invalid or expired", RequestType: MessagePairJoin})
+		return
+	}
+	s.removePairing(p)
+	s.mu.Unlock()
+
+	err := cache.SetPeerRoom(ctx, p.peer.credential, p.room, pairedRoomTTL)
+	if err == nil {
+		err = cache.SetPeerRoom(ctx, peer.credential, p.room, pairedRoomTTL)
+	}
+	if err != nil {
+		log.Printf("保存配对关系失败，err=%v", err)
+		s.send(peer, ErrorMessage{Type: MessageError, Code: ErrCodeUnavailable, Message: "failed to save the pairing, please try again later", RequestType: MessagePairJoin})
+		return
+	}
+	log.Printf("Peers paired: %s (ID: %s) and %s (ID: %s)", p.peer.ip, p.peer.id, peer.ip, peer.id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setPairedRoom(p.peer, p.room)
+	s.setPairedRoom(peer, p.room)
+	s.send(p.peer, PairedMessage{Type: MessagePaired, PeerId: peer.id})
+	s.send(peer, PairedMessage{Type: MessagePaired, PeerId: p.peer.id})
+}
+
+// recordPairingMiss 记录一次针对 p 的输错，达到 pairingCodeMaxMisses 时配对码失效并通知发起方重新生成，调用方需持有 s.mu
+func (s *PeerServer) recordPairingMiss(p *pairing) {
+	p.misses++
+	if p.misses >= pairingCodeMaxMisses {
+		s.removePairing(p)
+		s.send(p.peer, ErrorMessage{Type: MessageError, Code: ErrCodePairingCodeRevoked, Message: "pairing code revoked after too many invalid attempts, please request a new one", RequestType: MessagePairRequest})
+	}
+}
+
+// handleUnpair 将 peer 移出配对房间，房间内的其他设备仍然互相配对
+func (s *PeerServer) handleUnpair(ctx context.Context, peer *Peer) {
+	if err := cache.DeletePeerRoom(ctx, peer.credential); err != nil {
+		log.Printf("删除配对关系失败，err=%v", err)
+		s.send(peer, ErrorMessage{Type: MessageError, Code: ErrCodeUnavailable, Message: "failed to remove the pairing, please try again later", RequestType: MessageUnpair})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setPairedRoom(peer, "")
+}
+
+// visiblePeers 返回 peer 能看到的其他 peer，即同一 IP 的房间与配对房间的并集，调用方需持有 s.mu
+func (s *PeerServer) visiblePeers(peer *Peer) map[string]*Peer {
+	peers := make(map[string]*Peer)
+	for id, other := range s.rooms[peer.ip] {
+		if id != peer.id {
+			peers[id] = other
+		}
+	}
+	if peer.pairedRoom != "" {
+		for id, other := range s.paired[peer.pairedRoom] {
+			if id != peer.id {
+				peers[id] = other
+			}
+		}
+	}
+	return peers
+}
+
+// visiblePeer 在 peer 能看到的 peer 中查找 id，调用方需持有 s.mu
+func (s *PeerServer) visiblePeer(peer *Peer, id string) *Peer {
+	if other, exists := s.rooms[peer.ip][id]; exists {
+		return other
+	}
+	if peer.pairedRoom != "" {
+		return s.paired[peer.pairedRoom][id]
+	}
+	return nil
+}
+
+// setPairedRoom 修改 peer 所在的配对房间，在线时向因此互相可见或不再可见的 peer 发送 peer-joined 和 peer-left，调用方需持有 s.mu
+func (s *PeerServer) setPairedRoom(peer *Peer, room string) {
+	if peer.pairedRoom == room {
+		return
+	}
+	if s.rooms[peer.ip][peer.id] != peer {
+		// 已离开或尚未加入，下次加入时按新的房间处理
+		peer.pairedRoom = room
+		return
+	}
+
+	before := s.visiblePeers(peer)
+	s.removeFromPairedRoom(peer)
+	peer.pairedRoom = room
+	s.addToPairedRoom(peer)
+	after := s.visiblePeers(peer)
+
+	for id, other := range before {
+		if _, exists := after[id]; !exists {
+			s.send(other, PeerLeftMessage{Type: MessagePeerLeft, PeerId: peer.id})
+			s.send(peer, PeerLeftMessage{Type: MessagePeerLeft, PeerId: id})
+		}
+	}
+	for id, other := range after {
+		if _, exists := before[id]; !exists {
+			s.send(other, PeerJoinedMessage{Type: MessagePeerJoined, Peer: peer.info()})
+			s.send(peer, PeerJoinedMessage{Type: MessagePeerJoined, Peer: other.info()})
+		}
+	}
+}
+
+// addToPairedRoom 调用方需持有 s.mu
+func (s *PeerServer) addToPairedRoom(peer *Peer) {
+	if peer.pairedRoom == "" {
+		return
+	}
+	if _, exists := s.paired[peer.pairedRoom]; !exists {
+		s.paired[peer.pairedRoom] = make(map[string]*Peer)
+	}
+	s.paired[peer.pairedRoom][peer.id] = peer
+}
+
+// removeFromPairedRoom 调用方需持有 s.mu
+func (s *PeerServer) removeFromPairedRoom(peer *Peer) {
+	room, exists := s.paired[peer.pairedRoom]
+	if !exists || room[peer.id] != peer {
+		return
+	}
+	delete(room, peer.id)
+	if len(room) == 0 {
+		delete(s.paired, peer.pairedRoom)
+	}
+}
+
+// newPairingCode 生成前缀未被使用的 8 位数字配对码，调用方需持有 s.mu
+func (s *PeerServer) newPairingCode() (string, error) {
+	for {
+		n, err := rand.Int(rand.Reader, big.NewInt(100000000))
+		if err != nil {
+			return "", err
+		}
+		code := fmt.Sprintf("%0*d", pairingCodeDigits, n.Int64())
+		if _, exists := s.pairings[pairingSlot(code)]; !exists {
+			return code, nil
+		}
+	}
+}
+
+// pairingSlot 配对码中标识发起方的前缀
+func pairingSlot(code string) string {
+	if len(code) < pairingSlotDigits {
+		return code
+	}
+	return code[:pairingSlotDigits]
+}
+
+// removePairing 调用方需持有 s.mu
+func (s *PeerServer) removePairing(p *pairing) {
+	delete(s.pairings, pairingSlot(p.code))
+	delete(s.pairingTokens, p.token)
+}
+
+// sweepPairings 清理过期的配对码和输错次数，调用方需持有 s.mu
+func (s *PeerServer) sweepPairings() {
+	now := time.Now()
+	for _, p := range s.pairings {
+		if now.After(p.expiresAt) {
+			s.removePairing(p)
+		}
+	}
+	for addr, f := range s.pairingFailures {
+		if now.After(f.resetAt) {
+			delete(s.pairingFailures, addr)
+		}
+	}
+}
+
+// issuePeerSecret 读取请求中的设备密钥，没有或格式不对时生成新的密钥，每次连接都重新写入 Cookie 以延长有效期，
+// 返回密钥的摘要。Cookie 为 HttpOnly，页面脚本无法读取
+func issuePeerSecret(c *gin.Context) (string, error) {
+	secret, err := c.Cookie(peerSecretCookie)
+	if err != nil || !validPeerSecret(secret) {
+		if secret, err = randomToken(); err != nil {
+			return "", err
+		}
+	}
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(peerSecretCookie, secret, int(pairedRoomTTL.Seconds()), "/server/", "", false, true)
+	return peerCredential(secret), nil
+}
+
+// requestPeerCredential 返回请求中设备密钥的摘要，没有有效的密钥时返回空字符串
+func requestPeerCredential(c *gin.Context) string {
+	secret, err := c.Cookie(peerSecretCookie)
+	if err != nil || !validPeerSecret(secret) {
+		return ""
+	}
+	return peerCredential(secret)
+}
+
+// peerCredential 设备密钥的摘要，缓存和内存中只保存摘要
+func peerCredential(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// sameCredential 比较两个设备密钥的摘要，任一为空时返回 false
+func sameCredential(a, b string) bool {
+	return a != "" && b != "" && hmac.Equal([]byte(a), []byte(b))
+}
+
+// validPeerSecret 设备密钥是 randomToken 生成的 16 字节随机数
+func validPeerSecret(secret string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(secret)
+	return err == nil && len(b) == 16
+}
+
+// randomToken 生成二维码中使用的配对令牌、配对房间的 ID 以及设备密钥
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// readType 读取连接直到收到 typ 类型的消息
+func readType(t *testing.T, conn *websocket.Conn, typ string) map[string]interface{} {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("no %s message: %v", typ, err)
+		}
+		var msg map[string]interface{}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg["type"] == typ {
+			return msg
+		}
+	}
+}
+
+// requestPairCode 以 ip 所在网络的身份连接并请求配对码
+func requestPairCode(t *testing.T, url, ip string) (*websocket.Conn, string) {
+	t.Helper()
+	conn, _, err := dialPeer(url, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(map[string]interface{}{"type": MessagePairRequest}); err != nil {
+		t.Fatal(err)
+	}
+	return conn, readType(t, conn, MessagePairCode)["code"].(string)
+}
+
+// TestPairingMissesOnlyRevokeTargetedCode 针对一个配对码的输错只会使该配对码失效，其他用户的配对码仍然可用
+func TestPairingMissesOnlyRevokeTargetedCode(t *testing.T) {
+	_, url := newTestPeerServer(t)
+
+	victim, victimCode := requestPairCode(t, url, "10.1.0.1")
+	other, otherCode := requestPairCode(t, url, "10.2.0.1")
+	attacker, _, err := dialPeer(url, "10.3.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Close()
+
+	for i := 0; i < pairingCodeMaxMisses; i++ {
+		n, _ := strconv.Atoi(victimCode[pairingSlotDigits:])
+		guess := victimCode[:pairingSlotDigits] + fmt.Sprintf("%0*d", pairingCodeDigits-pairingSlotDigits, (n+i+1)%10000)
+		if err := attacker.WriteJSON(map[string]interface{}{"type": MessagePairJoin, "code": guess}); err != nil {
+			t.Fatal(err)
+		}
+		if code := readType(t, attacker, MessageError)["code"]; code != ErrCodeInvalidPairingCode {
+			t.Fatalf("guess %d answered with %v, want %s", i+1, code, ErrCodeInvalidPairingCode)
+		}
+	}
+	if code := readType(t, victim, MessageError)["code"]; code != ErrCodePairingCodeRevoked {
+		t.Fatalf("targeted code answered with %v, want %s", code, ErrCodePairingCodeRevoked)
+	}
+
+	joiner, _, err := dialPeer(url, "10.4.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer joiner.Close()
+	if err := joiner.WriteJSON(map[string]interface{}{"type": MessagePairJoin, "code": otherCode}); err != nil {
+		t.Fatal(err)
+	}
+	readType(t, joiner, MessagePaired)
+	readType(t, other, MessagePaired)
+}
@@ -0,0 +1,393 @@
+package server
+
+import (
+	"airclipboard/server/cache"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	// ProtocolVersion 当前的信令协议版本，客户端在连接地址的 v 参数中声明所用的版本
+	ProtocolVersion = 1
+	// MinProtocolVersion 仍兼容的最低版本，未携带 v 参数的旧客户端视为该版本
+	MinProtocolVersion = 1
+
+	// maxSignalMessageSize 客户端单条消息的大小上限，SDP 通常只有几 KB
+	maxSignalMessageSize = 64 << 10
+	// maxBoardNameLength 消息中剪贴板名称的长度上限
+	maxBoardNameLength = 64
+	// maxPairingTokenLength 二维码中配对令牌的长度上限
+	maxPairingTokenLength = 64
+)
+
+// 信令消息类型
+const (
+	MessageHello       = "hello"
+	MessagePeers       = "peers"
+	MessagePeerJoined  = "peer-joined"
+	MessagePeerLeft    = "peer-left"
+	MessageSignal      = "signal"
+	MessagePing        = "ping"
+	MessagePong        = "pong"
+	MessageDisplayName = "display-name"
+	MessageBoardUpdate = "board-update"
+	MessageDisconnect  = "disconnect"
+	MessageError       = "error"
+	MessagePairRequest = "pair-request"
+	MessagePairCode    = "pair-code"
+	MessagePairJoin    = "pair-join"
+	MessagePaired      = "paired"
+	MessageUnpair      = "unpair"
+	MessageRelay       = "relay"
+	MessageRelayReady  = "relay-ready"
+	MessageIceServers  = "ice-servers"
+)
+
+// error 消息中的错误码
+const (
+	ErrCodeUnsupportedVersion = "unsupported-version"
+	ErrCodeMessageTooLarge    = "message-too-large"
+	ErrCodeInvalidMessage     = "invalid-message"
+	ErrCodeUnknownType        = "unknown-type"
+	ErrCodePeerNotFound       = "peer-not-found"
+	ErrCodeInvalidPairingCode = "invalid-pairing-code"
+	ErrCodeTooManyAttempts    = "too-many-attempts"
+	ErrCodePairingCodeRevoked = "pairing-code-revoked"
+	ErrCodeUnavailable        = "unavailable"
+	ErrCodeRelayNotFound      = "relay-not-found"
+	ErrCodeRelayTimeout       = "relay-timeout"
+	ErrCodeTransferTooLarge   = "transfer-too-large"
+)
+
+// PeerName 根据 User-Agent 识别的设备信息
+type PeerName struct {
+	Model       string `json:"model"`
+	OS          string `json:"os"`
+	Browser     string `json:"browser"`
+	DeviceType  string `json:"deviceType"`
+	DeviceName  string `json:"deviceName"`
+	DisplayName string `json:"displayName"`
+}
+
+// PeerInfo peers 和 peer-joined 消息中的设备信息，不包含设备的 IP，配对房间中的设备可能来自其他网络
+type PeerInfo struct {
+	Id           string    `json:"id"`
+	RtcSupported bool      `json:"rtcSupported"`
+	Name         *PeerName `json:"name"`
+}
+
+// HelloMessage 连接建立后服务端发送的第一条消息，告知协商后的协议版本、是否已与其他设备配对以及建立 WebRTC 连接使用的 ICE 服务器
+type HelloMessage struct {
+	Type       string      `json:"type"`
+	Version    int         `json:"version"`
+	PeerId     string      `json:"peerId"`
+	Paired     bool        `json:"paired"`
+	IceServers []IceServer `json:"iceServers"`
+}
+
+// IceServer 对应浏览器 RTCIceServer 的 JSON 形式
+type IceServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// IceServersMessage TURN 凭据过期前下发的新 ICE 服务器列表
+type IceServersMessage struct {
+	Type       string      `json:"type"`
+	IceServers []IceServer `json:"iceServers"`
+}
+
+// PeersMessage 加入房间时发送给新 peer 的房间内其他 peer
+type PeersMessage struct {
+	Type  string     `json:"type"`
+	Peers []PeerInfo `json:"peers"`
+}
+
+type PeerJoinedMessage struct {
+	Type string   `json:"type"`
+	Peer PeerInfo `json:"peer"`
+}
+
+type PeerLeftMessage struct {
+	Type   string `json:"type"`
+	PeerId string `json:"peerId"`
+}
+
+// SignalMessage WebRTC 信令，客户端发送时以 to 指定接收方，服务端转发时改为 sender。sdp 和 ice 有且只有一个
+type SignalMessage struct {
+	Type   string              `json:"type"`
+	To     string              `json:"to,omitempty"`
+	Sender string              `json:"sender,omitempty"`
+	SDP    *SessionDescription `json:"sdp,omitempty"`
+	ICE    *IceCandidate       `json:"ice,omitempty"`
+}
+
+// SessionDescription 对应浏览器 RTCSessionDescription 的 JSON 形式
+type SessionDescription struct {
+	Type string `json:"type"`
+	SDP  string `json:"sdp"`
+}
+
+// IceCandidate 对应浏览器 RTCIceCandidate 的 JSON 形式
+type IceCandidate struct {
+	Candidate        string  `json:"candidate"`
+	SdpMid           *string `json:"sdpMid"`
+	SdpMLineIndex    *int    `json:"sdpMLineIndex"`
+	UsernameFragment *string `json:"usernameFragment"`
+}
+
+type PingMessage struct {
+	Type  string `json:"type"`
+	Board string `json:"board"`
+}
+
+// PongMessage 客户端对 ping 的回复，同时上报正在查看的剪贴板
+type PongMessage struct {
+	Type  string `json:"type"`
+	Board string `json:"board"`
+}
+
+type DisplayNameMessage struct {
+	Type    string      `json:"type"`
+	Message DisplayName `json:"message"`
+}
+
+type DisplayName struct {
+	DisplayName string `json:"displayName"`
+	DeviceName  string `json:"deviceName"`
+}
+
+// BoardUpdateMessage 剪贴板变更通知。客户端发送时只带 board，服务端推送写入接口发布的事件时带上事件详情
+type BoardUpdateMessage struct {
+	Type     string         `json:"type"`
+	Board    string         `json:"board"`
+	Event    string         `json:"event,omitempty"`
+	Id       string         `json:"id,omitempty"`
+	ExpireAt string         `json:"expireAt,omitempty"`
+	Message  *cache.Message `json:"message,omitempty"`
+}
+
+// DisconnectMessage 客户端主动离开
+type DisconnectMessage struct {
+	Type string `json:"type"`
+}
+
+// PairRequestMessage 客户端请求一个配对码，供其他网络中的设备输入
+type PairRequestMessage struct {
+	Type string `json:"type"`
+}
+
+// PairCodeMessage 对 pair-request 的回复，code 供手动输入，token 用于生成二维码，expiresIn 为有效秒数
+type PairCodeMessage struct {
+	Type      string `json:"type"`
+	Code      string `json:"code"`
+	Token     string `json:"token"`
+	ExpiresIn int64  `json:"expiresIn"`
+}
+
+// PairJoinMessage 客户端使用另一台设备的配对码完成配对，code 和 token 有且只有一个
+type PairJoinMessage struct {
+	Type  string `json:"type"`
+	Code  string `json:"code,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+// PairedMessage 配对完成后发送给双方，peerId 为对方的 ID
+type PairedMessage struct {
+	Type   string `json:"type"`
+	PeerId string `json:"peerId"`
+}
+
+// UnpairMessage 客户端解除自己的配对
+type UnpairMessage struct {
+	Type string `json:"type"`
+}
+
+// RelayMessage 通知接收方 sender 发起了中转，接收方以 id 连接 /server/relay 接受
+type RelayMessage struct {
+	Type   string `json:"type"`
+	Sender string `json:"sender"`
+	Id     string `json:"id"`
+}
+
+// RelayReadyMessage 接收方接入后在中转连接上发送给发送方，之后的消息均来自接收方
+type RelayReadyMessage struct {
+	Type string `json:"type"`
+}
+
+// ServerRestartingMessage 服务即将重启，客户端在 reconnectAfter 毫秒后重连
+type ServerRestartingMessage struct {
+	Type           string `json:"type"`
+	ReconnectAfter int64  `json:"reconnectAfter"`
+}
+
+// ErrorMessage 客户端的消息无法处理时的回复，requestType 为出错的消息类型
+type ErrorMessage struct {
+	Type        string `json:"type"`
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+	RequestType string `json:"requestType,omitempty"`
+}
+
+// ProtocolError 客户端违反信令协议，以 error 消息回复
+type ProtocolError struct {
+	Code        string
+	Message     string
+	RequestType string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func (e *ProtocolError) reply() ErrorMessage {
+	return ErrorMessage{Type: MessageError, Code: e.Code, Message: e.Message, RequestType: e.RequestType}
+}
+
+// negotiateVersion 根据客户端声明的版本确定使用的协议版本，客户端版本较新时按服务端的版本通信
+func negotiateVersion(v string) (int, error) {
+	if v == "" {
+		return MinProtocolVersion, nil
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil || version < MinProtocolVersion {
+		return 0, &ProtocolError{
+			Code:    ErrCodeUnsupportedVersion,
+			Message: fmt.Sprintf("protocol version %q is not supported, use %d to %d", v, MinProtocolVersion, ProtocolVersion),
+		}
+	}
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	return version, nil
+}
+
+// clientMessage 客户端可以发送的消息
+type clientMessage interface {
+	validate() error
+}
+
+// parseClientMessage 解析并校验客户端发送的消息，不允许未知的消息类型和字段，返回的错误均为 *ProtocolError
+func parseClientMessage(data []byte) (clientMessage, error) {
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, &ProtocolError{Code: ErrCodeInvalidMessage, Message: "message must be a JSON object"}
+	}
+
+	var msg clientMessage
+	switch envelope.Type {
+	case MessagePong:
+		msg = &PongMessage{}
+	case MessageSignal:
+		msg = &SignalMessage{}
+	case MessageBoardUpdate:
+		msg = &BoardUpdateMessage{}
+	case MessageDisconnect:
+		msg = &DisconnectMessage{}
+	case MessagePairRequest:
+		msg = &PairRequestMessage{}
+	case MessagePairJoin:
+		msg = &PairJoinMessage{}
+	case MessageUnpair:
+		msg = &UnpairMessage{}
+	case "":
+		return nil, &ProtocolError{Code: ErrCodeInvalidMessage, Message: "type is required"}
+	default:
+		return nil, &ProtocolError{Code: ErrCodeUnknownType, Message: "unknown message type", RequestType: envelope.Type}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(msg)
+	if err == nil {
+		if _, err = dec.Token(); errors.Is(err, io.EOF) {
+			err = msg.validate()
+		} else {
+			err = errors.New("unexpected data after the message")
+		}
+	}
+	if err != nil {
+		return nil, &ProtocolError{Code: ErrCodeInvalidMessage, Message: err.Error(), RequestType: envelope.Type}
+	}
+	return msg, nil
+}
+
+func validateBoardName(board string) error {
+	if len(board) > maxBoardNameLength {
+		return fmt.Errorf("board must not be longer than %d bytes", maxBoardNameLength)
+	}
+	return nil
+}
+
+func (m *PongMessage) validate() error {
+	return validateBoardName(m.Board)
+}
+
+func (m *BoardUpdateMessage) validate() error {
+	if m.Board == "" {
+		return errors.New("board is required")
+	}
+	if m.Event != "" || m.Id != "" || m.ExpireAt != "" || m.Message != nil {
+		return errors.New("only board can be set")
+	}
+	return validateBoardName(m.Board)
+}
+
+func (m *SignalMessage) validate() error {
+	if m.To == "" {
+		return errors.New("to is required")
+	}
+	if m.Sender != "" {
+		return errors.New("sender is set by the server")
+	}
+	if (m.SDP == nil) == (m.ICE == nil) {
+		return errors.New("exactly one of sdp and ice is required")
+	}
+	if m.SDP != nil {
+		switch m.SDP.Type {
+		case "offer", "answer", "pranswer", "rollback":
+		default:
+			return fmt.Errorf("invalid sdp type %q", m.SDP.Type)
+		}
+	}
+	return nil
+}
+
+func (m *DisconnectMessage) validate() error {
+	return nil
+}
+
+func (m *PairRequestMessage) validate() error {
+	return nil
+}
+
+func (m *PairJoinMessage) validate() error {
+	if (m.Code == "") == (m.Token == "") {
+		return errors.New("exactly one of code and token is required")
+	}
+	if m.Code != "" {
+		if len(m.Code) != pairingCodeDigits {
+			return fmt.Errorf("code must be %d digits", pairingCodeDigits)
+		}
+		for _, c := range m.Code {
+			if c < '0' || c > '9' {
+				return fmt.Errorf("code must be %d digits", pairingCodeDigits)
+			}
+		}
+	}
+	if len(m.Token) > maxPairingTokenLength {
+		return fmt.Errorf("token must not be longer than %d bytes", maxPairingTokenLength)
+	}
+	return nil
+}
+
+func (m *UnpairMessage) validate() error {
+	return nil
+}
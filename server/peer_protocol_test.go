@@ -0,0 +1,142 @@
+package server
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		v    string
+		want int
+		ok   bool
+	}{
+		{"", MinProtocolVersion, true},
+		{"1", 1, true},
+		// 客户端版本较新时按服务端的版本通信
+		{"2", ProtocolVersion, true},
+		{"100", ProtocolVersion, true},
+		{"0", 0, false},
+		{"-1", 0, false},
+		{"1.0", 0, false},
+		{"v1", 0, false},
+		{" 1", 0, false},
+	}
+	for _, tt := range tests {
+		version, err := negotiateVersion(tt.v)
+		if !tt.ok {
+			var perr *ProtocolError
+			if !errors.As(err, &perr) || perr.Code != ErrCodeUnsupportedVersion {
+				t.Errorf("negotiateVersion(%q) error = %v, want %s", tt.v, err, ErrCodeUnsupportedVersion)
+			}
+			continue
+		}
+		if err != nil || version != tt.want {
+			t.Errorf("negotiateVersion(%q) = %d, %v, want %d", tt.v, version, err, tt.want)
+		}
+	}
+}
+
+// TestParseClientMessage 每种消息类型的解析结果和校验错误，错误均为带错误码和消息类型的 *ProtocolError
+func TestParseClientMessage(t *testing.T) {
+	long := strings.Repeat("a", 65)
+	tests := []struct {
+		name        string
+		data        string
+		want        clientMessage
+		code        string
+		message     string
+		requestType string
+	}{
+		{name: "not json", data: `hello`, code: ErrCodeInvalidMessage, message: "message must be a JSON object"},
+		{name: "not an object", data: `["pong"]`, code: ErrCodeInvalidMessage, message: "message must be a JSON object"},
+		{name: "missing type", data: `{"board":"a"}`, code: ErrCodeInvalidMessage, message: "type is required"},
+		{name: "unknown type", data: `{"type":"hello"}`, code: ErrCodeUnknownType, message: "unknown message type", requestType: "hello"},
+		{name: "unknown field", data: `{"type":"pong","board":"a","extra":1}`, code: ErrCodeInvalidMessage, message: `unknown field "extra"`, requestType: MessagePong},
+		{name: "wrong field type", data: `{"type":"pong","board":1}`, code: ErrCodeInvalidMessage, message: "cannot unmarshal number", requestType: MessagePong},
+		{name: "trailing data", data: `{"type":"pong"} {"type":"pong"}`, code: ErrCodeInvalidMessage, message: "message must be a JSON object"},
+
+		{name: "pong", data: `{"type":"pong","board":"a"}`, want: &PongMessage{Type: MessagePong, Board: "a"}},
+		{name: "pong without board", data: `{"type":"pong"}`, want: &PongMessage{Type: MessagePong}},
+		{name: "pong with long board", data: `{"type":"pong","board":"` + long + `"}`, code: ErrCodeInvalidMessage, message: "board must not be longer than 64 bytes", requestType: MessagePong},
+
+		{name: "board-update", data: `{"type":"board-update","board":"a"}`, want: &BoardUpdateMessage{Type: MessageBoardUpdate, Board: "a"}},
+		{name: "board-update without board", data: `{"type":"board-update"}`, code: ErrCodeInvalidMessage, message: "board is required", requestType: MessageBoardUpdate},
+		{name: "board-update with event", data: `{"type":"board-update","board":"a","event":"add"}`, code: ErrCodeInvalidMessage, message: "only board can be set", requestType: MessageBoardUpdate},
+		{name: "board-update with message", data: `{"type":"board-update","board":"a","message":{}}`, code: ErrCodeInvalidMessage, message: "only board can be set", requestType: MessageBoardUpdate},
+		{name: "board-update with long board", data: `{"type":"board-update","board":"` + long + `"}`, code: ErrCodeInvalidMessage, message: "board must not be longer than 64 bytes", requestType: MessageBoardUpdate},
+
+		{name: "signal sdp", data: `{"type":"signal","to":"p","sdp":{"type":"offer","sdp":"v=0"}}`, want: &SignalMessage{Type: MessageSignal, To: "p", SDP: &SessionDescription{Type: "offer", SDP: "v=0"}}},
+		{name: "signal ice", data: `{"type":"signal","to":"p","ice":{"candidate":"c","sdpMid":null,"sdpMLineIndex":null,"usernameFragment":null}}`, want: &SignalMessage{Type: MessageSignal, To: "p", ICE: &IceCandidate{Candidate: "c"}}},
+		{name: "signal without to", data: `{"type":"signal","sdp":{"type":"offer","sdp":""}}`, code: ErrCodeInvalidMessage, message: "to is required", requestType: MessageSignal},
+		{name: "signal with sender", data: `{"type":"signal","to":"p","sender":"q","sdp":{"type":"offer","sdp":""}}`, code: ErrCodeInvalidMessage, message: "sender is set by the server", requestType: MessageSignal},
+		{name: "signal without payload", data: `{"type":"signal","to":"p"}`, code: ErrCodeInvalidMessage, message: "exactly one of sdp and ice is required", requestType: MessageSignal},
+		{name: "signal with both payloads", data: `{"type":"signal","to":"p","sdp":{"type":"offer","sdp":""},"ice":{"candidate":""}}`, code: ErrCodeInvalidMessage, message: "exactly one of sdp and ice is required", requestType: MessageSignal},
+		{name: "signal with invalid sdp type", data: `{"type":"signal","to":"p","sdp":{"type":"hello","sdp":""}}`, code: ErrCodeInvalidMessage, message: `invalid sdp type "hello"`, requestType: MessageSignal},
+		{name: "signal with unknown sdp field", data: `{"type":"signal","to":"p","sdp":{"type":"offer","sdp":"","extra":1}}`, code: ErrCodeInvalidMessage, message: `unknown field "extra"`, requestType: MessageSignal},
+
+		{name: "disconnect", data: `{"type":"disconnect"}`, want: &DisconnectMessage{Type: MessageDisconnect}},
+		{name: "disconnect with field", data: `{"type":"disconnect","board":"a"}`, code: ErrCodeInvalidMessage, message: `unknown field "board"`, requestType: MessageDisconnect},
+		{name: "pair-request", data: `{"type":"pair-request"}`, want: &PairRequestMessage{Type: MessagePairRequest}},
+		{name: "unpair", data: `{"type":"unpair"}`, want: &UnpairMessage{Type: MessageUnpair}},
+
+		{name: "pair-join code", data: `{"type":"pair-join","code":"01234567"}`, want: &PairJoinMessage{Type: MessagePairJoin, Code: "01234567"}},
+		{name: "pair-join token", data: `{"type":"pair-join","token":"abc"}`, want: &PairJoinMessage{Type: MessagePairJoin, Token: "abc"}},
+		{name: "pair-join without code", data: `{"type":"pair-join"}`, code: ErrCodeInvalidMessage, message: "exactly one of code and token is required", requestType: MessagePairJoin},
+		{name: "pair-join with both", data: `{"type":"pair-join","code":"01234567","token":"abc"}`, code: ErrCodeInvalidMessage, message: "exactly one of code and token is required", requestType: MessagePairJoin},
+		{name: "pair-join short code", data: `{"type":"pair-join","code":"0123"}`, code: ErrCodeInvalidMessage, message: "code must be 8 digits", requestType: MessagePairJoin},
+		{name: "pair-join non-digit code", data: `{"type":"pair-join","code":"0123456a"}`, code: ErrCodeInvalidMessage, message: "code must be 8 digits", requestType: MessagePairJoin},
+		{name: "pair-join long token", data: `{"type":"pair-join","token":"` + long + `"}`, code: ErrCodeInvalidMessage, message: "token must not be longer than 64 bytes", requestType: MessagePairJoin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := parseClientMessage([]byte(tt.data))
+			if tt.want != nil {
+				if err != nil || !reflect.DeepEqual(msg, tt.want) {
+					t.Fatalf("parseClientMessage() = %+v, %v, want %+v", msg, err, tt.want)
+				}
+				return
+			}
+			var perr *ProtocolError
+			if !errors.As(err, &perr) {
+				t.Fatalf("parseClientMessage() = %+v, %v, want a *ProtocolError", msg, err)
+			}
+			if perr.Code != tt.code || !strings.Contains(perr.Message, tt.message) || perr.RequestType != tt.requestType {
+				t.Fatalf("error = %+v, want code %s, message %q, request type %q", perr, tt.code, tt.message, tt.requestType)
+			}
+		})
+	}
+}
+
+// TestHandshakeVersion 未携带 v 参数时按最低版本通信，不支持的版本回复错误后断开
+func TestHandshakeVersion(t *testing.T) {
+	_, url := newTestPeerServer(t)
+	base := strings.TrimSuffix(url, "?v=1")
+
+	conn, _, err := websocket.DefaultDialer.Dial(base, http.Header{"X-Forwarded-For": {"10.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hello HelloMessage
+	if err = conn.ReadJSON(&hello); err != nil || hello.Type != MessageHello || hello.Version != MinProtocolVersion {
+		t.Fatalf("hello without v = %+v, %v", hello, err)
+	}
+	conn.Close()
+
+	conn, _, err = websocket.DefaultDialer.Dial(base+"?v=0", http.Header{"X-Forwarded-For": {"10.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var reply ErrorMessage
+	if err = conn.ReadJSON(&reply); err != nil || reply.Type != MessageError || reply.Code != ErrCodeUnsupportedVersion {
+		t.Fatalf("reply to v=0 = %+v, %v", reply, err)
+	}
+	if reason := expectClose(t, conn); reason != "unsupported protocol version" {
+		t.Fatalf("close reason = %q", reason)
+	}
+}
@@ -0,0 +1,311 @@
+package server
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RelayLimits 服务端中转传输的限制。浏览器不支持 WebRTC 或无法直连时，文件经 /server/relay 中转
+type RelayLimits struct {
+	MaxTransferBytes int64         // 单次中转每个方向最多转发的字节数
+	Bandwidth        int64         // 单次中转每秒转发的字节数上限，0 表示不限制
+	TotalBandwidth   int64         // 所有中转每秒转发的字节数之和的上限，0 表示不限制
+	AcceptTimeout    time.Duration // 等待接收方接入的时间
+}
+
+var PeerRelayLimits = RelayLimits{
+	MaxTransferBytes: 1 << 30,  // 1GB
+	Bandwidth:        4 << 20,  // 4MB/s
+	TotalBandwidth:   32 << 20, // 32MB/s
+	AcceptTimeout:    30 * time.Second,
+}
+
+// relayIdleTimeout 中转连接超过该时间没有收到消息，或一条消息超过该时间仍未写完时断开
+const relayIdleTimeout = 2 * time.Minute
+
+var (
+	errTransferTooLarge = errors.New("transfer too large")
+	// errRelayClosed 中转在接收方接入前已关闭，关闭帧已发送
+	errRelayClosed = errors.New("relay closed")
+)
+
+// relay 一次中转传输。发送方连接 /server/relay?to=<peerId> 后，服务端通过信令通知接收方以 id 接入。
+// 之后两个连接各自读取自己的 socket 并写入对方的 socket，写入阻塞时不再读取，由 TCP 将压力传回发送方
+type relay struct {
+	id        string
+	sender    string
+	recipient string
+	// recipientCredential 接收方的设备密钥摘要，接入时核对，防止其他设备冒用接收方的 peerId
+	recipientCredential string
+	senderConn          *websocket.Conn
+	accepted            chan struct{}     // 接收方接入后关闭
+	limiter             *bandwidthLimiter // 两个方向共用
+	done                chan struct{}
+	closeOnce           sync.Once
+
+	mu            sync.Mutex
+	recipientConn *websocket.Conn
+}
+
+// HandleRelay 建立中转连接，带 to 参数时向该 peer 发起，带 id 参数时接受 relay 消息中的中转。
+// 双方必须是在线且互相可见的 peer，并携带信令连接时颁发的设备密钥，错误码通过关闭帧的 reason 返回
+func (s *PeerServer) HandleRelay(c *gin.Context) {
+	peerId, err := c.Cookie("peerid")
+	credential := requestPeerCredential(c)
+	if err != nil || peerId == "" || credential == "" {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	closing := s.closing
+	s.mu.Unlock()
+	if closing {
+		c.Status(http.StatusServiceUnavailable)
+		return
+	}
+
+	socket, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Println("Upgrade error:", err)
+		return
+	}
+	defer socket.Close()
+
+	if _, err := negotiateVersion(c.Query("v")); err != nil {
+		writeClose(socket, websocket.CloseProtocolError, ErrCodeUnsupportedVersion)
+		return
+	}
+
+	var r *relay
+	var dst *websocket.Conn
+	from, to := peerId, ""
+	if id := c.Query("id"); id != "" {
+		r, dst, err = s.acceptRelay(id, peerId, credential, socket)
+		if r != nil {
+			to = r.sender
+		}
+	} else {
+		r, dst, err = s.openRelay(peerIP(c), peerId, credential, c.Query("to"), socket)
+		if r != nil {
+			defer s.removeRelay(r)
+			to = r.recipient
+		}
+	}
+	if err != nil {
+		var perr *ProtocolError
+		if errors.As(err, &perr) {
+			writeClose(socket, websocket.ClosePolicyViolation, perr.Code)
+		}
+		return
+	}
+
+	n, err := r.pipe(socket, dst, s.relayBandwidth)
+	log.Printf("Relay %s: %s -> %s finished, %d bytes", r.id, from, to, n)
+	if errors.Is(err, errTransferTooLarge) {
+		// 发送方还有未读取的数据，直接断开会触发 TCP RST，客户端收不到关闭帧
+		writeClose(socket, websocket.CloseMessageTooBig, ErrCodeTransferTooLarge)
+		_ = socket.SetReadDeadline(time.Now().Add(shutdownWriteTimeout))
+		for {
+			if _, _, err := socket.NextReader(); err != nil {
+				break
+			}
+		}
+		r.close(websocket.CloseMessageTooBig, ErrCodeTransferTooLarge)
+	} else {
+		r.close(websocket.CloseNormalClosure, "")
+	}
+}
+
+// openRelay 通知接收方并等待其接入，返回接收方的连接
+func (s *PeerServer) openRelay(ip, peerId, credential, to string, socket *websocket.Conn) (*relay, *websocket.Conn, error) {
+	id, err := randomToken()
+	if err != nil {
+		log.Printf("生成中转 ID 失败，err=%v", err)
+		return nil, nil, &ProtocolError{Code: ErrCodeUnavailable, Message: "failed to create a relay"}
+	}
+
+	s.mu.Lock()
+	var recipient *Peer
+	if sender := s.rooms[ip][peerId]; sender != nil && sameCredential(sender.credential, credential) {
+		recipient = s.visiblePeer(sender, to)
+	}
+	if recipient == nil {
+		s.mu.Unlock()
+		return nil, nil, &ProtocolError{Code: ErrCodePeerNotFound, Message: "peer not found"}
+	}
+	r := &relay{
+		id:                  id,
+		sender:              peerId,
+		recipient:           recipient.id,
+		recipientCredential: recipient.credential,
+		senderConn:          socket,
+		accepted:            make(chan struct{}),
+		limiter:             newBandwidthLimiter(PeerRelayLimits.Bandwidth),
+		done:                make(chan struct{}),
+	}
+	s.relays[id] = r
+	s.send(recipient, RelayMessage{Type: MessageRelay, Sender: peerId, Id: id})
+	s.mu.Unlock()
+
+	timer := time.NewTimer(PeerRelayLimits.AcceptTimeout)
+	defer timer.Stop()
+	select {
+	case <-r.accepted:
+		log.Printf("Relay %s: %s -> %s opened", r.id, r.sender, r.recipient)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r, r.recipientConn, nil
+	case <-timer.C:
+		s.removeRelay(r)
+		r.close(websocket.CloseTryAgainLater, ErrCodeRelayTimeout)
+		return nil, nil, errRelayClosed
+	case <-r.done:
+		s.removeRelay(r)
+		return nil, nil, errRelayClosed
+	}
+}
+
+// acceptRelay 接收方接入 id 对应的中转，先告知发送方可以开始发送，返回发送方的连接
+func (s *PeerServer) acceptRelay(id, peerId, credential string, socket *websocket.Conn) (*relay, *websocket.Conn, error) {
+	s.mu.Lock()
+	r := s.relays[id]
+	s.mu.Unlock()
+	if r == nil || r.recipient != peerId || !sameCredential(r.recipientCredential, credential) {
+		return nil, nil, &ProtocolError{Code: ErrCodeRelayNotFound, Message: "relay not found"}
+	}
+
+	r.mu.Lock()
+	if r.recipientConn != nil {
+		r.mu.Unlock()
+		return nil, nil, &ProtocolError{Code: ErrCodeRelayNotFound, Message: "relay not found"}
+	}
+	r.recipientConn = socket
+	r.mu.Unlock()
+
+	// 发送方的 socket 只由接收方的协程写入
+	_ = r.senderConn.SetWriteDeadline(time.Now().Add(peerWriteTimeout))
+	if err := r.senderConn.WriteJSON(RelayReadyMessage{Type: MessageRelayReady}); err != nil {
+		r.close(websocket.CloseGoingAway, "")
+		return nil, nil, errRelayClosed
+	}
+	close(r.accepted)
+	return r, r.senderConn, nil
+}
+
+// pipe 将 src 的消息原样转发给 dst，直到任意一方断开，返回转发的字节数。
+// 写入 dst 阻塞或触发限速时不再读取 src，total 为所有中转共用的限速
+func (r *relay) pipe(src, dst *websocket.Conn, total *bandwidthLimiter) (int64, error) {
+	reader := &relayReader{
+		remaining: PeerRelayLimits.MaxTransferBytes,
+		limiters:  []*bandwidthLimiter{r.limiter, total},
+	}
+	for {
+		_ = src.SetReadDeadline(time.Now().Add(relayIdleTimeout))
+		messageType, message, err := src.NextReader()
+		if err != nil {
+			return reader.n, nil
+		}
+		_ = dst.SetWriteDeadline(time.Now().Add(relayIdleTimeout))
+		w, err := dst.NextWriter(messageType)
+		if err != nil {
+			return reader.n, err
+		}
+		reader.r = message
+		_, err = io.Copy(w, reader)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			return reader.n, err
+		}
+	}
+}
+
+// close 向双方发送关闭帧并断开连接，可重复调用
+func (r *relay) close(code int, reason string) {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.mu.Lock()
+		conns := []*websocket.Conn{r.senderConn, r.recipientConn}
+		r.mu.Unlock()
+		for _, conn := range conns {
+			if conn != nil {
+				writeClose(conn, code, reason)
+				_ = conn.Close()
+			}
+		}
+	})
+}
+
+func (s *PeerServer) removeRelay(r *relay) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.relays[r.id] == r {
+		delete(s.relays, r.id)
+	}
+}
+
+// writeClose 发送关闭帧，reason 为错误码
+func writeClose(conn *websocket.Conn, code int, reason string) {
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(shutdownWriteTimeout))
+}
+
+// relayReader 统计转发的字节数，超过 remaining 时返回 errTransferTooLarge，并按带宽限速
+type relayReader struct {
+	r         io.Reader
+	n         int64
+	remaining int64
+	limiters  []*bandwidthLimiter
+}
+
+func (rr *relayReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if int64(n) > rr.remaining {
+		return 0, errTransferTooLarge
+	}
+	rr.n += int64(n)
+	rr.remaining -= int64(n)
+	for _, l := range rr.limiters {
+		l.wait(n)
+	}
+	return n, err
+}
+
+// bandwidthLimiter 按每秒 rate 字节限速，允许积累 1 秒的突发流量。rate 为 0 或 limiter 为 nil 时不限速
+type bandwidthLimiter struct {
+	rate int64
+	mu   sync.Mutex
+	next time.Time // 之前的字节按 rate 发送完毕的时间
+}
+
+func newBandwidthLimiter(rate int64) *bandwidthLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{rate: rate}
+}
+
+// wait 等待到可以再发送 n 字节
+func (l *bandwidthLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if earliest := now.Add(-time.Second); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	grt "runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -42,30 +41,38 @@ type LogWriter struct {
 
 type OptFunc func(logWriter *LogWriter)
 
-func Init() {
-	writers := []io.Writer{
-		NewLogWriters(),
-		os.Stdout,
-	}
-	fileAndStdoutWriter := io.MultiWriter(writers...)
-	log.SetOutput(fileAndStdoutWriter)
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+// Config 日志文件的配置
+type Config struct {
+	Dir                string // 日志目录
+	Prefix             string // 日志文件名前缀
+	Compress           bool   // 是否压缩超过 ReserveDay 的日志
+	ReserveDay         int    // 未压缩日志的保留天数
+	CompressReserveDay int    // 压缩日志的保留天数，不包含 ReserveDay
 }
 
-func NewLogWriters() *LogWriter {
-	var dir string
-	if grt.GOOS == "linux" {
-		dir = "./log"
-	}
-	if grt.GOOS == "windows" || grt.GOOS == "darwin" {
-		dir = "./log"
+// DefaultConfig 默认的日志配置
+func DefaultConfig() Config {
+	return Config{
+		Dir:                "./log",
+		Prefix:             "sync-board",
+		Compress:           true,
+		ReserveDay:         7,
+		CompressReserveDay: 30,
 	}
+}
+
+// Init 将日志同时输出到日志文件和标准输出，返回的 LogWriter 需在退出时关闭
+func Init(config Config) *LogWriter {
+	return NewLogWriters(config)
+}
+
+func NewLogWriters(config Config) *LogWriter {
 	LogWriter, _ := NewLogWriter(
-		Dir(dir),
-		Prefix("sync-board"),
-		CompressReserveDay(30),
-		ReserveDay(7),
-		Compress(true),
+		Dir(config.Dir),
+		Prefix(config.Prefix),
+		CompressReserveDay(config.CompressReserveDay),
+		ReserveDay(config.ReserveDay),
+		Compress(config.Compress),
 	)
 	writers := []io.Writer{
 		LogWriter,
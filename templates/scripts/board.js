@@ -3,6 +3,10 @@ NProgress.configure({showSpinner: false});
 const version = 'v2.3.1-20240926';
 
 window.collapsed = false
+window.boardMaxMessages = 5
+// 由服务端返回的剪贴板信息更新，服务端可配置
+window.boardMaxFileSize = 20 * 1024 * 1024
+window.boardMaxBytes = 100 * 1024 * 1024
 
 let isSmallScreen = false;
 
@@ -16,6 +20,7 @@ const contentData = {
                 </svg>
                 <div id="displayName" placeholder="文件传输" data-i18n-placeholder="file-transfer"></div>
                 <div class="font-body2" data-i18n="tip2">同网络设备可自动发现</div>
+                <a href="#" class="font-body2 pair-link" data-i18n="pair-link">配对其他网络的设备</a>
                 <div id="qrcode"></div>
             </div>
         </div>
@@ -42,6 +47,12 @@ const contentData = {
                           fill="red"/>
                 </svg>
             </div>
+            <div class="lock-icon" id="lock-icon" title="设置密码" onclick="setBoardPassword()">
+                <svg width="20" height="20" viewBox="0 0 24 24" xmlns="http://www.w3.org/2000/svg">
+                    <path d="M18 8h-1V6c0-2.76-2.24-5-5-5S7 3.24 7 6v2H6c-1.1 0-2 .9-2 2v10c0 1.1.9 2 2 2h12c1.1 0 2-.9 2-2V10c0-1.1-.9-2-2-2zm-6 9c-1.1 0-2-.9-2-2s.9-2 2-2 2 .9 2 2-.9 2-2 2zm3.1-9H8.9V6c0-1.71 1.39-3.1 3.1-3.1 1.71 0 3.1 1.39 3.1 3.1v2z"
+                          fill="currentColor"/>
+                </svg>
+            </div>
         </div>
         <div class="input-container">
         <textarea id="messageInput"
@@ -86,6 +97,7 @@ const contentData = {
             </svg>
             <div id="displayName" placeholder="跨设备传输文件的最简便的方法"></div>
             <div class="font-body2" data-i18n="tip2">同一个局网线下的设备可自动发现</div>
+            <a href="#" class="font-body2 pair-link" data-i18n="pair-link">配对其他网络的设备</a>
         </footer>
     </div>
     <div id="card" class="clipboard card">
@@ -110,6 +122,12 @@ const contentData = {
                               fill="red"/>
                     </svg>
                 </div>
+                <div class="lock-icon" id="lock-icon" title="设置密码" onclick="setBoardPassword()">
+                    <svg width="20" height="20" viewBox="0 0 24 24" xmlns="http://www.w3.org/2000/svg">
+                        <path d="M18 8h-1V6c0-2.76-2.24-5-5-5S7 3.24 7 6v2H6c-1.1 0-2 .9-2 2v10c0 1.1.9 2 2 2h12c1.1 0 2-.9 2-2V10c0-1.1-.9-2-2-2zm-6 9c-1.1 0-2-.9-2-2s.9-2 2-2 2 .9 2 2-.9 2-2 2zm3.1-9H8.9V6c0-1.71 1.39-3.1 3.1-3.1 1.71 0 3.1 1.39 3.1 3.1v2z"
+                              fill="currentColor"/>
+                    </svg>
+                </div>
             </div>
             <div class="input-container">
                 <textarea id="messageInput"
@@ -156,26 +174,20 @@ function addMessageInputListener(event) {
 
     document.getElementById('messageInput').addEventListener('paste', function (event) {
         const items = (event.clipboardData || event.originalEvent.clipboardData).items;
-        const maxSize = 20 * 1024 * 1024; // 20MB
+        const formatSize = (n) => Math.floor(n / 1024 / 1024) + 'MB';
 
         const handleFile = (file) => {
-            if (file.size > maxSize) {
-                alert('The file size exceeds the 20MB limit.');
+            if (file.size > window.boardMaxFileSize) {
+                alert('The file size exceeds the ' + formatSize(window.boardMaxFileSize) + ' limit.');
                 return;
             }
-            const reader = new FileReader();
-            reader.onload = (e) => {
-                const base64Image = e.target.result;
-                const message = `${file.name}#${base64Image}`;
-                sendMessage(message);
-            };
-            reader.readAsDataURL(file);
+            uploadFile(file);
         };
 
         const handleText = (item) => {
             item.getAsString((text) => {
-                if (new Blob([text]).size > maxSize) {
-                    alert('The text size exceeds the 20MB limit.');
+                if (new Blob([text]).size > window.boardMaxBytes) {
+                    alert('The text size exceeds the ' + formatSize(window.boardMaxBytes) + ' limit.');
                     return;
                 }
                 sendMessage(text);
@@ -226,6 +238,9 @@ function fetchMessages() {
         .then(data => {
             if (data.code == 200) {
                 updateCountdown(data.data.expireAt)
+                window.boardMaxMessages = data.data.settings.maxMessages;
+                window.boardMaxFileSize = data.data.maxFileSize;
+                window.boardMaxBytes = data.data.settings.maxBytes;
                 const messages = data.data.messages;
                 const messageList = document.getElementById('messages');
                 messageList.innerHTML = '';  // 清空现有的消息
@@ -258,6 +273,8 @@ function fetchMessages() {
                         appendMessage(message, false);
                     });
                 }
+            } else if (data.code == 401) {
+                promptBoardPassword();
             } else {
                 console.error('Error fetching messages:', data);
                 alert(data.message);
@@ -273,6 +290,87 @@ function fetchMessages() {
         });
 }
 
+function promptBoardPassword() {
+    const tip = language == 'zh' ? '该剪贴板已设置密码，请输入密码：' : 'This clipboard is password protected, please enter the password:';
+    const password = prompt(tip);
+    if (password === null) {
+        const currentUrl = new URL(window.location.href);
+        const newPath = currentUrl.pathname.replace(/[^/]+$/, "public");
+        window.location.href = `${currentUrl.origin}${newPath}`;
+        return;
+    }
+    fetch('/boardapi/' + board + '/auth', {
+        method: 'POST', headers: {
+            'Content-Type': 'application/json'
+        }, body: JSON.stringify({password: password})
+    }).then(response => response.json())
+        .then(data => {
+            if (data.code == 200) {
+                fetchMessages();
+            } else {
+                alert(data.message);
+                promptBoardPassword();
+            }
+        })
+        .catch(error => console.error('Error authenticating board:', error));
+}
+
+function setBoardPassword() {
+    const tip = language == 'zh' ? '为当前剪贴板设置密码（仅限尚无内容的新剪贴板）：' : 'Set a password for this clipboard (new and empty clipboards only):';
+    const password = prompt(tip);
+    if (!password) {
+        return;
+    }
+    fetch('/boardapi/' + board + '/password', {
+        method: 'PUT', headers: {
+            'Content-Type': 'application/json'
+        }, body: JSON.stringify({password: password})
+    }).then(response => response.json())
+        .then(data => {
+            if (data.code == 200) {
+                if (language == 'zh') {
+                    Events.fire('notify-user', '剪贴板密码设置成功');
+                } else {
+                    Events.fire('notify-user', 'Clipboard password set');
+                }
+            } else {
+                alert(data.message);
+            }
+        })
+        .catch(error => console.error('Error setting board password:', error));
+}
+
+// 根据服务端推送的剪贴板事件增量更新列表，事件不含记录元数据时重新拉取
+function applyBoardUpdate(update) {
+    if (update.board !== window.board) return;
+
+    const existing = document.querySelector(`#messages li[data-id="${update.id}"]`);
+    switch (update.event) {
+        case 'message-added':
+            if (!update.message) break;
+            if (!existing) {
+                const card = document.getElementById('card');
+                if (card) {
+                    card.style.width = '70%';
+                    card.style.backgroundColor = 'var(--bg-color)';
+                }
+                appendMessage(update.message, true);
+            }
+            updateCountdown(update.expireAt);
+            return;
+        case 'message-deleted':
+            if (existing) {
+                existing.remove();
+            }
+            if (document.querySelectorAll('#messages li').length > 0) {
+                updateCountdown(update.expireAt);
+                return;
+            }
+            break;
+    }
+    fetchMessages();
+}
+
 function addMessage() {
     const input = document.getElementById('messageInput');
     const messageText = input.value.trim();
@@ -283,12 +381,24 @@ function addMessage() {
 }
 
 function sendMessage(content) {
-    NProgress.start();
-    fetch('/boardapi/' + board, {
+    submitMessage(fetch('/boardapi/' + board, {
         method: 'POST', headers: {
             'Content-Type': 'application/json'
         }, body: JSON.stringify({content: content})
-    }).then(response => response.json())
+    }));
+}
+
+function uploadFile(file) {
+    const formData = new FormData();
+    formData.append('file', file, file.name || 'file');
+    submitMessage(fetch('/boardapi/' + board + '/upload', {
+        method: 'POST', body: formData
+    }));
+}
+
+function submitMessage(request) {
+    NProgress.start();
+    request.then(response => response.json())
         .then(data => {
             if (data.code == 200 && data.data.messages && data.data.messages.length > 0) {
                 const card = document.getElementById('card');
@@ -298,7 +408,6 @@ function sendMessage(content) {
                 }
                 updateCountdown(data.data.expireAt)
                 appendMessage(data.data.messages[0], true);
-                snapdrop.send({type: 'board-update', board: window.board})
                 if (language == 'zh') {
                     Events.fire('notify-user', '剪贴板记录添加成功');
                 } else {
@@ -329,6 +438,9 @@ function appendMessage(message, appendMessageToFirst) {
     const messageList = document.getElementById('messages');
     const newMessage = document.createElement('li');
     newMessage.setAttribute('data-id', message.id);
+    if (message.pinned) {
+        newMessage.classList.add('pinned');
+    }
 
     // console.log("message.content: " + message.content);
 
@@ -394,6 +506,15 @@ function appendMessage(message, appendMessageToFirst) {
         buttonsDiv.appendChild(copyButton);
     }
 
+    const pinButton = document.createElement('button');
+    pinButton.className = 'btn btn-secondary btn-sm pin-button';
+    pinButton.title = message.pinned ? "取消置顶" : "置顶";
+    const pinIcon = document.createElement('i');
+    pinIcon.textContent = message.pinned ? '\u{1F4CC}' : '\u{1F4CD}';
+    pinButton.addEventListener('click', () => pinMessage(message.id, !message.pinned));
+    pinButton.appendChild(pinIcon);
+    buttonsDiv.appendChild(pinButton);
+
     const deleteButton = document.createElement('button');
     deleteButton.className = 'btn btn-secondary btn-sm';
     deleteButton.title = "删除";
@@ -411,9 +532,10 @@ function appendMessage(message, appendMessageToFirst) {
         messageList.appendChild(newMessage);
     }
 
-    // 保证 messageList 最多只保留前面 5 条
-    while (messageList.children.length > 5) {
-        messageList.removeChild(messageList.lastChild);
+    // 保证 messageList 最多只保留剪贴板设置的条数，置顶的记录不计入
+    const unpinned = messageList.querySelectorAll('li:not(.pinned)');
+    for (let i = unpinned.length - 1; i >= window.boardMaxMessages; i--) {
+        unpinned[i].remove();
     }
 }
 
@@ -478,6 +600,26 @@ function copyUrlToClipboard() {
     });
 }
 
+function pinMessage(id, pinned) {
+    NProgress.start();
+    fetch(`/boardapi/` + board + `/${id}/pin`, {
+        method: pinned ? 'PUT' : 'DELETE'
+    })
+        .then(response => response.json())
+        .then(data => {
+            if (data.code == 200) {
+                fetchMessages();
+            } else {
+                alert(data.message);
+            }
+        })
+        .catch(error => console.error('Error pinning message:', error))
+        .finally(() => {
+            // Complete the progress bar
+            NProgress.done();
+        });
+}
+
 function deleteMessage(id, messageElement) {
     NProgress.start();
     fetch(`/boardapi/` + board + `/${id}`, {
@@ -512,7 +654,6 @@ function deleteMessage(id, messageElement) {
 
                 updateCountdown(data.data.expireAt)
 
-                snapdrop.send({type: 'board-update', board: window.board})
                 if (language == 'zh') {
                     Events.fire('notify-user', '剪贴板记录删除成功');
                 } else {
@@ -686,6 +827,7 @@ document.addEventListener("DOMContentLoaded", function () {
         }
 
         tooltipIcon.appendChild(tipSpan)
+        document.getElementById('lock-icon').style.display = "none";
     } else {
         tooltipIcon.style.visibility = "hidden";
     }
@@ -1,9 +1,13 @@
 window.URL = window.URL || window.webkitURL;
 window.isRtcSupported = !!(window.RTCPeerConnection || window.mozRTCPeerConnection || window.webkitRTCPeerConnection);
 
+// version of the signaling protocol this client speaks
+const PROTOCOL_VERSION = 1;
+
 class ServerConnection {
 
     constructor() {
+        this._takePairToken();
         this._connect();
         Events.on('beforeunload', e => this._disconnect());
         Events.on('pagehide', e => this._disconnect());
@@ -26,6 +30,35 @@ class ServerConnection {
         msg = JSON.parse(msg);
         console.log('WS:', msg);
         switch (msg.type) {
+            case 'hello':
+                this._protocolVersion = msg.version;
+                window.isPaired = msg.paired;
+                if (msg.iceServers) RTCPeer.config.iceServers = msg.iceServers;
+                if (this._pairToken) {
+                    this.send({type: 'pair-join', token: this._pairToken});
+                    this._pairToken = null;
+                }
+                break;
+            case 'error':
+                console.error('WS: server rejected', msg.requestType || 'connection', msg.code, msg.message);
+                if (['pair-request', 'pair-join', 'unpair'].includes(msg.requestType)) {
+                    Events.fire('pair-error', msg);
+                }
+                break;
+            case 'pair-code':
+                Events.fire('pair-code', msg);
+                break;
+            case 'paired':
+                window.isPaired = true;
+                Events.fire('paired', msg);
+                break;
+            case 'relay':
+                Events.fire('relay', msg);
+                break;
+            case 'ice-servers':
+                // fresh TURN credentials, used by connections created from now on
+                RTCPeer.config.iceServers = msg.iceServers;
+                break;
             case 'peers':
                 Events.fire('peers', msg.peers);
                 break;
@@ -45,7 +78,11 @@ class ServerConnection {
                 Events.fire('display-name', msg);
                 break;
             case 'board-update':
-                fetchMessages();
+                applyBoardUpdate(msg);
+                break;
+            case 'server-restarting':
+                // spread reconnects so that restarted servers are not hit by every client at once
+                this._reconnectDelay = msg.reconnectAfter + Math.random() * msg.reconnectAfter;
                 break;
             default:
                 console.error('WS: unkown message type', msg);
@@ -57,16 +94,30 @@ class ServerConnection {
         this._socket.send(JSON.stringify(message));
     }
 
+    // the QR code of a pairing code opens this page with ?pair=<token>, join with it once connected
+    _takePairToken() {
+        const url = new URL(location.href);
+        this._pairToken = url.searchParams.get('pair');
+        if (!this._pairToken) return;
+        url.searchParams.delete('pair');
+        history.replaceState(null, '', url.pathname + url.search + url.hash);
+    }
+
     _endpoint() {
         // hack to detect if deployment or development environment
         const protocol = location.protocol.startsWith('https') ? 'wss' : 'ws';
-        const webrtc = window.isRtcSupported ? '/webrtc' : '/fallback';
-        const url = protocol + '://' + location.host + '/server' + webrtc;
+        const rtc = window.isRtcSupported ? 1 : 0;
+        const url = protocol + '://' + location.host + '/server/webrtc?v=' + PROTOCOL_VERSION + '&rtc=' + rtc;
         // const url = 'ws://192.168.2.10:18129/server/webrtc';
 
         return url;
     }
 
+    relayEndpoint(query) {
+        const protocol = location.protocol.startsWith('https') ? 'wss' : 'ws';
+        return protocol + '://' + location.host + '/server/relay?v=' + PROTOCOL_VERSION + '&' + query;
+    }
+
     _disconnect() {
         this.send({type: 'disconnect'});
         this._socket.onclose = null;
@@ -81,7 +132,9 @@ class ServerConnection {
         //     Events.fire('notify-user', '连接丢失，5秒后重试...');
         // }
         clearTimeout(this._reconnectTimer);
-        this._reconnectTimer = setTimeout(_ => this._connect(), 5000);
+        const delay = this._reconnectDelay !== undefined ? this._reconnectDelay : 5000;
+        this._reconnectDelay = undefined;
+        this._reconnectTimer = setTimeout(_ => this._connect(), delay);
     }
 
     _onVisibilityChange() {
@@ -324,6 +377,7 @@ class RTCPeer extends Peer {
             case 'failed':
                 this._conn = null;
                 this._onChannelClosed();
+                Events.fire('peer-rtc-failed', this._peerId);
                 break;
         }
     }
@@ -378,6 +432,9 @@ class PeersManager {
         Events.on('files-selected', e => this._onFilesSelected(e.detail));
         Events.on('send-text', e => this._onSendText(e.detail));
         Events.on('peer-left', e => this._onPeerLeft(e.detail));
+        Events.on('peer-joined', e => this._onPeerJoined(e.detail));
+        Events.on('relay', e => this._onRelay(e.detail));
+        Events.on('peer-rtc-failed', e => this._onRTCFailed(e.detail));
     }
 
     _onMessage(message) {
@@ -401,6 +458,27 @@ class PeersManager {
         })
     }
 
+    // the joining peer calls us over WebRTC, but without WebRTC either side may open a relay first
+    _onPeerJoined(peer) {
+        if (this.peers[peer.id] || (window.isRtcSupported && peer.rtcSupported)) return;
+        this.peers[peer.id] = new WSPeer(this._server, peer.id);
+    }
+
+    _onRelay(message) {
+        if (!(this.peers[message.sender] instanceof WSPeer)) {
+            this.peers[message.sender] = new WSPeer(this._server, message.sender);
+            Events.fire('peer-relay-ready', message.sender);
+        }
+        this.peers[message.sender].onRelay(message);
+    }
+
+    // WebRTC is blocked between us, e.g. by a corporate firewall, fall back to the relay
+    _onRTCFailed(peerId) {
+        if (!(this.peers[peerId] instanceof RTCPeer)) return;
+        this.peers[peerId] = new WSPeer(this._server, peerId);
+        Events.fire('peer-relay-ready', peerId);
+    }
+
     sendTo(peerId, message) {
         this.peers[peerId].send(message);
     }
@@ -416,16 +494,93 @@ class PeersManager {
     _onPeerLeft(peerId) {
         const peer = this.peers[peerId];
         delete this.peers[peerId];
+        if (peer instanceof WSPeer) return peer.close();
         if (!peer || !peer._peer) return;
         peer._peer.close();
     }
 
 }
 
-class WSPeer {
+// relays the messages through the server for peers that can't connect over WebRTC
+class WSPeer extends Peer {
+
+    constructor(serverConnection, peerId) {
+        super(serverConnection, peerId);
+        this._queue = [];
+        this._sockets = new Set();
+    }
+
+    // messages go through the first relay that is ready until it is closed, a relay is opened on demand
     _send(message) {
-        message.to = this._peerId;
-        this._server.send(message);
+        if (this._socket) return this._socket.send(message);
+        this._queue.push(message);
+        if (!this._opening) this._opening = this._open('to=' + encodeURIComponent(this._peerId), false);
+    }
+
+    // the peer opened a relay to us
+    onRelay(message) {
+        this._open('id=' + encodeURIComponent(message.id), true);
+    }
+
+    _open(query, accepted) {
+        const socket = new WebSocket(this._server.relayEndpoint(query));
+        socket.binaryType = 'arraybuffer';
+        // the opening side waits for relay-ready, which the server sends once the peer accepted
+        socket.onopen = e => accepted && this._onReady(socket);
+        socket.onmessage = e => this._onRelayMessage(socket, e.data);
+        socket.onclose = e => this._onRelayClosed(socket, e);
+        this._sockets.add(socket);
+        return socket;
+    }
+
+    _onRelayMessage(socket, data) {
+        if (socket === this._opening && typeof data === 'string' && JSON.parse(data).type === 'relay-ready') {
+            this._opening = null;
+            this._onReady(socket);
+            return;
+        }
+        this._onMessage(data);
+    }
+
+    _onReady(socket) {
+        if (this._socket) return;
+        console.log('WS: relay opened with', this._peerId);
+        this._socket = socket;
+        const queue = this._queue;
+        this._queue = [];
+        queue.forEach(message => socket.send(message));
+    }
+
+    _onRelayClosed(socket, e) {
+        this._sockets.delete(socket);
+        if (socket === this._opening) this._opening = null;
+        if (socket === this._socket) this._socket = null;
+        if (e.code === 1000 || e.code === 1005) return;
+
+        console.error('WS: relay closed', e.code, e.reason);
+        if (!this._busy && !this._queue.length) return;
+        // give up the current file, the rest of the queue is sent over a new relay
+        this._queue = [];
+        this._chunker = null;
+        this._busy = false;
+        if (e.reason === 'transfer-too-large') {
+            Events.fire('notify-user', language == 'zh' ? '文件过大，无法经服务器中转。' : 'The file is too large to be relayed by the server.');
+        } else {
+            Events.fire('notify-user', language == 'zh' ? '文件传输失败。' : 'File transfer failed.');
+        }
+        this._dequeueFile();
+    }
+
+    // each file is relayed over its own connection, so the byte cap of the server applies per file
+    _onTransferCompleted() {
+        const socket = this._socket;
+        this._socket = null;
+        if (socket) socket.close();
+        super._onTransferCompleted();
+    }
+
+    close() {
+        this._sockets.forEach(socket => socket.close());
     }
 }
 
@@ -22,6 +22,7 @@ class PeersUI {
         Events.on('file-progress', e => this._onFileProgress(e.detail));
         // Events.on('paste', e => this._onPaste(e));
         Events.on('peer-rtc-connected', e => this._onRTCConnectable(e.detail));
+        Events.on('peer-relay-ready', e => this._onRTCConnectable(e.detail));
     }
 
     _onPeerJoined(peer) {
@@ -107,7 +108,8 @@ class PeerUI {
         el.id = this._peer.id;
         el.innerHTML = this.html();
         el.ui = this;
-        el.classList.add('disabled')
+        // peers without WebRTC are reachable through the relay right away
+        if (window.isRtcSupported && this._peer.rtcSupported) el.classList.add('disabled')
         el.querySelector('svg use').setAttribute('xlink:href', this._icon());
         el.querySelector('.name').textContent = this._displayName();
         el.querySelector('.device-name').textContent = this._deviceName();
@@ -389,6 +391,99 @@ class ReceiveTextDialog extends Dialog {
     }
 }
 
+class PairDialog extends Dialog {
+    constructor() {
+        super('pairDialog');
+        this.$code = this.$el.querySelector('#pairCode');
+        this.$qrcode = this.$el.querySelector('#pairQrcode');
+        this.$input = this.$el.querySelector('#pairCodeInput');
+        this.$unpair = this.$el.querySelector('#unpair');
+        this.$el.querySelector('#pairRequest').addEventListener('click', _ => this._request());
+        this.$el.querySelector('form').addEventListener('submit', e => this._join(e));
+        this.$unpair.addEventListener('click', _ => this._unpair());
+        // the pair link is re-rendered with the board layout, so listen on the document
+        document.addEventListener('click', e => {
+            if (!e.target.closest('.pair-link')) return;
+            e.preventDefault();
+            this.show();
+        });
+        Events.on('pair-code', e => this._onCode(e.detail));
+        Events.on('paired', e => this._onPaired());
+        Events.on('pair-error', e => this._onError(e.detail));
+    }
+
+    show() {
+        this.$unpair.hidden = !window.isPaired;
+        super.show();
+    }
+
+    hide() {
+        clearTimeout(this._expireTimer);
+        this.$code.textContent = '';
+        this.$qrcode.innerHTML = '';
+        this.$input.value = '';
+        super.hide();
+    }
+
+    _request() {
+        snapdrop.send({type: 'pair-request'});
+    }
+
+    _onCode(msg) {
+        this.$code.textContent = msg.code;
+        this.$qrcode.innerHTML = '';
+        new QRCode(this.$qrcode, {
+            text: location.origin + location.pathname + '?pair=' + encodeURIComponent(msg.token),
+            width: 128, height: 128
+        });
+        clearTimeout(this._expireTimer);
+        this._expireTimer = setTimeout(_ => {
+            this.$code.textContent = '';
+            this.$qrcode.innerHTML = '';
+        }, msg.expiresIn * 1000);
+    }
+
+    _join(e) {
+        e.preventDefault();
+        const code = this.$input.value.trim();
+        if (!/^\d{8}$/.test(code)) {
+            Events.fire('notify-user', language == 'zh' ? '请输入 8 位数字配对码' : 'Please enter the 8-digit pairing code');
+            return;
+        }
+        snapdrop.send({type: 'pair-join', code: code});
+    }
+
+    _unpair() {
+        snapdrop.send({type: 'unpair'});
+        window.isPaired = false;
+        this.hide();
+        Events.fire('notify-user', language == 'zh' ? '已解除配对' : 'Unpaired');
+    }
+
+    _onPaired() {
+        this.hide();
+        Events.fire('notify-user', language == 'zh' ? '配对成功' : 'Paired successfully');
+    }
+
+    _onError(msg) {
+        let text;
+        switch (msg.code) {
+            case 'invalid-pairing-code':
+                text = language == 'zh' ? '配对码无效或已过期' : 'The pairing code is invalid or expired';
+                break;
+            case 'too-many-attempts':
+                text = language == 'zh' ? '尝试次数过多，请稍后再试' : 'Too many attempts, please try again later';
+                break;
+            case 'pairing-code-revoked':
+                text = language == 'zh' ? '配对码被多次输错已失效，请重新生成' : 'The pairing code was revoked after too many wrong attempts, please create a new one';
+                break;
+            default:
+                text = language == 'zh' ? '配对失败，请稍后再试' : 'Pairing failed, please try again later';
+        }
+        Events.fire('notify-user', text);
+    }
+}
+
 class Toast extends Dialog {
     constructor() {
         super('toast');
@@ -546,6 +641,7 @@ class Snapdrop {
             const receiveDialog = new ReceiveDialog();
             const sendTextDialog = new SendTextDialog();
             const receiveTextDialog = new ReceiveTextDialog();
+            const pairDialog = new PairDialog();
             const toast = new Toast();
             const notifications = new Notifications();
             const networkStatusUI = new NetworkStatusUI();